@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+)
+
+// AuthEventType identifies the point of the server handshake an AuthEvent
+// records.
+type AuthEventType int
+
+const (
+	// AuthEventChallengeIssued is recorded once auth_challenge was sent.
+	AuthEventChallengeIssued AuthEventType = iota + 1
+
+	// AuthEventProofReceived is recorded once an auth_proof frame arrived,
+	// before it is verified.
+	AuthEventProofReceived
+
+	// AuthEventSucceeded is recorded once auth_ok was sent.
+	AuthEventSucceeded
+
+	// AuthEventFailed is recorded when the handshake fails, whether the
+	// server rejected it or the connection failed.
+	AuthEventFailed
+
+	// AuthEventTicketRejected is recorded when a resumption ticket presented
+	// in auth_begin was not accepted, with the reason in Err. The handshake
+	// continues with a challenge.
+	AuthEventTicketRejected
+)
+
+func (t AuthEventType) String() string {
+	switch t {
+	case AuthEventChallengeIssued:
+		return "challenge_issued"
+	case AuthEventProofReceived:
+		return "proof_received"
+	case AuthEventSucceeded:
+		return "succeeded"
+	case AuthEventFailed:
+		return "failed"
+	case AuthEventTicketRejected:
+		return "ticket_rejected"
+	default:
+		return fmt.Sprintf("AuthEventType(%d)", int(t))
+	}
+}
+
+// AuthEvent is one audit record of a server handshake. Every handshake ends
+// with exactly one AuthEventSucceeded or AuthEventFailed event.
+type AuthEvent struct {
+	Type AuthEventType
+
+	// Time is when the event was recorded, from the WithClock time source.
+	Time time.Time
+
+	// RemoteAddr is the client's address, or empty if the transport does not
+	// report one.
+	RemoteAddr string
+
+	// AgentID and Label are what the client presented in auth_begin, empty
+	// if it was not read. Only for AuthEventSucceeded has the client proven
+	// it holds AgentID's key; see AuthResult.Label for the label's trust.
+	AgentID string
+	Label   string
+
+	// ChallengeID identifies the challenge issued, once there is one.
+	ChallengeID string
+
+	// Resumed reports that the agent redeemed a resumption ticket, so no
+	// challenge was issued.
+	Resumed bool
+
+	// Code is the auth_error code sent to the client for AuthEventFailed, or
+	// empty if the handshake failed without one, e.g. because the connection
+	// dropped or timed out.
+	Code string
+
+	// Err is the error WaitForAgentAuthentication returns, for
+	// AuthEventFailed, or why the ticket was rejected, for
+	// AuthEventTicketRejected. It may hold details withheld from the client.
+	Err error
+}
+
+// AuditSink receives an AuthEvent for every decision point of each server
+// handshake; see WithAuditSink.
+type AuditSink interface {
+	// Event records ev. It is called synchronously on the handshake's
+	// goroutine, so a slow sink delays the handshake; a sink that must not
+	// lose events should persist them before returning, and one that must
+	// be fast should queue them.
+	Event(ev AuthEvent)
+}
+
+// WithAuditSink makes the server report each handshake to sink: when the
+// challenge is issued, when the proof arrives, and on success or failure.
+// Sinks are shared between handshakes and must be safe for concurrent use.
+// By default nothing is recorded.
+func WithAuditSink(sink AuditSink) Option {
+	return func(cfg *config) {
+		cfg.auditSink = sink
+	}
+}
+
+// audit records an event of type typ, built from ev, if a sink is set.
+func (cfg *config) audit(typ AuthEventType, ev AuthEvent) {
+	if cfg.auditSink == nil {
+		return
+	}
+	ev.Type = typ
+	ev.Time = cfg.now()
+	cfg.auditSink.Event(ev)
+}
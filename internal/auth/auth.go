@@ -5,7 +5,10 @@ import (
 	"crypto/ed25519"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"strings"
+	"syscall"
 	"time"
 
 	"switchboard/internal/protocol"
@@ -15,47 +18,155 @@ var (
 	readTimeout  = 30 * time.Second
 	writeTimeout = 5 * time.Second
 	challengeTTL = 30 * time.Second
+
+	// rejectLinger bounds how long RejectConnection waits for the client to
+	// close.
+	rejectLinger = time.Second
 )
 
-func AuthenticateAsClient(connection *protocol.Conn) error {
+// maxLabelLen bounds the optional agent label presented in auth_begin.
+const maxLabelLen = 128
+
+// AuthResult describes an agent authenticated by WaitForAgentAuthentication,
+// or, on the client, the outcome returned by AuthenticateAsClient.
+type AuthResult struct {
+	// AgentID is the verified agent identity (hex sha256 of its public key).
+	// It is the only field that may be used for authorization decisions.
+	AgentID string
+
+	// Label is the optional human-readable name the agent presented in
+	// auth_begin. Unless LabelSigned is set it is not covered by the
+	// signature, so any agent holding a valid key can claim any label: use it
+	// for logs and dashboards, never for authorization.
+	Label string
+
+	// LabelSigned reports whether the agent signed with v2, binding Label to
+	// its key.
+	LabelSigned bool
+
+	// AuthenticatedAt is when the server accepted the proof.
+	AuthenticatedAt time.Time
+
+	// Resumed reports whether the agent authenticated by redeeming a
+	// resumption ticket instead of answering a challenge. The ticket
+	// signature binds the label, so LabelSigned is then set too.
+	Resumed bool
+
+	// Ticket is the resumption ticket the server issued in auth_ok, for
+	// WithTicket on the next connection. It is set on the client only, and
+	// only if the server issues tickets.
+	Ticket *Ticket
+
+	// ServerInfo is the metadata the server sent in auth_ok (node ID, region,
+	// ...), set on the client only. auth_ok is not signed: ServerInfo is as
+	// trustworthy as the TLS connection it arrived on.
+	ServerInfo map[string]string
+}
+
+// AuthenticateAsClient runs the agent side of the handshake on connection and
+// returns the result as reported by the server in auth_ok.
+// Every blocking step honors ctx in addition to the per-step timeouts, so
+// cancelling ctx aborts the handshake promptly with ctx.Err().
+func AuthenticateAsClient(ctx context.Context, connection *protocol.Conn, opts ...Option) (AuthResult, error) {
 	if connection == nil {
-		return errors.New("nil connection")
+		return AuthResult{}, errors.New("nil connection")
+	}
+	priv, _, _, err := loadOrCreateAgentKey()
+	if err != nil {
+		return AuthResult{}, err
 	}
+	return authenticateAsClient(ctx, connection, priv, newConfig(opts))
+}
+
+// AuthenticateAsClientWithKey is like AuthenticateAsClient but authenticates
+// as priv instead of loading the agent key, so the keystore (files and
+// environment variables) is never touched. The agent ID is derived from priv.
+func AuthenticateAsClientWithKey(ctx context.Context, connection *protocol.Conn, priv ed25519.PrivateKey, opts ...Option) (AuthResult, error) {
+	if connection == nil {
+		return AuthResult{}, errors.New("nil connection")
+	}
+	if l := len(priv); l != ed25519.PrivateKeySize {
+		return AuthResult{}, fmt.Errorf("invalid ed25519 private key: length %d (want %d)", l, ed25519.PrivateKeySize)
+	}
+	return authenticateAsClient(ctx, connection, priv, newConfig(opts))
+}
 
-	priv, _, agentID, err := loadOrCreateAgentKey()
+func authenticateAsClient(ctx context.Context, connection *protocol.Conn, priv ed25519.PrivateKey, cfg *config) (AuthResult, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	agentID, err := cfg.agentIDDerivation.AgentID(priv.Public().(ed25519.PublicKey))
 	if err != nil {
-		return err
+		return AuthResult{}, err
 	}
 
 	begin := authBegin{
 		Type:         "auth_begin",
 		V:            authVersion,
 		AgentID:      agentID,
-		ClientTimeMS: nowMS(),
+		ClientTimeMS: cfg.nowMS(),
+		Label:        cfg.label,
+	}
+	resuming := cfg.ticket != nil && cfg.ticket.Value != "" && cfg.now().Before(cfg.ticket.ExpiresAt)
+	if resuming {
+		begin.Ticket = cfg.ticket.Value
+		toSign := stringToSignTicket(agentID, begin.Ticket, begin.ClientTimeMS, begin.Label)
+		begin.TicketSig = b64Encode(ed25519.Sign(priv, []byte(toSign)))
 	}
 	beginPayload, err := mustMarshalJSON(begin)
 	if err != nil {
-		return err
+		return AuthResult{}, err
 	}
-	if err := sendAuth(connection, protocol.TypeAuthBegin, beginPayload); err != nil {
-		return err
+	if err := sendAuth(ctx, connection, protocol.TypeAuthBegin, beginPayload); err != nil {
+		return AuthResult{}, err
 	}
 
-	// Challenge.
-	chMsg, err := readAuth(connection, protocol.TypeAuthChallenge)
+	// Challenge. The server may reject auth_begin outright with auth_error,
+	// possibly sent before it even read auth_begin; see RejectConnection.
+	// If it accepted our ticket it skips the challenge and replies auth_ok.
+	chMsg, err := readServerReply(ctx, connection)
 	if err != nil {
-		return err
+		return AuthResult{}, err
+	}
+	if resuming && chMsg.Type == protocol.TypeAuthOK {
+		return acceptAuthOK(connection, cfg, chMsg.Payload, AuthResult{
+			AgentID:     agentID,
+			Label:       cfg.label,
+			LabelSigned: true,
+			Resumed:     true,
+		})
+	}
+	switch chMsg.Type {
+	case protocol.TypeAuthChallenge:
+	case protocol.TypeAuthError:
+		return AuthResult{}, remoteAuthError(chMsg.Payload)
+	default:
+		_ = connection.Close()
+		return AuthResult{}, fmt.Errorf("unexpected frame type %d (want %d)", chMsg.Type, protocol.TypeAuthChallenge)
 	}
-	challenge, err := unmarshalAndValidate[authChallenge](chMsg.Payload, "auth_challenge")
+	challenge, err := parseChallenge(chMsg.Payload)
 	if err != nil {
-		return err
-	}
-	if strings.TrimSpace(challenge.ChallengeID) == "" || strings.TrimSpace(challenge.Nonce) == "" {
-		return errors.New("invalid auth_challenge (missing challenge_id/nonce)")
+		return AuthResult{}, err
 	}
 
-	// Proof.
-	toSign := stringToSignV1(agentID, challenge.ChallengeID, challenge.Nonce, challenge.IssuedAtMS)
+	// Proof. Sign with the version the server advertises. Without one, sign
+	// with v2 when a label is presented so that it is bound to the key, and
+	// with v1 otherwise.
+	sigV := challenge.SigV
+	if sigV == 0 && cfg.label != "" {
+		sigV = signingV2
+	}
+	toSign, ok := stringToSign(sigV, signingInput{
+		agentID:     agentID,
+		challengeID: challenge.ChallengeID,
+		nonce:       challenge.Nonce,
+		issuedAtMS:  challenge.IssuedAtMS,
+		label:       cfg.label,
+	})
+	if !ok {
+		_ = connection.Close()
+		return AuthResult{}, fmt.Errorf("server requires unsupported signing version %d", sigV)
+	}
 	sig := ed25519.Sign(priv, []byte(toSign))
 	proof := authProof{
 		Type:        "auth_proof",
@@ -65,92 +176,217 @@ func AuthenticateAsClient(connection *protocol.Conn) error {
 		Nonce:       challenge.Nonce,
 		IssuedAtMS:  challenge.IssuedAtMS,
 		Signature:   b64Encode(sig),
+		SigV:        sigV,
 	}
 	proofPayload, err := mustMarshalJSON(proof)
 	if err != nil {
-		return err
+		return AuthResult{}, err
 	}
-	if err := sendAuth(connection, protocol.TypeAuthProof, proofPayload); err != nil {
-		return err
+	if err := sendAuth(ctx, connection, protocol.TypeAuthProof, proofPayload); err != nil {
+		return AuthResult{}, err
 	}
 
 	// Result.
-	msg, err := readNextWithTimeout(connection, readTimeout)
+	msg, err := readServerReply(ctx, connection)
 	if err != nil {
-		return err
+		return AuthResult{}, err
 	}
 	switch msg.Type {
 	case protocol.TypeAuthOK:
-		ok, err := unmarshalAndValidate[authOK](msg.Payload, "auth_ok")
-		if err != nil {
-			return err
-		}
-		if ok.AgentID != agentID {
-			return fmt.Errorf("auth_ok agent_id mismatch: got %q want %q", ok.AgentID, agentID)
-		}
-		return nil
+		return acceptAuthOK(connection, cfg, msg.Payload, AuthResult{
+			AgentID:     agentID,
+			Label:       cfg.label,
+			LabelSigned: sigV == signingV2,
+		})
 
 	case protocol.TypeAuthError:
-		ae, err := unmarshalAndValidate[authError](msg.Payload, "auth_error")
-		if err != nil {
-			return err
-		}
-		if ae.Message != "" {
-			return fmt.Errorf("authentication failed: %s (%s)", ae.Code, ae.Message)
-		}
-		return fmt.Errorf("authentication failed: %s", ae.Code)
+		return AuthResult{}, remoteAuthError(msg.Payload)
 
 	default:
 		_ = connection.Close()
-		return fmt.Errorf("unexpected frame type %d while waiting for auth result", msg.Type)
+		return AuthResult{}, fmt.Errorf("unexpected frame type %d while waiting for auth result", msg.Type)
 	}
 }
 
-func WaitForAgentAuthentication(connection *protocol.Conn, lookupPublicKey func(agentID string) (ed25519.PublicKey, bool)) error {
+// acceptAuthOK validates the server's auth_ok against result, which holds
+// what the client presented, and completes result from it.
+func acceptAuthOK(connection *protocol.Conn, cfg *config, payload []byte, result AuthResult) (AuthResult, error) {
+	ok, err := unmarshalAndValidate[authOK](payload, "auth_ok")
+	if err != nil {
+		return AuthResult{}, err
+	}
+	if ok.AgentID != result.AgentID {
+		return AuthResult{}, fmt.Errorf("auth_ok agent_id mismatch: got %q want %q", ok.AgentID, result.AgentID)
+	}
+	if cfg.maxServerClockSkew > 0 {
+		skew := time.Duration(ok.AuthenticatedAtMS-cfg.nowMS()) * time.Millisecond
+		if skew < -cfg.maxServerClockSkew || skew > cfg.maxServerClockSkew {
+			_ = connection.Close()
+			return AuthResult{}, fmt.Errorf("auth_ok authenticated_at_ms is off by %s from local time", skew)
+		}
+	}
+	connection.MarkAuthenticated()
+	result.AuthenticatedAt = time.UnixMilli(ok.AuthenticatedAtMS)
+	result.ServerInfo = ok.ServerInfo
+	if ok.Ticket != "" {
+		result.Ticket = &Ticket{Value: ok.Ticket, ExpiresAt: time.UnixMilli(ok.TicketExpiresAtMS)}
+	}
+	return result, nil
+}
+
+// ProbeServer checks that the server accepts agentID and issues a well-formed
+// challenge, without authenticating. It sends auth_begin, validates the
+// auth_challenge it receives and closes the connection.
+//
+// ProbeServer intentionally never sends an auth_proof: the challenge is left
+// unanswered and expires on the server, so no authentication is completed or
+// recorded. It is meant as a lightweight reachability and compatibility check.
+func ProbeServer(ctx context.Context, connection *protocol.Conn, agentID string, opts ...Option) error {
 	if connection == nil {
 		return errors.New("nil connection")
 	}
-	if lookupPublicKey == nil {
-		return errors.New("lookupPublicKey is nil")
+	if strings.TrimSpace(agentID) == "" {
+		return errors.New("missing agent_id")
 	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	cfg := newConfig(opts)
+	defer connection.Close()
 
-	beginMsg, err := readAuth(connection, protocol.TypeAuthBegin)
+	beginPayload, err := mustMarshalJSON(authBegin{
+		Type:         "auth_begin",
+		V:            authVersion,
+		AgentID:      agentID,
+		ClientTimeMS: cfg.nowMS(),
+	})
 	if err != nil {
 		return err
 	}
-	begin, err := unmarshalAndValidate[authBegin](beginMsg.Payload, "auth_begin")
+	if err := sendAuth(ctx, connection, protocol.TypeAuthBegin, beginPayload); err != nil {
+		return err
+	}
+
+	msg, err := readServerReply(ctx, connection)
 	if err != nil {
-		_ = connection.Close()
 		return err
 	}
+	switch msg.Type {
+	case protocol.TypeAuthChallenge:
+		_, err := parseChallenge(msg.Payload)
+		return err
+	case protocol.TypeAuthError:
+		return remoteAuthError(msg.Payload)
+	default:
+		return fmt.Errorf("unexpected frame type %d (want %d)", msg.Type, protocol.TypeAuthChallenge)
+	}
+}
+
+func WaitForAgentAuthentication(connection *protocol.Conn, lookupPublicKey func(agentID string) (ed25519.PublicKey, bool), opts ...Option) (AuthResult, error) {
+	if connection == nil {
+		return AuthResult{}, errors.New("nil connection")
+	}
+	if lookupPublicKey == nil {
+		return AuthResult{}, errors.New("lookupPublicKey is nil")
+	}
+	cfg := newConfig(opts)
+	if _, ok := signingVersions[cfg.signingVersion]; cfg.signingVersion != 0 && !ok {
+		return AuthResult{}, fmt.Errorf("unsupported signing version %d", cfg.signingVersion)
+	}
+
+	var ev AuthEvent
+	if addr := connection.RemoteAddr(); addr != nil {
+		ev.RemoteAddr = addr.String()
+	}
+	result, err := waitForAgentAuthentication(connection, lookupPublicKey, cfg, &ev)
+	if err != nil {
+		ev.Err = err
+		var rejection *serverRejection
+		if errors.As(err, &rejection) {
+			ev.Code = rejection.code
+		}
+		cfg.audit(AuthEventFailed, ev)
+		return AuthResult{}, err
+	}
+	cfg.audit(AuthEventSucceeded, ev)
+	return result, nil
+}
+
+// waitForAgentAuthentication runs the server side of the handshake, filling
+// in ev as the client identifies itself for the audit events.
+func waitForAgentAuthentication(connection *protocol.Conn, lookupPublicKey func(agentID string) (ed25519.PublicKey, bool), cfg *config, ev *AuthEvent) (AuthResult, error) {
+	ctx := context.Background()
+
+	beginMsg, err := readAuth(ctx, connection, protocol.TypeAuthBegin)
+	if err != nil {
+		return AuthResult{}, err
+	}
+	begin, err := unmarshalAndValidate[authBegin](beginMsg.Payload, "auth_begin")
+	if err != nil {
+		return AuthResult{}, rejectInvalid(connection, "auth_begin", err)
+	}
 	agentID := begin.AgentID
+	ev.AgentID, ev.Label = agentID, begin.Label
 	if strings.TrimSpace(agentID) == "" {
-		return failAuth(connection, "protocol_error", "missing agent_id")
+		return AuthResult{}, failAuth(connection, "protocol_error", "missing agent_id")
+	}
+	if cfg.deniedAgentIDs[agentID] {
+		return AuthResult{}, failAuth(connection, "denied_agent", "")
+	}
+	if len(begin.Label) > maxLabelLen {
+		return AuthResult{}, failAuth(connection, "protocol_error", "label too long")
+	}
+	if cfg.maxClockSkew > 0 && begin.ClientTimeMS != 0 {
+		skew := time.Duration(cfg.nowMS()-begin.ClientTimeMS) * time.Millisecond
+		if skew < -cfg.maxClockSkew || skew > cfg.maxClockSkew {
+			return AuthResult{}, failAuth(connection, "clock_skew", fmt.Sprintf("client clock off by %s", skew))
+		}
 	}
 
 	pub, ok := lookupPublicKey(agentID)
 	if !ok {
-		return failAuth(connection, "unknown_agent", "")
+		return AuthResult{}, failAuth(connection, "unknown_agent", "")
 	}
-	expectedAgentID, err := agentIDFromPublicKey(pub)
+	expectedAgentID, err := cfg.agentIDDerivation.AgentID(pub)
 	if err != nil {
-		return failAuth(connection, "internal_error", "invalid configured public key")
+		return AuthResult{}, failAuth(connection, "internal_error", "invalid configured public key")
 	}
 	if agentID != expectedAgentID {
-		// Registry must be self-consistent: agent_id is sha256(pubkey).
-		return failAuth(connection, "unknown_agent", "")
+		// Registry must be self-consistent: agent_id is derived from pubkey.
+		return AuthResult{}, failAuth(connection, "unknown_agent", "")
+	}
+
+	// Resumption. The ticket is only redeemed once the agent passed every
+	// check above, so revoking its key also revokes its tickets. A rejected
+	// ticket merely costs the client the challenge round trip it tried to
+	// save, since answering the challenge requires the agent key anyway.
+	if begin.Ticket != "" && cfg.ticketIssuer != nil {
+		err := cfg.ticketIssuer.redeem(begin, pub, cfg.now())
+		if err == nil {
+			ev.Resumed = true
+			return sendAuthOK(ctx, connection, cfg, AuthResult{
+				AgentID:         agentID,
+				Label:           begin.Label,
+				LabelSigned:     true,
+				AuthenticatedAt: cfg.now(),
+				Resumed:         true,
+			})
+		}
+		rejected := *ev
+		rejected.Err = err
+		cfg.audit(AuthEventTicketRejected, rejected)
 	}
 
-	issuedAt := nowMS()
+	issuedAt := cfg.nowMS()
 	expiresAt := issuedAt + int64(challengeTTL/time.Millisecond)
 
-	nonceBytes, err := randomBytes(32)
+	nonceBytes, err := cfg.randomBytes(32)
 	if err != nil {
-		return failAuth(connection, "internal_error", "nonce generation failed")
+		return AuthResult{}, failAuth(connection, "internal_error", "nonce generation failed")
 	}
-	challengeIDBytes, err := randomBytes(24)
+	challengeIDBytes, err := cfg.randomBytes(24)
 	if err != nil {
-		return failAuth(connection, "internal_error", "challenge_id generation failed")
+		return AuthResult{}, failAuth(connection, "internal_error", "challenge_id generation failed")
 	}
 	ch := authChallenge{
 		Type:        "auth_challenge",
@@ -159,77 +395,129 @@ func WaitForAgentAuthentication(connection *protocol.Conn, lookupPublicKey func(
 		Nonce:       b64Encode(nonceBytes),
 		IssuedAtMS:  issuedAt,
 		ExpiresAtMS: expiresAt,
+		SigV:        cfg.signingVersion,
 	}
 	chPayload, err := mustMarshalJSON(ch)
 	if err != nil {
-		return err
+		return AuthResult{}, err
 	}
-	if err := sendAuth(connection, protocol.TypeAuthChallenge, chPayload); err != nil {
+	if err := sendAuth(ctx, connection, protocol.TypeAuthChallenge, chPayload); err != nil {
 		_ = connection.Close()
-		return err
+		return AuthResult{}, err
 	}
+	ev.ChallengeID = ch.ChallengeID
+	cfg.audit(AuthEventChallengeIssued, *ev)
 
-	proofMsg, err := readAuth(connection, protocol.TypeAuthProof)
+	proofMsg, err := readAuth(ctx, connection, protocol.TypeAuthProof)
 	if err != nil {
 		_ = connection.Close()
-		return err
+		return AuthResult{}, err
 	}
+	cfg.audit(AuthEventProofReceived, *ev)
 	proof, err := unmarshalAndValidate[authProof](proofMsg.Payload, "auth_proof")
 	if err != nil {
-		return failAuth(connection, "protocol_error", "invalid auth_proof")
+		return AuthResult{}, rejectInvalid(connection, "auth_proof", err)
 	}
 
 	// Challenge binding.
 	if proof.AgentID != agentID {
-		return failAuth(connection, "protocol_error", "agent_id mismatch")
+		return AuthResult{}, failAuth(connection, "protocol_error", "agent_id mismatch")
 	}
 	if proof.ChallengeID != ch.ChallengeID || proof.Nonce != ch.Nonce || proof.IssuedAtMS != ch.IssuedAtMS {
-		return failAuth(connection, "replayed_challenge", "")
+		return AuthResult{}, failAuth(connection, "replayed_challenge", "")
 	}
 
 	// Freshness.
-	if nowMS() > ch.ExpiresAtMS {
-		return failAuth(connection, "expired_challenge", "")
+	if now := cfg.nowMS(); now > ch.ExpiresAtMS {
+		// The peer only learns the code; the details are for server logs, to
+		// tell a slow client from a skewed clock.
+		elapsed := time.Duration(now-ch.IssuedAtMS) * time.Millisecond
+		return AuthResult{}, fmt.Errorf("%w: challenge ttl %s, elapsed %s (read timeout %s, write timeout %s)",
+			failAuth(connection, "expired_challenge", ""), challengeTTL, elapsed, readTimeout, writeTimeout)
 	}
 
 	sigBytes, err := b64Decode(proof.Signature)
 	if err != nil || len(sigBytes) != ed25519.SignatureSize {
-		return failAuth(connection, "bad_signature", "")
+		return AuthResult{}, failAuth(connection, "bad_signature", "")
 	}
 
-	toVerify := stringToSignV1(agentID, proof.ChallengeID, proof.Nonce, proof.IssuedAtMS)
+	// The proof's sig_v selects the signing string: absent or 1 verifies v1
+	// (label unsigned), 2 verifies v2 over the label from auth_begin. When
+	// the challenge advertised a version, the proof must use exactly that one,
+	// or the previous one during WithSigningVersionGrace.
+	if cfg.signingVersion != 0 && !cfg.acceptsSigningVersion(proof.SigV) {
+		return AuthResult{}, failAuth(connection, "signing_version_mismatch", fmt.Sprintf("want sig_v %d", cfg.signingVersion))
+	}
+	toVerify, ok := stringToSign(proof.SigV, signingInput{
+		agentID:     agentID,
+		challengeID: proof.ChallengeID,
+		nonce:       proof.Nonce,
+		issuedAtMS:  proof.IssuedAtMS,
+		label:       begin.Label,
+	})
+	if !ok {
+		return AuthResult{}, failAuth(connection, "protocol_error", fmt.Sprintf("unsupported sig_v %d", proof.SigV))
+	}
 	if !ed25519.Verify(pub, []byte(toVerify), sigBytes) {
-		return failAuth(connection, "bad_signature", "")
+		return AuthResult{}, failAuth(connection, "bad_signature", "")
+	}
+	if cfg.replayStore != nil {
+		switch err := cfg.replayStore.markUsed(proof.ChallengeID, cfg.now()); {
+		case errors.Is(err, errReplayStoreFull):
+			return AuthResult{}, fmt.Errorf("%w: %w", failAuth(connection, "server_busy", ""), err)
+		case err != nil:
+			return AuthResult{}, failAuth(connection, "replayed_challenge", "")
+		}
 	}
 
+	return sendAuthOK(ctx, connection, cfg, AuthResult{
+		AgentID:         agentID,
+		Label:           begin.Label,
+		LabelSigned:     proof.SigV == signingV2,
+		AuthenticatedAt: cfg.now(),
+	})
+}
+
+// sendAuthOK completes a successful server handshake: it sends auth_ok for
+// result, with a fresh resumption ticket if tickets are enabled, and marks
+// the connection authenticated.
+func sendAuthOK(ctx context.Context, connection *protocol.Conn, cfg *config, result AuthResult) (AuthResult, error) {
 	okMsg := authOK{
 		Type:              "auth_ok",
 		V:                 authVersion,
-		AgentID:           agentID,
-		AuthenticatedAtMS: nowMS(),
+		AgentID:           result.AgentID,
+		AuthenticatedAtMS: result.AuthenticatedAt.UnixMilli(),
+	}
+	if cfg.serverInfo != nil {
+		okMsg.ServerInfo = cfg.serverInfo(result)
+	}
+	if cfg.ticketIssuer != nil {
+		// Without a ticket the client simply answers a challenge next time.
+		if t, err := cfg.ticketIssuer.issue(result.AgentID, cfg.now(), cfg.randomBytes); err == nil {
+			okMsg.Ticket, okMsg.TicketExpiresAtMS = t.Value, t.ExpiresAt.UnixMilli()
+		}
 	}
 	okPayload, err := mustMarshalJSON(okMsg)
 	if err != nil {
 		_ = connection.Close()
-		return err
+		return AuthResult{}, err
 	}
-	if err := sendAuth(connection, protocol.TypeAuthOK, okPayload); err != nil {
+	if err := sendAuth(ctx, connection, protocol.TypeAuthOK, okPayload); err != nil {
 		_ = connection.Close()
-		return err
+		return AuthResult{}, err
 	}
-	return nil
+	connection.MarkAuthenticated()
+	return result, nil
 }
 
-func nowMS() int64 { return time.Now().UnixMilli() }
-
-func sendAuth(c *protocol.Conn, typ protocol.Type, payload []byte) error {
-	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+func sendAuth(ctx context.Context, c *protocol.Conn, typ protocol.Type, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, writeTimeout)
 	defer cancel()
-	return c.Send(ctx, protocol.Message{Type: typ, Payload: payload})
+	return wrapConnClosed(c.Send(ctx, protocol.Message{Type: typ, Payload: payload}))
 }
 
-func readAuth(c *protocol.Conn, wantType protocol.Type) (protocol.Message, error) {
-	msg, err := readNextWithTimeout(c, readTimeout)
+func readAuth(ctx context.Context, c *protocol.Conn, wantType protocol.Type) (protocol.Message, error) {
+	msg, err := readNextWithTimeout(ctx, c, readTimeout)
 	if err != nil {
 		return protocol.Message{}, err
 	}
@@ -240,24 +528,141 @@ func readAuth(c *protocol.Conn, wantType protocol.Type) (protocol.Message, error
 	return msg, nil
 }
 
-func readNextWithTimeout(c *protocol.Conn, timeout time.Duration) (protocol.Message, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+// readServerReply reads the server's next handshake message on the client. A
+// connection-level error frame in its place is a rejection like auth_error and
+// is reported as a *RejectedError.
+func readServerReply(ctx context.Context, c *protocol.Conn) (protocol.Message, error) {
+	msg, err := readNextWithTimeout(ctx, c, readTimeout)
+	var remote *protocol.RemoteError
+	if errors.As(err, &remote) {
+		return protocol.Message{}, &RejectedError{Code: remote.Code, Message: remote.Message}
+	}
+	return msg, err
+}
+
+func readNextWithTimeout(ctx context.Context, c *protocol.Conn, timeout time.Duration) (protocol.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	return c.ReadNext(ctx)
+	msg, err := c.ReadNext(ctx)
+	return msg, wrapConnClosed(err)
 }
 
-func failAuth(c *protocol.Conn, code, message string) error {
-	ae := authError{
-		Type:    "auth_error",
-		V:       authVersion,
-		Code:    code,
-		Message: message,
+// wrapConnClosed marks errors caused by the connection going away, as opposed
+// to timeouts, cancellation or protocol violations, with ErrAuthConnectionClosed.
+func wrapConnClosed(err error) error {
+	if err == nil {
+		return nil
 	}
+	if errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return fmt.Errorf("%w: %w", ErrAuthConnectionClosed, err)
+	}
+	return err
+}
+
+func parseChallenge(payload []byte) (authChallenge, error) {
+	challenge, err := unmarshalAndValidate[authChallenge](payload, "auth_challenge")
+	if err != nil {
+		return authChallenge{}, err
+	}
+	if strings.TrimSpace(challenge.ChallengeID) == "" || strings.TrimSpace(challenge.Nonce) == "" {
+		return authChallenge{}, errors.New("invalid auth_challenge (missing challenge_id/nonce)")
+	}
+	return challenge, nil
+}
+
+func remoteAuthError(payload []byte) error {
+	ae, err := unmarshalAndValidate[authError](payload, "auth_error")
+	if err != nil {
+		return err
+	}
+	return &RejectedError{Code: ae.Code, Message: ae.Message, SupportedV: ae.SupportedV}
+}
+
+// RejectConnection turns away a freshly accepted connection before the
+// handshake starts, e.g. with code "server_busy" or "maintenance": it sends an
+// auth_error with code and message without waiting for auth_begin, then
+// closes c. The client's AuthenticateAsClient reports it as a *RejectedError.
+//
+// Whatever the client sends meanwhile is read and discarded, so that a
+// synchronous transport cannot deadlock and a TCP connection is not reset
+// with the auth_begin unread, which could destroy the auth_error before the
+// client reads it. RejectConnection waits up to a second for the client to
+// close after the auth_error.
+func RejectConnection(ctx context.Context, c *protocol.Conn, code, message string) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if strings.TrimSpace(code) == "" {
+		return errors.New("missing rejection code")
+	}
+	payload, err := mustMarshalJSON(authError{Type: "auth_error", V: authVersion, Code: code, Message: message})
+	if err != nil {
+		return err
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		drainCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rejectLinger)
+		defer cancel()
+		for {
+			if _, err := c.ReadNext(drainCtx); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = sendAuth(ctx, c, protocol.TypeAuthError, payload)
+	if err == nil {
+		err = c.CloseWrite()
+	}
+	if err != nil {
+		_ = c.Close()
+	}
+	<-drained
+	_ = c.Close()
+	return err
+}
+
+func failAuth(c *protocol.Conn, code, message string) error {
+	return sendAuthError(c, authError{Code: code, Message: message})
+}
+
+// rejectInvalid fails the handshake over a message of type msgType that did
+// not pass unmarshalAndValidate. A client speaking another auth version is
+// told which versions are supported, so it can report something actionable.
+func rejectInvalid(c *protocol.Conn, msgType string, err error) error {
+	ae := authError{Code: validationCode(err), Message: "invalid " + msgType}
+	if errors.Is(err, ErrAuthUnsupportedVersion) {
+		ae.Message = fmt.Sprintf("unsupported %s version, supported: %d", msgType, authVersion)
+		ae.SupportedV = []int{authVersion}
+	}
+	return fmt.Errorf("%w: %w", sendAuthError(c, ae), err)
+}
+
+// sendAuthError sends ae, filling in its type and version, and closes c.
+func sendAuthError(c *protocol.Conn, ae authError) error {
+	ae.Type, ae.V = "auth_error", authVersion
 	payload, _ := mustMarshalJSON(ae)
-	_ = sendAuth(c, protocol.TypeAuthError, payload)
+	_ = sendAuth(context.Background(), c, protocol.TypeAuthError, payload)
 	_ = c.Close()
-	if message != "" {
-		return fmt.Errorf("auth failed: %s (%s)", code, message)
+	return &serverRejection{code: ae.Code, message: ae.Message}
+}
+
+// serverRejection is the server-side error for a handshake it rejected with
+// an auth_error.
+type serverRejection struct {
+	code, message string
+}
+
+func (e *serverRejection) Error() string {
+	if e.message != "" {
+		return fmt.Sprintf("auth failed: %s (%s)", e.code, e.message)
 	}
-	return fmt.Errorf("auth failed: %s", code)
+	return "auth failed: " + e.code
 }
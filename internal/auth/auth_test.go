@@ -4,14 +4,43 @@ import (
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"errors"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"switchboard/internal/protocol"
 )
 
+// fakeClock is a manually advanced time source for deterministic tests.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock { return &fakeClock{now: time.Unix(1700000000, 0)} }
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
 func TestAuthHappyPath(t *testing.T) {
 	t.Setenv(agentKeyEnvPath, t.TempDir())
 
@@ -35,8 +64,11 @@ func TestAuthHappyPath(t *testing.T) {
 	cb := protocol.New(b)
 
 	errCh := make(chan error, 2)
-	go func() { errCh <- WaitForAgentAuthentication(cb, lookup) }()
-	go func() { errCh <- AuthenticateAsClient(ca) }()
+	go func() { _, err := WaitForAgentAuthentication(cb, lookup); errCh <- err }()
+	go func() {
+		_, err := AuthenticateAsClient(context.Background(), ca)
+		errCh <- err
+	}()
 
 	for i := 0; i < 2; i++ {
 		if err := <-errCh; err != nil {
@@ -45,9 +77,9 @@ func TestAuthHappyPath(t *testing.T) {
 	}
 
 	// Spot-check that the agent_id matches the derived one.
-	derived, err := agentIDFromPublicKey(pub)
+	derived, err := AgentIDFromPublicKey(pub)
 	if err != nil {
-		t.Fatalf("agentIDFromPublicKey: %v", err)
+		t.Fatalf("AgentIDFromPublicKey: %v", err)
 	}
 	if derived != agentID {
 		t.Fatalf("agent_id mismatch: got %q want %q", derived, agentID)
@@ -71,8 +103,11 @@ func TestAuthUnknownAgent(t *testing.T) {
 	cb := protocol.New(b)
 
 	errCh := make(chan error, 2)
-	go func() { errCh <- WaitForAgentAuthentication(cb, lookup) }()
-	go func() { errCh <- AuthenticateAsClient(ca) }()
+	go func() { _, err := WaitForAgentAuthentication(cb, lookup); errCh <- err }()
+	go func() {
+		_, err := AuthenticateAsClient(context.Background(), ca)
+		errCh <- err
+	}()
 
 	// One side should error; the other may error too due to connection close.
 	var sawErr bool
@@ -110,14 +145,14 @@ func TestAuthBadSignature(t *testing.T) {
 
 	// Proxy runs real handler.
 	proxyErrCh := make(chan error, 1)
-	go func() { proxyErrCh <- WaitForAgentAuthentication(cb, lookup) }()
+	go func() { _, err := WaitForAgentAuthentication(cb, lookup); proxyErrCh <- err }()
 
 	// Manual client with intentionally invalid signature.
 	beginPayload, err := mustMarshalJSON(authBegin{
 		Type:         "auth_begin",
 		V:            authVersion,
 		AgentID:      agentID,
-		ClientTimeMS: nowMS(),
+		ClientTimeMS: time.Now().UnixMilli(),
 	})
 	if err != nil {
 		t.Fatalf("marshal begin: %v", err)
@@ -169,10 +204,7 @@ func TestAuthBadSignature(t *testing.T) {
 func TestAuthExpiredChallenge(t *testing.T) {
 	t.Setenv(agentKeyEnvPath, t.TempDir())
 
-	// Make TTL tiny to force expiry.
-	oldTTL := challengeTTL
-	challengeTTL = 1 * time.Millisecond
-	t.Cleanup(func() { challengeTTL = oldTTL })
+	clock := newFakeClock()
 
 	// Use a real keypair for agent_id, and configure proxy with its public key.
 	priv, pub, agentID, err := loadOrCreateAgentKey()
@@ -194,13 +226,13 @@ func TestAuthExpiredChallenge(t *testing.T) {
 	cb := protocol.New(b)
 
 	proxyErrCh := make(chan error, 1)
-	go func() { proxyErrCh <- WaitForAgentAuthentication(cb, lookup) }()
+	go func() { _, err := WaitForAgentAuthentication(cb, lookup, WithClock(clock.Now)); proxyErrCh <- err }()
 
 	beginPayload, err := mustMarshalJSON(authBegin{
 		Type:         "auth_begin",
 		V:            authVersion,
 		AgentID:      agentID,
-		ClientTimeMS: nowMS(),
+		ClientTimeMS: time.Now().UnixMilli(),
 	})
 	if err != nil {
 		t.Fatalf("marshal begin: %v", err)
@@ -218,7 +250,8 @@ func TestAuthExpiredChallenge(t *testing.T) {
 		t.Fatalf("unmarshal challenge: %v", err)
 	}
 
-	time.Sleep(5 * time.Millisecond)
+	// Move past the challenge expiry without sleeping.
+	clock.Advance(challengeTTL + time.Millisecond)
 
 	toSign := stringToSignV1(agentID, ch.ChallengeID, ch.Nonce, ch.IssuedAtMS)
 	sig := ed25519.Sign(priv, []byte(toSign))
@@ -242,9 +275,15 @@ func TestAuthExpiredChallenge(t *testing.T) {
 	// Drain client side (auth_error or EOF).
 	_, _ = ca.ReadNext(context.Background())
 
-	if err := <-proxyErrCh; err == nil {
+	err = <-proxyErrCh
+	if err == nil {
 		t.Fatalf("expected proxy error")
 	}
+	for _, want := range []string{"expired_challenge", "challenge ttl 30s", "elapsed 30.001s"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("proxy error %q does not contain %q", err, want)
+		}
+	}
 }
 
 func TestKeypairFilesAreCreated(t *testing.T) {
@@ -270,3 +309,1879 @@ func TestKeypairFilesAreCreated(t *testing.T) {
 	}
 }
 
+func TestProbeServer(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+
+	_, pub, agentID, err := loadOrCreateAgentKey()
+	if err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+	lookup := func(id string) (ed25519.PublicKey, bool) {
+		if id != agentID {
+			return nil, false
+		}
+		return pub, true
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	proxyErrCh := make(chan error, 1)
+	go func() { _, err := WaitForAgentAuthentication(protocol.New(b), lookup); proxyErrCh <- err }()
+
+	if err := ProbeServer(context.Background(), protocol.New(a), agentID); err != nil {
+		t.Fatalf("ProbeServer: %v", err)
+	}
+
+	// The probe never sends a proof, so the server must not authenticate.
+	if err := <-proxyErrCh; err == nil {
+		t.Fatalf("expected server to fail after probe closed the connection")
+	}
+}
+
+func TestProbeServerUnknownAgent(t *testing.T) {
+	lookup := func(string) (ed25519.PublicKey, bool) { return nil, false }
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go func() { _, _ = WaitForAgentAuthentication(protocol.New(b), lookup) }()
+
+	err := ProbeServer(context.Background(), protocol.New(a), strings.Repeat("ab", 32))
+	if err == nil || !strings.Contains(err.Error(), "unknown_agent") {
+		t.Fatalf("expected unknown_agent rejection, got %v", err)
+	}
+}
+
+func TestAuthBeginValidationErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		wantErr  error
+		wantCode string
+	}{
+		{"malformed", `{"type":`, ErrAuthMalformedJSON, "malformed_message"},
+		{"wrong type", `{"type":"auth_proof","v":1,"agent_id":"x"}`, ErrAuthWrongType, "unexpected_message"},
+		{"unsupported version", `{"type":"auth_begin","v":2,"agent_id":"x"}`, ErrAuthUnsupportedVersion, "unsupported_version"},
+		{"too deep", `{"type":"auth_begin","v":1,"agent_id":"x","x":` + strings.Repeat("[", 100) + strings.Repeat("]", 100) + `}`, ErrAuthMalformedJSON, "malformed_message"},
+		{"too large", `{"type":"auth_begin","v":1,"agent_id":"` + strings.Repeat("x", maxAuthPayloadLen) + `"}`, ErrAuthMalformedJSON, "malformed_message"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+
+			ca := protocol.New(a)
+			lookup := func(string) (ed25519.PublicKey, bool) { return nil, false }
+
+			proxyErrCh := make(chan error, 1)
+			go func() { _, err := WaitForAgentAuthentication(protocol.New(b), lookup); proxyErrCh <- err }()
+
+			if err := ca.Send(context.Background(), protocol.Message{Type: protocol.TypeAuthBegin, Payload: []byte(tt.payload)}); err != nil {
+				t.Fatalf("send begin: %v", err)
+			}
+			msg, err := ca.ReadNext(context.Background())
+			if err != nil {
+				t.Fatalf("read auth_error: %v", err)
+			}
+			ae, err := unmarshalAndValidate[authError](msg.Payload, "auth_error")
+			if err != nil {
+				t.Fatalf("unmarshal auth_error: %v", err)
+			}
+			if ae.Code != tt.wantCode {
+				t.Fatalf("code: got %q want %q", ae.Code, tt.wantCode)
+			}
+			if tt.wantCode == "unsupported_version" {
+				if !slices.Equal(ae.SupportedV, []int{authVersion}) || !strings.Contains(ae.Message, "supported: 1") {
+					t.Fatalf("unsupported_version does not name the supported version: %+v", ae)
+				}
+			} else if ae.SupportedV != nil {
+				t.Fatalf("supported_v set for %s", ae.Code)
+			}
+
+			if err := <-proxyErrCh; !errors.Is(err, tt.wantErr) {
+				t.Fatalf("server error: got %v want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthResultLabel(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+
+	_, pub, agentID, err := loadOrCreateAgentKey()
+	if err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+	lookup := func(id string) (ed25519.PublicKey, bool) { return pub, id == agentID }
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	type serverResult struct {
+		res AuthResult
+		err error
+	}
+	serverCh := make(chan serverResult, 1)
+	go func() {
+		res, err := WaitForAgentAuthentication(protocol.New(b), lookup)
+		serverCh <- serverResult{res, err}
+	}()
+
+	if _, err := AuthenticateAsClient(context.Background(), protocol.New(a), WithLabel("edge-node-fra-3")); err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	got := <-serverCh
+	if got.err != nil {
+		t.Fatalf("server: %v", got.err)
+	}
+	if got.res.AgentID != agentID {
+		t.Fatalf("agent_id: got %q want %q", got.res.AgentID, agentID)
+	}
+	if got.res.Label != "edge-node-fra-3" || !got.res.LabelSigned {
+		t.Fatalf("label: got %q (signed=%v)", got.res.Label, got.res.LabelSigned)
+	}
+	if got.res.AuthenticatedAt.IsZero() {
+		t.Fatalf("AuthenticatedAt not set")
+	}
+}
+
+func TestAuthenticateAsClientWithKey(t *testing.T) {
+	keyDir := t.TempDir()
+	t.Setenv(agentKeyEnvPath, keyDir)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	agentID, err := AgentIDFromPublicKey(pub)
+	if err != nil {
+		t.Fatalf("AgentIDFromPublicKey: %v", err)
+	}
+	lookup := func(id string) (ed25519.PublicKey, bool) { return pub, id == agentID }
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		_, err := WaitForAgentAuthentication(protocol.New(b), lookup)
+		serverErr <- err
+	}()
+
+	res, err := AuthenticateAsClientWithKey(context.Background(), protocol.New(a), priv)
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	if res.AgentID != agentID {
+		t.Fatalf("agent_id: got %q want %q", res.AgentID, agentID)
+	}
+	if entries, _ := os.ReadDir(keyDir); len(entries) != 0 {
+		t.Fatalf("keystore was touched: %v", entries)
+	}
+
+	if _, err := AuthenticateAsClientWithKey(context.Background(), protocol.New(a), priv[:10]); err == nil || !strings.Contains(err.Error(), "invalid ed25519 private key") {
+		t.Fatalf("malformed key: got %v", err)
+	}
+}
+
+func TestValidateRegistry(t *testing.T) {
+	pub1, _, _ := ed25519.GenerateKey(nil)
+	pub2, _, _ := ed25519.GenerateKey(nil)
+	id1, _ := AgentIDFromPublicKey(pub1)
+	id2, _ := AgentIDFromPublicKey(pub2)
+
+	if err := ValidateRegistry(map[string]ed25519.PublicKey{id1: pub1, id2: pub2}); err != nil {
+		t.Fatalf("consistent registry: %v", err)
+	}
+
+	err := ValidateRegistry(map[string]ed25519.PublicKey{id1: pub2, id2: pub2, "short": pub1[:8]})
+	if !errors.Is(err, ErrInconsistentRegistry) {
+		t.Fatalf("got %v want ErrInconsistentRegistry", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, id1) || !strings.Contains(msg, "short") || strings.Contains(msg, id2+" (") {
+		t.Fatalf("error does not list exactly the offenders: %v", err)
+	}
+
+	// The check follows the derivation the server is configured with.
+	spki1, _ := SPKISHA256.AgentID(pub1)
+	spki := WithAgentIDDerivation(SPKISHA256)
+	if err := ValidateRegistry(map[string]ed25519.PublicKey{spki1: pub1}, spki); err != nil {
+		t.Fatalf("consistent SPKI registry: %v", err)
+	}
+	if err := ValidateRegistry(map[string]ed25519.PublicKey{id1: pub1}, spki); !errors.Is(err, ErrInconsistentRegistry) {
+		t.Fatalf("raw IDs under SPKI derivation: got %v want ErrInconsistentRegistry", err)
+	}
+	if err := ValidateRegistry(map[string]ed25519.PublicKey{spki1: pub1}); !errors.Is(err, ErrInconsistentRegistry) {
+		t.Fatalf("SPKI IDs under default derivation: got %v want ErrInconsistentRegistry", err)
+	}
+}
+
+func TestAgentIDDerivation(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	rawID, err := RawKeySHA256.AgentID(pub)
+	if err != nil {
+		t.Fatalf("RawKeySHA256: %v", err)
+	}
+	spkiID, err := SPKISHA256.AgentID(pub)
+	if err != nil {
+		t.Fatalf("SPKISHA256: %v", err)
+	}
+	if rawID == spkiID {
+		t.Fatalf("derivations agree: %q", rawID)
+	}
+	lookup := func(id string) (ed25519.PublicKey, bool) { return pub, id == spkiID || id == rawID }
+
+	for _, tt := range []struct {
+		name       string
+		clientOpts []Option
+		serverOpts []Option
+		wantErr    bool
+	}{
+		{name: "spki on both sides", clientOpts: []Option{WithAgentIDDerivation(SPKISHA256)}, serverOpts: []Option{WithAgentIDDerivation(SPKISHA256)}},
+		{name: "mismatched", clientOpts: []Option{WithAgentIDDerivation(SPKISHA256)}, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+
+			serverErr := make(chan error, 1)
+			go func() {
+				_, err := WaitForAgentAuthentication(protocol.New(b), lookup, tt.serverOpts...)
+				serverErr <- err
+			}()
+
+			res, err := AuthenticateAsClientWithKey(context.Background(), protocol.New(a), priv, tt.clientOpts...)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "unknown_agent") {
+					t.Fatalf("client: got %v want unknown_agent", err)
+				}
+				<-serverErr
+				return
+			}
+			if err != nil {
+				t.Fatalf("client: %v", err)
+			}
+			if err := <-serverErr; err != nil {
+				t.Fatalf("server: %v", err)
+			}
+			if res.AgentID != spkiID {
+				t.Fatalf("agent_id: got %q want %q", res.AgentID, spkiID)
+			}
+		})
+	}
+}
+
+func TestAuthServerInfo(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+
+	_, pub, agentID, err := loadOrCreateAgentKey()
+	if err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+	lookup := func(id string) (ed25519.PublicKey, bool) { return pub, id == agentID }
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		_, err := WaitForAgentAuthentication(protocol.New(b), lookup, WithServerInfo(func(res AuthResult) map[string]string {
+			return map[string]string{"node_id": "proxy-1", "peer": res.AgentID}
+		}))
+		serverErr <- err
+	}()
+
+	res, err := AuthenticateAsClient(context.Background(), protocol.New(a))
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	if res.AgentID != agentID || res.AuthenticatedAt.IsZero() {
+		t.Fatalf("unexpected client result: %+v", res)
+	}
+	if res.ServerInfo["node_id"] != "proxy-1" || res.ServerInfo["peer"] != agentID {
+		t.Fatalf("server info: got %v", res.ServerInfo)
+	}
+}
+
+func TestAuthLabelSigningVersions(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+
+	priv, pub, agentID, err := loadOrCreateAgentKey()
+	if err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+	lookup := func(id string) (ed25519.PublicKey, bool) { return pub, id == agentID }
+
+	tests := []struct {
+		name        string
+		sigV        int
+		signedLabel string
+		wantSigned  bool
+		wantCode    string
+	}{
+		{name: "v1 leaves label unsigned", sigV: 0},
+		{name: "v2 binds label", sigV: signingV2, signedLabel: "edge-node-fra-3", wantSigned: true},
+		{name: "v2 over another label", sigV: signingV2, signedLabel: "spoofed", wantCode: "bad_signature"},
+		{name: "unknown sig_v", sigV: 9, wantCode: "protocol_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+
+			ca := protocol.New(a)
+
+			type serverResult struct {
+				res AuthResult
+				err error
+			}
+			serverCh := make(chan serverResult, 1)
+			go func() {
+				res, err := WaitForAgentAuthentication(protocol.New(b), lookup)
+				serverCh <- serverResult{res, err}
+			}()
+
+			beginPayload, err := mustMarshalJSON(authBegin{
+				Type:    "auth_begin",
+				V:       authVersion,
+				AgentID: agentID,
+				Label:   "edge-node-fra-3",
+			})
+			if err != nil {
+				t.Fatalf("marshal begin: %v", err)
+			}
+			if err := ca.Send(context.Background(), protocol.Message{Type: protocol.TypeAuthBegin, Payload: beginPayload}); err != nil {
+				t.Fatalf("send begin: %v", err)
+			}
+			chMsg, err := ca.ReadNext(context.Background())
+			if err != nil {
+				t.Fatalf("read challenge: %v", err)
+			}
+			ch, err := parseChallenge(chMsg.Payload)
+			if err != nil {
+				t.Fatalf("parse challenge: %v", err)
+			}
+
+			toSign := stringToSignV1(agentID, ch.ChallengeID, ch.Nonce, ch.IssuedAtMS)
+			if tt.sigV == signingV2 {
+				toSign = stringToSignV2(agentID, ch.ChallengeID, ch.Nonce, ch.IssuedAtMS, tt.signedLabel)
+			}
+			proofPayload, err := mustMarshalJSON(authProof{
+				Type:        "auth_proof",
+				V:           authVersion,
+				AgentID:     agentID,
+				ChallengeID: ch.ChallengeID,
+				Nonce:       ch.Nonce,
+				IssuedAtMS:  ch.IssuedAtMS,
+				Signature:   b64Encode(ed25519.Sign(priv, []byte(toSign))),
+				SigV:        tt.sigV,
+			})
+			if err != nil {
+				t.Fatalf("marshal proof: %v", err)
+			}
+			if err := ca.Send(context.Background(), protocol.Message{Type: protocol.TypeAuthProof, Payload: proofPayload}); err != nil {
+				t.Fatalf("send proof: %v", err)
+			}
+
+			msg, err := ca.ReadNext(context.Background())
+			if err != nil {
+				t.Fatalf("read result: %v", err)
+			}
+			got := <-serverCh
+			if tt.wantCode != "" {
+				ae, err := unmarshalAndValidate[authError](msg.Payload, "auth_error")
+				if err != nil {
+					t.Fatalf("unmarshal auth_error: %v", err)
+				}
+				if ae.Code != tt.wantCode {
+					t.Fatalf("code: got %q want %q", ae.Code, tt.wantCode)
+				}
+				if got.err == nil {
+					t.Fatalf("expected server error")
+				}
+				return
+			}
+			if got.err != nil {
+				t.Fatalf("server: %v", got.err)
+			}
+			if got.res.LabelSigned != tt.wantSigned {
+				t.Fatalf("LabelSigned: got %v want %v", got.res.LabelSigned, tt.wantSigned)
+			}
+		})
+	}
+}
+
+func TestServe(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+
+	_, pub, agentID, err := loadOrCreateAgentKey()
+	if err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+	lookup := func(id string) (ed25519.PublicKey, bool) { return pub, id == agentID }
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handled := make(chan AuthResult, 2)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- Serve(ctx, ln, ServeConfig{LookupPublicKey: lookup, MaxConcurrentHandshakes: 1}, func(c *AuthenticatedConn) {
+			_ = c.Close()
+			handled <- c.Result
+		})
+	}()
+
+	// Occupy the only handshake slot with a connection that never speaks.
+	stalled, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer stalled.Close()
+
+	clientErr := make(chan error, 1)
+	go func() {
+		nc, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			clientErr <- err
+			return
+		}
+		defer nc.Close()
+		_, err = AuthenticateAsClient(context.Background(), protocol.New(nc))
+		clientErr <- err
+	}()
+
+	select {
+	case err := <-clientErr:
+		t.Fatalf("client finished while the handshake slot was taken: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Freeing the slot lets the queued client authenticate.
+	_ = stalled.Close()
+	if err := <-clientErr; err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if res := <-handled; res.AgentID != agentID {
+		t.Fatalf("agent_id: got %q want %q", res.AgentID, agentID)
+	}
+
+	cancel()
+	if err := <-serveErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Serve: got %v want context.Canceled", err)
+	}
+}
+
+// scriptedListener is a net.Listener whose Accept results are supplied by
+// the test.
+type scriptedListener struct {
+	accepts   chan any // net.Conn or error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newScriptedListener() *scriptedListener {
+	return &scriptedListener{accepts: make(chan any, 8), closed: make(chan struct{})}
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-l.accepts:
+		if err, ok := r.(error); ok {
+			return nil, err
+		}
+		return r.(net.Conn), nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *scriptedListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *scriptedListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+// temporaryError is an Accept error worth retrying, like EMFILE.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestServeAcceptErrors(t *testing.T) {
+	ln := newScriptedListener()
+	lookup := func(string) (ed25519.PublicKey, bool) { return nil, false }
+
+	// Temporary errors are retried; the connection accepted after them is
+	// still authenticating when a permanent error ends Serve.
+	stalledClient, stalledServer := net.Pipe()
+	defer stalledClient.Close()
+	failed := errors.New("accept failed")
+	ln.accepts <- temporaryError{}
+	ln.accepts <- temporaryError{}
+	ln.accepts <- stalledServer
+	ln.accepts <- failed
+
+	err := Serve(context.Background(), ln, ServeConfig{LookupPublicKey: lookup}, func(c *AuthenticatedConn) {
+		t.Errorf("unexpected authenticated conn")
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("Serve: got %v want %v", err, failed)
+	}
+	select {
+	case <-ln.closed:
+	default:
+		t.Fatalf("listener not closed")
+	}
+	_ = stalledClient.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, stalledClient); err != nil {
+		t.Fatalf("authenticating conn not closed: %v", err)
+	}
+}
+
+func TestAuthLiftsRequireAuthFirstGate(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+
+	_, pub, agentID, err := loadOrCreateAgentKey()
+	if err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+	lookup := func(id string) (ed25519.PublicKey, bool) { return pub, id == agentID }
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ca := protocol.New(a)
+	cb := protocol.New(b, protocol.WithRequireAuthFirst(true))
+
+	errCh := make(chan error, 1)
+	go func() { _, err := WaitForAgentAuthentication(cb, lookup); errCh <- err }()
+	if _, err := AuthenticateAsClient(context.Background(), ca); err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+
+	go func() {
+		_ = ca.Send(context.Background(), protocol.Message{Type: protocol.TypeMessagePayload, StreamID: 1, Kind: protocol.PayloadKindOneway, Data: []byte("x")})
+	}()
+	if _, err := cb.ReadNext(context.Background()); err != nil {
+		t.Fatalf("ReadNext after auth: %v", err)
+	}
+}
+
+func TestGenerateAgentKey(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "agent")
+
+	agentID, pubPEM, err := GenerateAgentKey(dir)
+	if err != nil {
+		t.Fatalf("GenerateAgentKey: %v", err)
+	}
+
+	pub, err := parseEd25519PublicKeySPKI(pubPEM)
+	if err != nil {
+		t.Fatalf("parse returned public key: %v", err)
+	}
+	if derived, _ := AgentIDFromPublicKey(pub); derived != agentID {
+		t.Fatalf("agent_id: got %q want %q", agentID, derived)
+	}
+
+	if runtime.GOOS != "windows" {
+		st, err := os.Stat(filepath.Join(dir, defaultPrivateKeyName))
+		if err != nil {
+			t.Fatalf("private key missing: %v", err)
+		}
+		if perm := st.Mode().Perm(); perm != 0o600 {
+			t.Fatalf("private key mode: got %o want 600", perm)
+		}
+	}
+
+	// The agent picks up the provisioned identity.
+	t.Setenv(agentKeyEnvPath, dir)
+	_, _, loadedID, err := loadOrCreateAgentKey()
+	if err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+	if loadedID != agentID {
+		t.Fatalf("loaded agent_id: got %q want %q", loadedID, agentID)
+	}
+	if currentID, err := CurrentAgentID(); err != nil || currentID != agentID {
+		t.Fatalf("CurrentAgentID: got %q, %v want %q", currentID, err, agentID)
+	}
+
+	if _, _, err := GenerateAgentKey(dir); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected refusal to overwrite existing keys, got %v", err)
+	}
+	if _, _, again, err := loadOrCreateAgentKey(); err != nil || again != agentID {
+		t.Fatalf("agent_id after refusal: got %q, %v want %q", again, err, agentID)
+	}
+}
+
+func TestGenerateAgentKeyConcurrent(t *testing.T) {
+	dir := t.TempDir()
+
+	const n = 8
+	var (
+		wg  sync.WaitGroup
+		ids = make([]string, n)
+	)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids[i], _, _ = GenerateAgentKey(dir)
+		}()
+	}
+	wg.Wait()
+
+	var won []string
+	for _, id := range ids {
+		if id != "" {
+			won = append(won, id)
+		}
+	}
+	if len(won) != 1 {
+		t.Fatalf("%d of %d concurrent GenerateAgentKey calls succeeded, want 1", len(won), n)
+	}
+	t.Setenv(agentKeyEnvPath, dir)
+	if _, _, agentID, err := loadOrCreateAgentKey(); err != nil || agentID != won[0] {
+		t.Fatalf("stored key: agent_id=%q err=%v want %q", agentID, err, won[0])
+	}
+}
+
+func TestValidateAgentKey(t *testing.T) {
+	t.Run("missing", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv(agentKeyEnvPath, dir)
+
+		if err := ValidateAgentKey(); !errors.Is(err, ErrNoAgentKey) {
+			t.Fatalf("got %v want ErrNoAgentKey", err)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Fatalf("ValidateAgentKey created files: %v", entries)
+		}
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		dir := t.TempDir()
+		if _, _, err := GenerateAgentKey(dir); err != nil {
+			t.Fatalf("GenerateAgentKey: %v", err)
+		}
+		t.Setenv(agentKeyEnvPath, dir)
+
+		if err := ValidateAgentKey(); err != nil {
+			t.Fatalf("ValidateAgentKey: %v", err)
+		}
+	})
+
+	t.Run("mismatched pair", func(t *testing.T) {
+		dir, other := t.TempDir(), t.TempDir()
+		if _, _, err := GenerateAgentKey(dir); err != nil {
+			t.Fatalf("GenerateAgentKey: %v", err)
+		}
+		_, otherPub, err := GenerateAgentKey(other)
+		if err != nil {
+			t.Fatalf("GenerateAgentKey: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, defaultPublicKeyName), otherPub, 0o644); err != nil {
+			t.Fatalf("write public key: %v", err)
+		}
+		t.Setenv(agentKeyEnvPath, dir)
+
+		err = ValidateAgentKey()
+		if err == nil || !strings.Contains(err.Error(), "does not match") {
+			t.Fatalf("got %v want mismatch error", err)
+		}
+	})
+}
+
+func TestAgentKeyNotPEMOrDER(t *testing.T) {
+	dir := t.TempDir()
+	privPath := filepath.Join(dir, "agent_private.json")
+	pubPath := filepath.Join(dir, "agent_public.json")
+	if err := os.WriteFile(privPath, []byte(`{"listen": ":8443"}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(pubPath, []byte(`{}`), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	t.Setenv(agentKeyEnvPath, privPath)
+
+	_, _, _, err := loadOrCreateAgentKey()
+	if !errors.Is(err, errNotPEMOrDER) {
+		t.Fatalf("got %v want errNotPEMOrDER", err)
+	}
+	if !strings.Contains(err.Error(), privPath) {
+		t.Fatalf("error %q does not name %q", err, privPath)
+	}
+
+	// Bytes that look like DER but do not parse are reported the same way.
+	if _, err := parseEd25519PrivateKeyPKCS8([]byte{0x30, 0x03, 0x01}); !errors.Is(err, errNotPEMOrDER) {
+		t.Fatalf("got %v want errNotPEMOrDER", err)
+	}
+}
+
+func TestAgentKeySearchPath(t *testing.T) {
+	t.Run("found in second location", func(t *testing.T) {
+		first := t.TempDir()
+		second := t.TempDir()
+		wantID, _, err := GenerateAgentKey(second)
+		if err != nil {
+			t.Fatalf("GenerateAgentKey: %v", err)
+		}
+		t.Setenv(agentKeyEnvPath, "")
+		t.Setenv(agentKeyEnvSearchPath, first+string(os.PathListSeparator)+second)
+
+		_, _, agentID, err := loadOrCreateAgentKey()
+		if err != nil {
+			t.Fatalf("loadOrCreateAgentKey: %v", err)
+		}
+		if agentID != wantID {
+			t.Fatalf("agent_id: got %q want %q", agentID, wantID)
+		}
+		if ok, _ := fileExists(filepath.Join(first, defaultPrivateKeyName)); ok {
+			t.Fatalf("unexpected key created in first location")
+		}
+	})
+
+	t.Run("none found, create in first writable", func(t *testing.T) {
+		base := t.TempDir()
+		// A directory below a regular file can never be created.
+		blocker := filepath.Join(base, "file")
+		if err := os.WriteFile(blocker, nil, 0o600); err != nil {
+			t.Fatalf("write blocker: %v", err)
+		}
+		unwritable := filepath.Join(blocker, "keys")
+		writable := filepath.Join(base, "keys")
+		later := filepath.Join(base, "later")
+		t.Setenv(agentKeyEnvPath, "")
+		t.Setenv(agentKeyEnvSearchPath, strings.Join([]string{unwritable, writable, later}, string(os.PathListSeparator)))
+
+		_, _, agentID, err := loadOrCreateAgentKey()
+		if err != nil {
+			t.Fatalf("loadOrCreateAgentKey: %v", err)
+		}
+		if ok, _ := fileExists(filepath.Join(writable, defaultPrivateKeyName)); !ok {
+			t.Fatalf("key not created in first writable location")
+		}
+		if ok, _ := fileExists(filepath.Join(later, defaultPrivateKeyName)); ok {
+			t.Fatalf("key unexpectedly created in later location")
+		}
+
+		// Subsequent loads find the created key.
+		_, _, again, err := loadOrCreateAgentKey()
+		if err != nil || again != agentID {
+			t.Fatalf("reload: agent_id=%q err=%v want %q", again, err, agentID)
+		}
+	})
+
+	t.Run("failed creation leaves no files", func(t *testing.T) {
+		dir := t.TempDir()
+		blocker := filepath.Join(dir, "file")
+		if err := os.WriteFile(blocker, nil, 0o600); err != nil {
+			t.Fatalf("write blocker: %v", err)
+		}
+		privPath := filepath.Join(dir, defaultPrivateKeyName)
+		if _, _, _, _, err := createAgentKey(privPath, filepath.Join(blocker, defaultPublicKeyName)); err == nil {
+			t.Fatalf("createAgentKey: want an error")
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("directory after failed creation: %v, %v want only the blocker", entries, err)
+		}
+
+		// The directory is still usable as a search path entry.
+		t.Setenv(agentKeyEnvPath, "")
+		t.Setenv(agentKeyEnvSearchPath, dir)
+		if _, _, _, err := loadOrCreateAgentKey(); err != nil {
+			t.Fatalf("loadOrCreateAgentKey: %v", err)
+		}
+	})
+}
+
+func TestAuthenticateAsClientCancelMidHandshake(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := AuthenticateAsClient(ctx, protocol.New(a))
+		errCh <- err
+	}()
+
+	// Receive auth_begin, then never answer.
+	if _, err := protocol.New(b).ReadNext(context.Background()); err != nil {
+		t.Fatalf("read begin: %v", err)
+	}
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("AuthenticateAsClient did not return after cancel")
+	}
+}
+
+func TestAuthDeniedAgentIDs(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+
+	_, pub, agentID, err := loadOrCreateAgentKey()
+	if err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+	lookupCalled := false
+	lookup := func(id string) (ed25519.PublicKey, bool) {
+		lookupCalled = true
+		return pub, id == agentID
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		_, err := WaitForAgentAuthentication(protocol.New(b), lookup, WithDeniedAgentIDs("other", agentID))
+		serverErr <- err
+	}()
+
+	_, err = AuthenticateAsClient(context.Background(), protocol.New(a))
+	if !errors.Is(err, ErrAuthRejected) || !strings.Contains(err.Error(), "denied_agent") {
+		t.Fatalf("client: got %v want denied_agent rejection", err)
+	}
+	if err := <-serverErr; err == nil {
+		t.Fatalf("server: expected error")
+	}
+	if lookupCalled {
+		t.Fatalf("lookupPublicKey called for a denied agent")
+	}
+}
+
+func TestAuthRejectsClientClockSkew(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+
+	_, pub, agentID, err := loadOrCreateAgentKey()
+	if err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+	lookup := func(id string) (ed25519.PublicKey, bool) { return pub, id == agentID }
+
+	clientClock := newFakeClock()
+	serverClock := newFakeClock()
+	serverClock.Advance(2 * time.Minute)
+
+	for _, tt := range []struct {
+		name     string
+		maxSkew  time.Duration
+		wantCode string
+	}{
+		{name: "disabled by default"},
+		{name: "within bound", maxSkew: 5 * time.Minute},
+		{name: "beyond bound", maxSkew: time.Minute, wantCode: "clock_skew"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+
+			opts := []Option{WithClock(serverClock.Now)}
+			if tt.maxSkew > 0 {
+				opts = append(opts, WithMaxClientClockSkew(tt.maxSkew))
+			}
+			serverErr := make(chan error, 1)
+			go func() {
+				_, err := WaitForAgentAuthentication(protocol.New(b), lookup, opts...)
+				serverErr <- err
+			}()
+
+			_, err := AuthenticateAsClient(context.Background(), protocol.New(a), WithClock(clientClock.Now))
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("client: %v", err)
+				}
+				if err := <-serverErr; err != nil {
+					t.Fatalf("server: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantCode) {
+				t.Fatalf("client: got %v want %s", err, tt.wantCode)
+			}
+			if err := <-serverErr; err == nil {
+				t.Fatalf("expected server error")
+			}
+		})
+	}
+}
+
+func TestClientRejectsServerClockSkew(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+
+	_, pub, agentID, err := loadOrCreateAgentKey()
+	if err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+	lookup := func(id string) (ed25519.PublicKey, bool) { return pub, id == agentID }
+
+	clientClock := newFakeClock()
+	serverClock := newFakeClock()
+	serverClock.Advance(2 * time.Minute)
+
+	for _, tt := range []struct {
+		name    string
+		maxSkew time.Duration
+		wantErr bool
+	}{
+		{name: "disabled by default"},
+		{name: "within bound", maxSkew: 5 * time.Minute},
+		{name: "beyond bound", maxSkew: time.Minute, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+
+			go func() { _, _ = WaitForAgentAuthentication(protocol.New(b), lookup, WithClock(serverClock.Now)) }()
+
+			opts := []Option{WithClock(clientClock.Now)}
+			if tt.maxSkew > 0 {
+				opts = append(opts, WithMaxServerClockSkew(tt.maxSkew))
+			}
+			_, err := AuthenticateAsClient(context.Background(), protocol.New(a), opts...)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "authenticated_at_ms") {
+					t.Fatalf("client: got %v want authenticated_at_ms error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("client: %v", err)
+			}
+		})
+	}
+}
+
+func TestAuthAdvertisedSigningVersion(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+
+	_, pub, agentID, err := loadOrCreateAgentKey()
+	if err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+	lookup := func(id string) (ed25519.PublicKey, bool) { return pub, id == agentID }
+
+	t.Run("client follows advertised version", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		type serverResult struct {
+			res AuthResult
+			err error
+		}
+		serverCh := make(chan serverResult, 1)
+		go func() {
+			res, err := WaitForAgentAuthentication(protocol.New(b), lookup, WithSigningVersion(signingV2))
+			serverCh <- serverResult{res, err}
+		}()
+
+		// No label: without the advertisement the client would sign v1.
+		if _, err := AuthenticateAsClient(context.Background(), protocol.New(a)); err != nil {
+			t.Fatalf("client: %v", err)
+		}
+		got := <-serverCh
+		if got.err != nil {
+			t.Fatalf("server: %v", got.err)
+		}
+		if !got.res.LabelSigned {
+			t.Fatalf("expected v2 proof")
+		}
+	})
+
+	t.Run("client rejects unsupported version", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		go func() {
+			cb := protocol.New(b)
+			if _, err := cb.ReadNext(context.Background()); err != nil {
+				return
+			}
+			payload, _ := mustMarshalJSON(authChallenge{
+				Type:        "auth_challenge",
+				V:           authVersion,
+				ChallengeID: "id",
+				Nonce:       "nonce",
+				IssuedAtMS:  1,
+				ExpiresAtMS: 2,
+				SigV:        99,
+			})
+			_ = cb.Send(context.Background(), protocol.Message{Type: protocol.TypeAuthChallenge, Payload: payload})
+		}()
+
+		_, err := AuthenticateAsClient(context.Background(), protocol.New(a))
+		if err == nil || !strings.Contains(err.Error(), "unsupported signing version 99") {
+			t.Fatalf("client: got %v", err)
+		}
+	})
+}
+
+func TestAuthDistinguishesCloseFromRejection(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+	if _, _, _, err := loadOrCreateAgentKey(); err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+
+	t.Run("rejected", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		lookup := func(string) (ed25519.PublicKey, bool) { return nil, false }
+		go func() { _, _ = WaitForAgentAuthentication(protocol.New(b), lookup) }()
+
+		_, err := AuthenticateAsClient(context.Background(), protocol.New(a))
+		if !errors.Is(err, ErrAuthRejected) || errors.Is(err, ErrAuthConnectionClosed) {
+			t.Fatalf("got %v want ErrAuthRejected", err)
+		}
+	})
+
+	t.Run("connection dropped", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+
+		go func() {
+			_, _ = protocol.New(b).ReadNext(context.Background())
+			_ = b.Close()
+		}()
+
+		_, err := AuthenticateAsClient(context.Background(), protocol.New(a))
+		if !errors.Is(err, ErrAuthConnectionClosed) || errors.Is(err, ErrAuthRejected) {
+			t.Fatalf("got %v want ErrAuthConnectionClosed", err)
+		}
+	})
+}
+
+func TestAuthChallengeReplayStore(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+	priv, pub, agentID, err := loadOrCreateAgentKey()
+	if err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+	lookup := func(id string) (ed25519.PublicKey, bool) {
+		if id != agentID {
+			return nil, false
+		}
+		return pub, true
+	}
+	// Every connection issues the same challenge, so a proof captured on one
+	// passes the per-connection binding check on the next.
+	clock := newFakeClock()
+	sameChallenge := func(cfg *config) {
+		cfg.now = clock.Now
+		cfg.randomBytes = func(n int) ([]byte, error) { return make([]byte, n), nil }
+	}
+
+	// handshake runs the server on a fresh connection and answers its
+	// challenge with proof, or with a freshly signed one if proof is nil. It
+	// returns the proof sent and the server's result.
+	handshake := func(t *testing.T, proof []byte, opts ...Option) ([]byte, error) {
+		t.Helper()
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		ca := protocol.New(a)
+
+		errCh := make(chan error, 1)
+		go func() { _, err := WaitForAgentAuthentication(protocol.New(b), lookup, opts...); errCh <- err }()
+
+		beginPayload, err := mustMarshalJSON(authBegin{Type: "auth_begin", V: authVersion, AgentID: agentID})
+		if err != nil {
+			t.Fatalf("marshal begin: %v", err)
+		}
+		if err := ca.Send(context.Background(), protocol.Message{Type: protocol.TypeAuthBegin, Payload: beginPayload}); err != nil {
+			t.Fatalf("send begin: %v", err)
+		}
+		chMsg, err := ca.ReadNext(context.Background())
+		if err != nil {
+			t.Fatalf("read challenge: %v", err)
+		}
+		ch, err := unmarshalAndValidate[authChallenge](chMsg.Payload, "auth_challenge")
+		if err != nil {
+			t.Fatalf("unmarshal challenge: %v", err)
+		}
+		if proof == nil {
+			toSign, _ := stringToSign(signingV1, signingInput{
+				agentID:     agentID,
+				challengeID: ch.ChallengeID,
+				nonce:       ch.Nonce,
+				issuedAtMS:  ch.IssuedAtMS,
+			})
+			proof, err = mustMarshalJSON(authProof{
+				Type:        "auth_proof",
+				V:           authVersion,
+				AgentID:     agentID,
+				ChallengeID: ch.ChallengeID,
+				Nonce:       ch.Nonce,
+				IssuedAtMS:  ch.IssuedAtMS,
+				Signature:   b64Encode(ed25519.Sign(priv, []byte(toSign))),
+			})
+			if err != nil {
+				t.Fatalf("marshal proof: %v", err)
+			}
+		}
+		if err := ca.Send(context.Background(), protocol.Message{Type: protocol.TypeAuthProof, Payload: proof}); err != nil {
+			t.Fatalf("send proof: %v", err)
+		}
+		_, _ = ca.ReadNext(context.Background())
+		return proof, <-errCh
+	}
+
+	t.Run("relayed proof rejected", func(t *testing.T) {
+		store := NewChallengeReplayStore(time.Minute, 0)
+		proof, err := handshake(t, nil, sameChallenge, WithChallengeReplayStore(store))
+		if err != nil {
+			t.Fatalf("first handshake: %v", err)
+		}
+		_, err = handshake(t, proof, sameChallenge, WithChallengeReplayStore(store))
+		if err == nil || !strings.Contains(err.Error(), "replayed_challenge") {
+			t.Fatalf("relayed proof: got %v want replayed_challenge", err)
+		}
+		if got := store.Len(); got != 1 {
+			t.Fatalf("store.Len() = %d, want 1", got)
+		}
+	})
+
+	t.Run("forgotten after ttl", func(t *testing.T) {
+		store := NewChallengeReplayStore(time.Second, 0)
+		now := time.Unix(1700000000, 0)
+		if store.markUsed("c1", now) != nil {
+			t.Fatalf("first use rejected")
+		}
+		if err := store.markUsed("c1", now.Add(500*time.Millisecond)); !errors.Is(err, errChallengeReplayed) {
+			t.Fatalf("reuse within ttl: got %v", err)
+		}
+		if store.markUsed("c2", now.Add(2*time.Second)) != nil || store.markUsed("c1", now.Add(2*time.Second)) != nil {
+			t.Fatalf("use after ttl rejected")
+		}
+		if got := store.Len(); got != 2 {
+			t.Fatalf("store.Len() = %d, want 2", got)
+		}
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		store := NewChallengeReplayStore(time.Second, 2)
+		now := time.Unix(1700000000, 0)
+		if store.markUsed("c1", now) != nil || store.markUsed("c2", now.Add(100*time.Millisecond)) != nil {
+			t.Fatalf("use below the cap rejected")
+		}
+		// Full: new IDs are refused rather than evicting unexpired ones.
+		if err := store.markUsed("c3", now.Add(200*time.Millisecond)); !errors.Is(err, errReplayStoreFull) {
+			t.Fatalf("use beyond the cap: got %v", err)
+		}
+		if err := store.markUsed("c1", now.Add(200*time.Millisecond)); !errors.Is(err, errChallengeReplayed) {
+			t.Fatalf("reuse in a full store: got %v", err)
+		}
+		// c1 expiring makes room for exactly one more.
+		if store.markUsed("c3", now.Add(time.Second)) != nil {
+			t.Fatalf("use after the oldest expired rejected")
+		}
+		if err := store.markUsed("c4", now.Add(time.Second)); !errors.Is(err, errReplayStoreFull) {
+			t.Fatalf("use beyond the cap: got %v", err)
+		}
+
+		// Concurrent use never exceeds the cap, and every ID is accepted at
+		// most once while remembered.
+		store = NewChallengeReplayStore(time.Second, 50)
+		var accepted atomic.Int64
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					if store.markUsed(strconv.Itoa(i), now) == nil {
+						accepted.Add(1)
+					}
+					if n := store.Len(); n > 50 {
+						t.Errorf("store.Len() = %d exceeds the cap", n)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if got := accepted.Load(); got != 50 {
+			t.Fatalf("accepted %d IDs, want 50", got)
+		}
+
+		_, err := handshake(t, nil, sameChallenge, WithChallengeReplayStore(store))
+		if err == nil || !strings.Contains(err.Error(), "server_busy") {
+			t.Fatalf("handshake with a full store: got %v want server_busy", err)
+		}
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		proof, err := handshake(t, nil, sameChallenge)
+		if err != nil {
+			t.Fatalf("first handshake: %v", err)
+		}
+		if _, err := handshake(t, proof, sameChallenge); err != nil {
+			t.Fatalf("second handshake without store: %v", err)
+		}
+	})
+}
+
+func TestRejectConnection(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+	if _, _, _, err := loadOrCreateAgentKey(); err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+
+	t.Run("before auth_begin", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		serverErr := make(chan error, 1)
+		go func() {
+			serverErr <- RejectConnection(context.Background(), protocol.New(b), "server_busy", "retry in 30s")
+		}()
+
+		_, err := AuthenticateAsClient(context.Background(), protocol.New(a))
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) || !errors.Is(err, ErrAuthRejected) || errors.Is(err, ErrAuthConnectionClosed) {
+			t.Fatalf("got %v want *RejectedError", err)
+		}
+		if rejected.Code != "server_busy" || rejected.Message != "retry in 30s" {
+			t.Fatalf("got %+v", rejected)
+		}
+		if err := <-serverErr; err != nil {
+			t.Fatalf("RejectConnection: %v", err)
+		}
+	})
+
+	t.Run("error frame instead of challenge", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		go func() {
+			cb := protocol.New(b)
+			_, _ = cb.ReadNext(context.Background())
+			_ = cb.CloseWithError(context.Background(), "maintenance", "")
+		}()
+
+		_, err := AuthenticateAsClient(context.Background(), protocol.New(a))
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) || rejected.Code != "maintenance" {
+			t.Fatalf("got %v want *RejectedError with code maintenance", err)
+		}
+	})
+
+	t.Run("missing code", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		if err := RejectConnection(context.Background(), protocol.New(b), " ", ""); err == nil {
+			t.Fatal("empty code accepted")
+		}
+	})
+}
+
+func TestDirectoryRegistry(t *testing.T) {
+	dir := t.TempDir()
+	writeKey := func(name string) (string, []byte) {
+		t.Helper()
+		agentID, pubPEM, err := GenerateAgentKey(filepath.Join(t.TempDir(), "agent"))
+		if err != nil {
+			t.Fatalf("GenerateAgentKey: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), pubPEM, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return agentID, pubPEM
+	}
+
+	idA, pemA := writeKey("a.pub.pem")
+	idB, _ := writeKey("b.pub.pem")
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := NewDirectoryRegistry(dir)
+	if err != nil {
+		t.Fatalf("NewDirectoryRegistry: %v", err)
+	}
+	for _, id := range []string{idA, idB} {
+		if _, ok := reg.Lookup(id); !ok {
+			t.Fatalf("agent %s not loaded", id)
+		}
+	}
+	if reg.Len() != 2 {
+		t.Fatalf("Len = %d, want 2", reg.Len())
+	}
+
+	// Malformed and duplicate files are skipped with an error; the rest loads.
+	if err := os.WriteFile(filepath.Join(dir, "broken.pub.pem"), []byte("not a key"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "z-copy.pub.pem"), pemA, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "b.pub.pem")); err != nil {
+		t.Fatal(err)
+	}
+	idC, _ := writeKey("c.pub.pem")
+	err = reg.Reload()
+	if err == nil || !strings.Contains(err.Error(), "broken.pub.pem") || !errors.Is(err, ErrInconsistentRegistry) {
+		t.Fatalf("Reload: got %v, want errors for broken.pub.pem and the duplicate", err)
+	}
+	if _, ok := reg.Lookup(idB); ok {
+		t.Fatal("removed key still loaded")
+	}
+	if _, ok := reg.Lookup(idA); !ok {
+		t.Fatal("duplicated key dropped")
+	}
+	if _, ok := reg.Lookup(idC); !ok {
+		t.Fatal("added key not loaded")
+	}
+
+	// The registry plugs into the server handshake.
+	t.Setenv(agentKeyEnvPath, dir)
+	_, pub, agentID, err := loadOrCreateAgentKey()
+	if err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+	pubPEM, err := marshalEd25519PublicKeySPKIPEM(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "self.pub.pem"), pubPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_ = reg.Reload()
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	errCh := make(chan error, 1)
+	go func() { _, err := WaitForAgentAuthentication(protocol.New(b), reg.Lookup); errCh <- err }()
+	if res, err := AuthenticateAsClient(context.Background(), protocol.New(a)); err != nil || res.AgentID != agentID {
+		t.Fatalf("AuthenticateAsClient: %+v, %v", res, err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+
+	if _, err := NewDirectoryRegistry(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("missing directory accepted")
+	}
+}
+
+func TestDirectoryRegistryDerivation(t *testing.T) {
+	dir := t.TempDir()
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	pubPEM, err := marshalEd25519PublicKeySPKIPEM(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "agent.pub.pem"), pubPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	spki := WithAgentIDDerivation(SPKISHA256)
+	reg, err := NewDirectoryRegistry(dir, spki)
+	if err != nil {
+		t.Fatalf("NewDirectoryRegistry: %v", err)
+	}
+	spkiID, _ := SPKISHA256.AgentID(pub)
+	rawID, _ := AgentIDFromPublicKey(pub)
+	if _, ok := reg.Lookup(spkiID); !ok {
+		t.Fatal("key not loaded under its SPKI ID")
+	}
+	if _, ok := reg.Lookup(rawID); ok {
+		t.Fatal("key loaded under its raw-key ID")
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() { _, _ = WaitForAgentAuthentication(protocol.New(b), reg.Lookup, spki) }()
+	if res, err := AuthenticateAsClientWithKey(context.Background(), protocol.New(a), priv, spki); err != nil || res.AgentID != spkiID {
+		t.Fatalf("authenticate: got %+v, %v", res, err)
+	}
+}
+
+func TestUnmarshalAndValidateDepth(t *testing.T) {
+	// Brackets inside strings, escaped quotes included, do not count.
+	label := strings.Repeat(`[{\"`, 50)
+	begin, err := unmarshalAndValidate[authBegin]([]byte(`{"type":"auth_begin","v":1,"agent_id":"x","label":"`+label+`"}`), "auth_begin")
+	if err != nil {
+		t.Fatalf("brackets in a string: %v", err)
+	}
+	if begin.AgentID != "x" || begin.Label != strings.Repeat(`[{"`, 50) {
+		t.Fatalf("got %+v", begin)
+	}
+
+	nested := func(depth int) []byte {
+		return []byte(`{"type":"auth_ok","v":1,"agent_id":"x","server_info":{},"x":` +
+			strings.Repeat("[", depth-1) + strings.Repeat("]", depth-1) + `}`)
+	}
+	if _, err := unmarshalAndValidate[authOK](nested(maxAuthJSONDepth), "auth_ok"); err != nil {
+		t.Fatalf("depth %d: %v", maxAuthJSONDepth, err)
+	}
+	if _, err := unmarshalAndValidate[authOK](nested(maxAuthJSONDepth+1), "auth_ok"); !errors.Is(err, ErrAuthMalformedJSON) {
+		t.Fatalf("depth %d: got %v want ErrAuthMalformedJSON", maxAuthJSONDepth+1, err)
+	}
+}
+
+type recordingSink struct {
+	mu      sync.Mutex
+	events  []AuthEvent
+	onEvent func(AuthEvent)
+}
+
+func (s *recordingSink) Event(ev AuthEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, ev)
+	if s.onEvent != nil {
+		s.onEvent(ev)
+	}
+}
+
+func TestAuthAuditSink(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+	_, pub, agentID, err := loadOrCreateAgentKey()
+	if err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+	clock := newFakeClock()
+
+	lookup := func(id string) (ed25519.PublicKey, bool) { return pub, id == agentID }
+	handshake := func(t *testing.T, lookup func(string) (ed25519.PublicKey, bool), onEvent func(AuthEvent)) ([]AuthEvent, error) {
+		t.Helper()
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		sink := &recordingSink{onEvent: onEvent}
+		serverErr := make(chan error, 1)
+		go func() {
+			_, err := WaitForAgentAuthentication(protocol.New(b), lookup, WithAuditSink(sink), WithClock(clock.Now))
+			serverErr <- err
+		}()
+		_, _ = AuthenticateAsClient(context.Background(), protocol.New(a), WithLabel("edge-1"), WithClock(clock.Now))
+		err := <-serverErr
+		return sink.events, err
+	}
+	types := func(events []AuthEvent) []AuthEventType {
+		var out []AuthEventType
+		for _, ev := range events {
+			out = append(out, ev.Type)
+		}
+		return out
+	}
+
+	t.Run("success", func(t *testing.T) {
+		events, err := handshake(t, lookup, nil)
+		if err != nil {
+			t.Fatalf("server: %v", err)
+		}
+		want := []AuthEventType{AuthEventChallengeIssued, AuthEventProofReceived, AuthEventSucceeded}
+		if got := types(events); !slices.Equal(got, want) {
+			t.Fatalf("events %v want %v", got, want)
+		}
+		for _, ev := range events {
+			if ev.AgentID != agentID || ev.Label != "edge-1" || ev.RemoteAddr == "" || ev.ChallengeID == "" {
+				t.Fatalf("incomplete event %+v", ev)
+			}
+			if !ev.Time.Equal(clock.Now()) || ev.Code != "" || ev.Err != nil {
+				t.Fatalf("unexpected event %+v", ev)
+			}
+		}
+	})
+
+	t.Run("unknown agent", func(t *testing.T) {
+		events, err := handshake(t, func(string) (ed25519.PublicKey, bool) { return nil, false }, nil)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		want := []AuthEventType{AuthEventFailed}
+		if got := types(events); !slices.Equal(got, want) {
+			t.Fatalf("events %v want %v", got, want)
+		}
+		ev := events[0]
+		if ev.Code != "unknown_agent" || ev.AgentID != agentID || ev.ChallengeID != "" || ev.Err != err {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	})
+
+	t.Run("expired challenge", func(t *testing.T) {
+		events, _ := handshake(t, lookup, func(ev AuthEvent) {
+			if ev.Type == AuthEventChallengeIssued {
+				clock.Advance(challengeTTL + time.Second)
+			}
+		})
+		want := []AuthEventType{AuthEventChallengeIssued, AuthEventProofReceived, AuthEventFailed}
+		if got := types(events); !slices.Equal(got, want) {
+			t.Fatalf("events %v want %v", got, want)
+		}
+		if ev := events[2]; ev.Code != "expired_challenge" || ev.ChallengeID == "" {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	})
+}
+
+func TestAuthResumptionTicket(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentID, _ := AgentIDFromPublicKey(pub)
+	lookup := func(id string) (ed25519.PublicKey, bool) { return pub, id == agentID }
+	key := make([]byte, TicketKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := NewTicketIssuer(key, time.Minute)
+	if err != nil {
+		t.Fatalf("NewTicketIssuer: %v", err)
+	}
+	// The client clock stands still so that it keeps presenting tickets the
+	// server considers expired.
+	serverClock, clientClock := newFakeClock(), newFakeClock()
+
+	// handshake authenticates once, presenting ticket, and reports the
+	// client result and whether the server issued a challenge.
+	handshake := func(t *testing.T, issuer *TicketIssuer, ticket *Ticket) (AuthResult, []AuthEvent) {
+		t.Helper()
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		sink := &recordingSink{}
+		serverErr := make(chan error, 1)
+		go func() {
+			_, err := WaitForAgentAuthentication(protocol.New(b), lookup,
+				WithTicketIssuer(issuer), WithAuditSink(sink), WithClock(serverClock.Now))
+			serverErr <- err
+		}()
+		res, err := AuthenticateAsClientWithKey(context.Background(), protocol.New(a), priv,
+			WithTicket(ticket), WithLabel("edge-1"), WithClock(clientClock.Now))
+		if err != nil {
+			t.Fatalf("client: %v", err)
+		}
+		if err := <-serverErr; err != nil {
+			t.Fatalf("server: %v", err)
+		}
+		return res, sink.events
+	}
+	challenged := func(events []AuthEvent) bool {
+		return slices.ContainsFunc(events, func(ev AuthEvent) bool { return ev.Type == AuthEventChallengeIssued })
+	}
+	ticketRejected := func(events []AuthEvent) bool {
+		return slices.ContainsFunc(events, func(ev AuthEvent) bool { return ev.Type == AuthEventTicketRejected })
+	}
+
+	first, events := handshake(t, issuer, nil)
+	if first.Resumed || !challenged(events) {
+		t.Fatalf("first handshake resumed: %+v", first)
+	}
+	if first.Ticket == nil || first.Ticket.Value == "" {
+		t.Fatal("no ticket issued")
+	}
+	if want := serverClock.Now().Add(time.Minute); !first.Ticket.ExpiresAt.Equal(want) {
+		t.Fatalf("ticket expires %v want %v", first.Ticket.ExpiresAt, want)
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		res, events := handshake(t, issuer, first.Ticket)
+		if !res.Resumed || !res.LabelSigned || challenged(events) {
+			t.Fatalf("not resumed: %+v, events %+v", res, events)
+		}
+		if res.Ticket == nil || res.Ticket.Value == first.Ticket.Value {
+			t.Fatal("no fresh ticket issued on resumption")
+		}
+		if last := events[len(events)-1]; last.Type != AuthEventSucceeded || !last.Resumed {
+			t.Fatalf("last event %+v", last)
+		}
+	})
+
+	t.Run("single use", func(t *testing.T) {
+		res, events := handshake(t, issuer, first.Ticket)
+		if res.Resumed || !challenged(events) || !ticketRejected(events) {
+			t.Fatalf("redeemed ticket accepted twice: %+v", res)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		res, _ := handshake(t, issuer, nil)
+		serverClock.Advance(time.Minute + time.Second)
+		res, events := handshake(t, issuer, res.Ticket)
+		if res.Resumed || !challenged(events) || !ticketRejected(events) {
+			t.Fatalf("expired ticket accepted: %+v", res)
+		}
+	})
+
+	t.Run("other key", func(t *testing.T) {
+		res, _ := handshake(t, issuer, nil)
+		otherKey := make([]byte, TicketKeySize)
+		other, err := NewTicketIssuer(otherKey, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, events := handshake(t, other, res.Ticket)
+		if res.Resumed || !ticketRejected(events) {
+			t.Fatalf("ticket sealed under another key accepted: %+v", res)
+		}
+	})
+
+	t.Run("server without tickets", func(t *testing.T) {
+		res, _ := handshake(t, issuer, nil)
+		res, events := handshake(t, nil, res.Ticket)
+		if res.Resumed || res.Ticket != nil || !challenged(events) {
+			t.Fatalf("got %+v", res)
+		}
+	})
+
+	if _, err := NewTicketIssuer(key[:16], 0); err == nil {
+		t.Fatal("short ticket key accepted")
+	}
+}
+
+func TestRegistryConcurrentUpdates(t *testing.T) {
+	var reg Registry
+
+	// Churn adds and removes unrelated keys for as long as handshakes run.
+	stop := make(chan struct{})
+	churned := make(chan struct{})
+	go func() {
+		defer close(churned)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			pub, _, _ := ed25519.GenerateKey(nil)
+			id, err := reg.Add(pub)
+			if err != nil {
+				t.Errorf("Add: %v", err)
+				return
+			}
+			reg.Remove(id)
+		}
+	}()
+
+	const agents = 8
+	var wg sync.WaitGroup
+	for i := 0; i < agents; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pub, priv, _ := ed25519.GenerateKey(nil)
+			authenticate := func() (AuthResult, error) {
+				a, b := net.Pipe()
+				defer a.Close()
+				defer b.Close()
+				go func() { _, _ = WaitForAgentAuthentication(protocol.New(b), reg.Lookup) }()
+				return AuthenticateAsClientWithKey(context.Background(), protocol.New(a), priv)
+			}
+
+			var rejected *RejectedError
+			if _, err := authenticate(); !errors.As(err, &rejected) || rejected.Code != "unknown_agent" {
+				t.Errorf("before Add: got %v want unknown_agent", err)
+			}
+			id, err := reg.Add(pub)
+			if err != nil {
+				t.Errorf("Add: %v", err)
+				return
+			}
+			if res, err := authenticate(); err != nil || res.AgentID != id {
+				t.Errorf("after Add: got %+v, %v", res, err)
+			}
+			if !reg.Remove(id) {
+				t.Errorf("Remove(%s) = false", id)
+			}
+			if _, err := authenticate(); !errors.As(err, &rejected) || rejected.Code != "unknown_agent" {
+				t.Errorf("after Remove: got %v want unknown_agent", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-churned
+
+	pub1, _, _ := ed25519.GenerateKey(nil)
+	pub2, _, _ := ed25519.GenerateKey(nil)
+	if err := reg.Replace(pub1, pub2); err != nil || reg.Len() != 2 {
+		t.Fatalf("Replace: %v, Len %d", err, reg.Len())
+	}
+	if err := reg.Replace(pub1, ed25519.PublicKey("short")); err == nil || reg.Len() != 2 {
+		t.Fatalf("Replace with an invalid key: %v, Len %d", err, reg.Len())
+	}
+}
+
+func TestRegistryDerivation(t *testing.T) {
+	reg := Registry{Derivation: SPKISHA256}
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	id, err := reg.Add(pub)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if want, _ := SPKISHA256.AgentID(pub); id != want {
+		t.Fatalf("Add: got ID %s want %s", id, want)
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	spki := WithAgentIDDerivation(SPKISHA256)
+	go func() { _, _ = WaitForAgentAuthentication(protocol.New(b), reg.Lookup, spki) }()
+	if res, err := AuthenticateAsClientWithKey(context.Background(), protocol.New(a), priv, spki); err != nil || res.AgentID != id {
+		t.Fatalf("authenticate: got %+v, %v", res, err)
+	}
+
+	// The registry keeps its own copy of the key.
+	clear(pub)
+	if got, ok := reg.Lookup(id); !ok || got.Equal(pub) {
+		t.Fatalf("Lookup after mutating the added key: %x, %v", got, ok)
+	}
+}
+
+func TestAuthSigningVersionGrace(t *testing.T) {
+	t.Setenv(agentKeyEnvPath, t.TempDir())
+	priv, pub, agentID, err := loadOrCreateAgentKey()
+	if err != nil {
+		t.Fatalf("loadOrCreateAgentKey: %v", err)
+	}
+	lookup := func(id string) (ed25519.PublicKey, bool) { return pub, id == agentID }
+	clock := newFakeClock()
+	serverOpts := []Option{
+		WithClock(clock.Now),
+		WithSigningVersion(signingV2),
+		WithSigningVersionGrace(clock.Now().Add(time.Hour)),
+	}
+
+	// prove authenticates signing with sigV, as a client that ignores the
+	// advertised version would, and returns the server's result.
+	prove := func(t *testing.T, sigV int) (AuthResult, error) {
+		t.Helper()
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		ca := protocol.New(a)
+
+		type serverResult struct {
+			res AuthResult
+			err error
+		}
+		serverCh := make(chan serverResult, 1)
+		go func() {
+			res, err := WaitForAgentAuthentication(protocol.New(b), lookup, serverOpts...)
+			serverCh <- serverResult{res, err}
+		}()
+
+		beginPayload, _ := mustMarshalJSON(authBegin{Type: "auth_begin", V: authVersion, AgentID: agentID, Label: "edge-1"})
+		if err := ca.Send(context.Background(), protocol.Message{Type: protocol.TypeAuthBegin, Payload: beginPayload}); err != nil {
+			t.Fatalf("send begin: %v", err)
+		}
+		chMsg, err := ca.ReadNext(context.Background())
+		if err != nil {
+			t.Fatalf("read challenge: %v", err)
+		}
+		ch, err := parseChallenge(chMsg.Payload)
+		if err != nil {
+			t.Fatalf("parse challenge: %v", err)
+		}
+		toSign, _ := stringToSign(sigV, signingInput{
+			agentID:     agentID,
+			challengeID: ch.ChallengeID,
+			nonce:       ch.Nonce,
+			issuedAtMS:  ch.IssuedAtMS,
+			label:       "edge-1",
+		})
+		proofPayload, _ := mustMarshalJSON(authProof{
+			Type:        "auth_proof",
+			V:           authVersion,
+			AgentID:     agentID,
+			ChallengeID: ch.ChallengeID,
+			Nonce:       ch.Nonce,
+			IssuedAtMS:  ch.IssuedAtMS,
+			Signature:   b64Encode(ed25519.Sign(priv, []byte(toSign))),
+			SigV:        sigV,
+		})
+		if err := ca.Send(context.Background(), protocol.Message{Type: protocol.TypeAuthProof, Payload: proofPayload}); err != nil {
+			t.Fatalf("send proof: %v", err)
+		}
+		_, _ = ca.ReadNext(context.Background())
+		got := <-serverCh
+		return got.res, got.err
+	}
+
+	for _, sigV := range []int{0, signingV1, signingV2} {
+		res, err := prove(t, sigV)
+		if err != nil {
+			t.Fatalf("sig_v %d during grace: %v", sigV, err)
+		}
+		if res.LabelSigned != (sigV == signingV2) {
+			t.Fatalf("sig_v %d: LabelSigned = %v", sigV, res.LabelSigned)
+		}
+	}
+
+	clock.Advance(time.Hour)
+	for _, sigV := range []int{0, signingV1} {
+		if _, err := prove(t, sigV); err == nil || !strings.Contains(err.Error(), "signing_version_mismatch") {
+			t.Fatalf("sig_v %d after grace: got %v want signing_version_mismatch", sigV, err)
+		}
+	}
+	if _, err := prove(t, signingV2); err != nil {
+		t.Fatalf("sig_v 2 after grace: %v", err)
+	}
+
+	// A server pinned to v1 accepts proofs from clients that predate sig_v.
+	serverOpts = []Option{WithClock(clock.Now), WithSigningVersion(signingV1)}
+	for _, sigV := range []int{0, signingV1} {
+		if _, err := prove(t, sigV); err != nil {
+			t.Fatalf("sig_v %d against v1: %v", sigV, err)
+		}
+	}
+	if _, err := prove(t, signingV2); err == nil || !strings.Contains(err.Error(), "signing_version_mismatch") {
+		t.Fatalf("sig_v 2 against v1: got %v want signing_version_mismatch", err)
+	}
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrAuthMalformedJSON is returned when an auth payload is empty or not valid JSON.
+	ErrAuthMalformedJSON = errors.New("malformed auth message")
+
+	// ErrAuthWrongType is returned when an auth payload's "type" is not the expected one.
+	ErrAuthWrongType = errors.New("unexpected auth message type")
+
+	// ErrAuthUnsupportedVersion is returned when an auth payload's "v" is not supported.
+	ErrAuthUnsupportedVersion = errors.New("unsupported auth version")
+
+	// ErrAuthRejected is returned when the peer explicitly rejected the
+	// handshake with an auth_error. Retrying with the same identity will not help.
+	ErrAuthRejected = errors.New("authentication failed")
+
+	// ErrAuthConnectionClosed is returned when the connection closed during the
+	// handshake without an auth_error, e.g. because the network dropped. It is
+	// usually worth retrying.
+	ErrAuthConnectionClosed = errors.New("connection closed during authentication")
+
+	// ErrInconsistentRegistry is returned by ValidateRegistry when an agent ID
+	// does not match its public key.
+	ErrInconsistentRegistry = errors.New("inconsistent public key registry")
+
+	// ErrNoAgentKey is returned by ValidateAgentKey when no keypair exists at
+	// the resolved location.
+	ErrNoAgentKey = errors.New("no agent key present")
+)
+
+// RejectedError is returned on the client when the server rejected the
+// handshake, with an auth_error or a connection-level error frame, at any
+// point including before auth_begin was read. It matches ErrAuthRejected.
+type RejectedError struct {
+	// Code is the machine-readable reason, e.g. "unknown_agent" or
+	// "server_busy".
+	Code string
+
+	// Message is the optional human-readable detail.
+	Message string
+
+	// SupportedV lists the auth versions the server accepts when Code is
+	// "unsupported_version".
+	SupportedV []int
+}
+
+func (e *RejectedError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%v: %s (%s)", ErrAuthRejected, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%v: %s", ErrAuthRejected, e.Code)
+}
+
+// Is makes RejectedError match ErrAuthRejected.
+func (e *RejectedError) Is(target error) bool { return target == ErrAuthRejected }
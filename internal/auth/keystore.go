@@ -11,21 +11,137 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 const agentKeyEnvPath = "SWITCHBOARD_AGENT_KEY_PATH"
 
+// agentKeyEnvSearchPath lists candidate key directories, separated like PATH
+// (':' on Unix, ';' on Windows). It is ignored when agentKeyEnvPath is set.
+const agentKeyEnvSearchPath = "SWITCHBOARD_AGENT_KEY_SEARCH_PATH"
+
 const (
 	defaultPrivateKeyName = "agent_ed25519_private.pem"
 	defaultPublicKeyName  = "agent_ed25519_public.pem"
 )
 
+// loadOrCreateAgentKey resolves the agent keypair:
+//
+//  1. SWITCHBOARD_AGENT_KEY_PATH, if set, names the key location explicitly.
+//  2. Otherwise SWITCHBOARD_AGENT_KEY_SEARCH_PATH, if set, is searched; see
+//     loadOrCreateAgentKeyInSearchPath.
+//  3. Otherwise the per-user config directory is used.
+//
+// In cases 1 and 3 a missing keypair is created in place.
 func loadOrCreateAgentKey() (ed25519.PrivateKey, ed25519.PublicKey, string, error) {
+	if os.Getenv(agentKeyEnvPath) == "" {
+		if dirs := searchPathDirs(os.Getenv(agentKeyEnvSearchPath)); len(dirs) > 0 {
+			return loadOrCreateAgentKeyInSearchPath(dirs)
+		}
+	}
+
 	privPath, pubPath, err := agentKeyPaths()
 	if err != nil {
 		return nil, nil, "", err
 	}
+	return loadOrCreateAgentKeyAt(privPath, pubPath)
+}
 
+// CurrentAgentID returns the agent ID this process presents when it
+// authenticates, resolving (and, if missing, creating) the keypair exactly as
+// AuthenticateAsClient does. It is meant for diagnostics such as printing the
+// ID an operator has to register. Pass the same options as to
+// AuthenticateAsClient if they change the agent ID derivation.
+func CurrentAgentID(opts ...Option) (string, error) {
+	_, pub, _, err := loadOrCreateAgentKey()
+	if err != nil {
+		return "", err
+	}
+	return newConfig(opts).agentIDDerivation.AgentID(pub)
+}
+
+// loadOrCreateAgentKeyInSearchPath uses the first directory in dirs that holds
+// a keypair under the default file names. A directory holding only one of the
+// two files is an error rather than being skipped, as for a single location.
+// If no directory holds a keypair, one is created in the first directory that
+// can be written to, in order.
+func loadOrCreateAgentKeyInSearchPath(dirs []string) (ed25519.PrivateKey, ed25519.PublicKey, string, error) {
+	privPath, pubPath, found, err := findAgentKeyInSearchPath(dirs)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if found {
+		return loadOrCreateAgentKeyAt(privPath, pubPath)
+	}
+
+	var errs []error
+	for _, dir := range dirs {
+		priv, pub, agentID, _, err := createAgentKey(filepath.Join(dir, defaultPrivateKeyName), filepath.Join(dir, defaultPublicKeyName))
+		if err == nil {
+			return priv, pub, agentID, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", dir, err))
+	}
+	return nil, nil, "", fmt.Errorf("no writable key directory in search path: %w", errors.Join(errs...))
+}
+
+// findAgentKeyInSearchPath returns the key paths in the first directory of dirs
+// holding either key file, or found=false if there is none.
+func findAgentKeyInSearchPath(dirs []string) (privPath, pubPath string, found bool, _ error) {
+	for _, dir := range dirs {
+		privPath := filepath.Join(dir, defaultPrivateKeyName)
+		pubPath := filepath.Join(dir, defaultPublicKeyName)
+		privOK, err := fileExists(privPath)
+		if err != nil {
+			return "", "", false, err
+		}
+		pubOK, err := fileExists(pubPath)
+		if err != nil {
+			return "", "", false, err
+		}
+		if privOK || pubOK {
+			return privPath, pubPath, true, nil
+		}
+	}
+	return "", "", false, nil
+}
+
+func searchPathDirs(v string) []string {
+	var dirs []string
+	for _, dir := range filepath.SplitList(v) {
+		if strings.TrimSpace(dir) != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+func fileExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, syscall.ENOTDIR):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func loadOrCreateAgentKeyAt(privPath, pubPath string) (ed25519.PrivateKey, ed25519.PublicKey, string, error) {
+	priv, pub, agentID, err := loadAgentKeyAt(privPath, pubPath)
+	if errors.Is(err, ErrNoAgentKey) {
+		priv, pub, agentID, _, err = createAgentKey(privPath, pubPath)
+	}
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return priv, pub, agentID, nil
+}
+
+// loadAgentKeyAt reads and checks the keypair at privPath and pubPath. It
+// returns ErrNoAgentKey if neither file exists.
+func loadAgentKeyAt(privPath, pubPath string) (ed25519.PrivateKey, ed25519.PublicKey, string, error) {
 	privBytes, privErr := os.ReadFile(privPath)
 	pubBytes, pubErr := os.ReadFile(pubPath)
 
@@ -48,40 +164,14 @@ func loadOrCreateAgentKey() (ed25519.PrivateKey, ed25519.PublicKey, string, erro
 			return nil, nil, "", errors.New("public key does not match private key")
 		}
 
-		agentID, err := agentIDFromPublicKey(pub)
+		agentID, err := AgentIDFromPublicKey(pub)
 		if err != nil {
 			return nil, nil, "", err
 		}
 		return priv, pub, agentID, nil
 
 	case errors.Is(privErr, os.ErrNotExist) && errors.Is(pubErr, os.ErrNotExist):
-		// Create.
-		pub, priv, err := ed25519.GenerateKey(rand.Reader)
-		if err != nil {
-			return nil, nil, "", err
-		}
-		agentID, err := agentIDFromPublicKey(pub)
-		if err != nil {
-			return nil, nil, "", err
-		}
-
-		privPEM, err := marshalEd25519PrivateKeyPKCS8PEM(priv)
-		if err != nil {
-			return nil, nil, "", err
-		}
-		pubPEM, err := marshalEd25519PublicKeySPKIPEM(pub)
-		if err != nil {
-			return nil, nil, "", err
-		}
-
-		if err := writeFileAtomic(privPath, privPEM, 0o600); err != nil {
-			return nil, nil, "", err
-		}
-		if err := writeFileAtomic(pubPath, pubPEM, 0o644); err != nil {
-			return nil, nil, "", err
-		}
-
-		return priv, pub, agentID, nil
+		return nil, nil, "", fmt.Errorf("%w: neither %q nor %q exists", ErrNoAgentKey, privPath, pubPath)
 
 	case errors.Is(privErr, os.ErrNotExist) || errors.Is(pubErr, os.ErrNotExist):
 		// Partial presence is dangerous; don't rotate silently.
@@ -96,6 +186,88 @@ func loadOrCreateAgentKey() (ed25519.PrivateKey, ed25519.PublicKey, string, erro
 	}
 }
 
+// ValidateAgentKey checks the agent keypair as AuthenticateAsClient would load
+// it: both files parse, have the right lengths, and the public key matches the
+// private key. Unlike AuthenticateAsClient it never creates a key; if none
+// exists it returns ErrNoAgentKey. It is meant as a preflight check before
+// deploying an agent.
+func ValidateAgentKey() error {
+	if os.Getenv(agentKeyEnvPath) == "" {
+		if dirs := searchPathDirs(os.Getenv(agentKeyEnvSearchPath)); len(dirs) > 0 {
+			privPath, pubPath, found, err := findAgentKeyInSearchPath(dirs)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("%w in search path %q", ErrNoAgentKey, os.Getenv(agentKeyEnvSearchPath))
+			}
+			_, _, _, err = loadAgentKeyAt(privPath, pubPath)
+			return err
+		}
+	}
+
+	privPath, pubPath, err := agentKeyPaths()
+	if err != nil {
+		return err
+	}
+	_, _, _, err = loadAgentKeyAt(privPath, pubPath)
+	return err
+}
+
+// GenerateAgentKey provisions a new agent identity in dir, ahead of the
+// agent's first connection. It writes the private key (mode 0o600) and public
+// key using the default file names, so an agent started with
+// SWITCHBOARD_AGENT_KEY_PATH=dir uses this identity. It returns the agent ID
+// and public key PEM to register with the server.
+//
+// GenerateAgentKey refuses to overwrite an existing keypair in dir, including
+// one another process creates at the same time.
+func GenerateAgentKey(dir string) (agentID string, pubPEM []byte, err error) {
+	if strings.TrimSpace(dir) == "" {
+		return "", nil, errors.New("empty key directory")
+	}
+	privPath := filepath.Join(dir, defaultPrivateKeyName)
+	pubPath := filepath.Join(dir, defaultPublicKeyName)
+	_, _, agentID, pubPEM, err = createAgentKey(privPath, pubPath)
+	if err != nil {
+		return "", nil, err
+	}
+	return agentID, pubPEM, nil
+}
+
+// createAgentKey generates a keypair and writes it to privPath and pubPath,
+// neither of which may exist yet. If it fails partway the private key is
+// removed again, so that a failed attempt does not leave a directory holding
+// half a keypair.
+func createAgentKey(privPath, pubPath string) (ed25519.PrivateKey, ed25519.PublicKey, string, []byte, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	agentID, err := AgentIDFromPublicKey(pub)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+
+	privPEM, err := marshalEd25519PrivateKeyPKCS8PEM(priv)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	pubPEM, err := marshalEd25519PublicKeySPKIPEM(pub)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+
+	if err := writeNewFile(privPath, privPEM, 0o600); err != nil {
+		return nil, nil, "", nil, err
+	}
+	if err := writeNewFile(pubPath, pubPEM, 0o644); err != nil {
+		_ = os.Remove(privPath)
+		return nil, nil, "", nil, err
+	}
+	return priv, pub, agentID, pubPEM, nil
+}
+
 func agentKeyPaths() (privPath string, pubPath string, _ error) {
 	if v := os.Getenv(agentKeyEnvPath); v != "" {
 		// If this is a directory, use default file names inside it.
@@ -129,12 +301,15 @@ func agentKeyPaths() (privPath string, pubPath string, _ error) {
 }
 
 func parseEd25519PrivateKeyPKCS8(b []byte) (ed25519.PrivateKey, error) {
-	der, err := maybePEMToDER(b, "PRIVATE KEY")
+	der, fromPEM, err := maybePEMToDER(b, "PRIVATE KEY")
 	if err != nil {
 		return nil, err
 	}
 	k, err := x509.ParsePKCS8PrivateKey(der)
 	if err != nil {
+		if !fromPEM {
+			return nil, fmt.Errorf("%w: %w", errNotPEMOrDER, err)
+		}
 		return nil, err
 	}
 	priv, ok := k.(ed25519.PrivateKey)
@@ -148,12 +323,15 @@ func parseEd25519PrivateKeyPKCS8(b []byte) (ed25519.PrivateKey, error) {
 }
 
 func parseEd25519PublicKeySPKI(b []byte) (ed25519.PublicKey, error) {
-	der, err := maybePEMToDER(b, "PUBLIC KEY")
+	der, fromPEM, err := maybePEMToDER(b, "PUBLIC KEY")
 	if err != nil {
 		return nil, err
 	}
 	k, err := x509.ParsePKIXPublicKey(der)
 	if err != nil {
+		if !fromPEM {
+			return nil, fmt.Errorf("%w: %w", errNotPEMOrDER, err)
+		}
 		return nil, err
 	}
 	pub, ok := k.(ed25519.PublicKey)
@@ -166,22 +344,33 @@ func parseEd25519PublicKeySPKI(b []byte) (ed25519.PublicKey, error) {
 	return pub, nil
 }
 
-func maybePEMToDER(b []byte, wantType string) ([]byte, error) {
+// errNotPEMOrDER describes key files that are neither PEM nor DER, typically
+// because the key path points at some other file by mistake.
+var errNotPEMOrDER = errors.New("file is neither a PEM key nor a DER-encoded key")
+
+// maybePEMToDER returns the DER bytes of b, decoding it first if it is PEM.
+// fromPEM reports which of the two b was.
+func maybePEMToDER(b []byte, wantType string) (der []byte, fromPEM bool, _ error) {
 	trim := bytes.TrimSpace(b)
 	if len(trim) == 0 {
-		return nil, errors.New("empty key")
+		return nil, false, errors.New("empty key")
 	}
 	if bytes.HasPrefix(trim, []byte("-----BEGIN")) {
 		block, _ := pem.Decode(trim)
 		if block == nil {
-			return nil, errors.New("invalid PEM")
+			return nil, true, errors.New("invalid PEM")
 		}
 		if wantType != "" && block.Type != wantType {
-			return nil, fmt.Errorf("unexpected PEM type %q (want %q)", block.Type, wantType)
+			return nil, true, fmt.Errorf("unexpected PEM type %q (want %q)", block.Type, wantType)
 		}
-		return block.Bytes, nil
+		return block.Bytes, true, nil
 	}
-	return trim, nil // assume DER
+	// Assume DER. Every DER key starts with an ASN.1 SEQUENCE tag; anything
+	// else (JSON, text, ...) is rejected without a confusing ASN.1 error.
+	if trim[0] != 0x30 {
+		return nil, false, errNotPEMOrDER
+	}
+	return trim, false, nil
 }
 
 func marshalEd25519PrivateKeyPKCS8PEM(priv ed25519.PrivateKey) ([]byte, error) {
@@ -208,20 +397,27 @@ func marshalEd25519PublicKeySPKIPEM(pub ed25519.PublicKey) ([]byte, error) {
 	return out.Bytes(), nil
 }
 
-func writeFileAtomic(path string, contents []byte, perm os.FileMode) error {
+// writeNewFile creates path with perm and writes contents to it. It fails if
+// path already exists, so that of two processes creating the same key only
+// one succeeds, and removes the file again if writing it fails.
+func writeNewFile(path string, contents []byte, perm os.FileMode) error {
 	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
 		return err
 	}
 
-	tmp := path + ".tmp"
-	if err := os.WriteFile(tmp, contents, perm); err != nil {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("key file %q already exists: %w", path, err)
+	}
+	if err != nil {
 		return err
 	}
-
-	// Best-effort replace across platforms (Windows rename won’t overwrite).
-	_ = os.Remove(path)
-	if err := os.Rename(tmp, path); err != nil {
-		_ = os.Remove(tmp)
+	_, err = f.Write(contents)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
 		return err
 	}
 	return nil
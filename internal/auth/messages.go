@@ -13,6 +13,12 @@ type authBegin struct {
 	V            int    `json:"v"`
 	AgentID      string `json:"agent_id"`
 	ClientTimeMS int64  `json:"client_time_ms,omitempty"`
+	// Label is unauthenticated, informational metadata; see AuthResult.Label.
+	Label string `json:"label,omitempty"`
+	// Ticket and TicketSig redeem a resumption ticket instead of answering a
+	// challenge; see Ticket.
+	Ticket    string `json:"ticket,omitempty"`
+	TicketSig string `json:"ticket_sig,omitempty"`
 }
 
 type authChallenge struct {
@@ -22,6 +28,8 @@ type authChallenge struct {
 	Nonce       string `json:"nonce"`
 	IssuedAtMS  int64  `json:"issued_at_ms"`
 	ExpiresAtMS int64  `json:"expires_at_ms"`
+	// SigV, when set, is the signing version the client must use.
+	SigV int `json:"sig_v,omitempty"`
 }
 
 type authProof struct {
@@ -32,6 +40,8 @@ type authProof struct {
 	Nonce       string `json:"nonce"`
 	IssuedAtMS  int64  `json:"issued_at_ms"`
 	Signature   string `json:"signature"`
+	// SigV selects the string to sign; absent (0) means v1.
+	SigV int `json:"sig_v,omitempty"`
 }
 
 type authOK struct {
@@ -39,6 +49,12 @@ type authOK struct {
 	V                 int    `json:"v"`
 	AgentID           string `json:"agent_id"`
 	AuthenticatedAtMS int64  `json:"authenticated_at_ms"`
+	// ServerInfo is optional server metadata; see AuthResult.ServerInfo.
+	ServerInfo map[string]string `json:"server_info,omitempty"`
+	// Ticket is a resumption ticket for the next connection, if the server
+	// issues them.
+	Ticket            string `json:"ticket,omitempty"`
+	TicketExpiresAtMS int64  `json:"ticket_expires_at_ms,omitempty"`
 }
 
 type authError struct {
@@ -46,6 +62,9 @@ type authError struct {
 	V       int    `json:"v"`
 	Code    string `json:"code"`
 	Message string `json:"message,omitempty"`
+	// SupportedV lists the auth versions the sender accepts; it is set with
+	// code unsupported_version.
+	SupportedV []int `json:"supported_v,omitempty"`
 }
 
 func mustMarshalJSON(v any) ([]byte, error) {
@@ -59,30 +78,93 @@ func mustMarshalJSON(v any) ([]byte, error) {
 	return b, nil
 }
 
-func unmarshalAndValidate[T any](payload []byte, wantType string) (T, error) {
-	var zero T
+// Auth messages are small and shallow: the deepest, auth_ok, nests
+// server_info one level down. The limits reject anything far off before it is
+// parsed.
+const (
+	maxAuthPayloadLen = 64 << 10
+	maxAuthJSONDepth  = 8
+)
+
+// authMessage is implemented by the auth message types, which all carry the
+// common type and v fields.
+type authMessage[T any] interface {
+	*T
+	header() (typ string, v int)
+}
+
+func (m authBegin) header() (string, int)     { return m.Type, m.V }
+func (m authChallenge) header() (string, int) { return m.Type, m.V }
+func (m authProof) header() (string, int)     { return m.Type, m.V }
+func (m authOK) header() (string, int)        { return m.Type, m.V }
+func (m authError) header() (string, int)     { return m.Type, m.V }
+
+// unmarshalAndValidate parses payload as a T in a single pass, after checking
+// its size and nesting depth, and validates the type and v fields.
+func unmarshalAndValidate[T any, PT authMessage[T]](payload []byte, wantType string) (T, error) {
+	var msg T
 	if len(payload) == 0 {
-		return zero, errors.New("empty payload")
+		return msg, fmt.Errorf("%w: empty payload", ErrAuthMalformedJSON)
 	}
-	if err := json.Unmarshal(payload, &zero); err != nil {
-		return zero, err
+	if len(payload) > maxAuthPayloadLen {
+		return msg, fmt.Errorf("%w: payload of %d bytes exceeds %d", ErrAuthMalformedJSON, len(payload), maxAuthPayloadLen)
 	}
-
-	// Minimal structural validation for all messages: type + v.
-	var header struct {
-		Type string `json:"type"`
-		V    int    `json:"v"`
+	if err := checkJSONDepth(payload, maxAuthJSONDepth); err != nil {
+		return msg, fmt.Errorf("%w: %w", ErrAuthMalformedJSON, err)
 	}
-	if err := json.Unmarshal(payload, &header); err != nil {
-		return zero, err
+	if err := json.Unmarshal(payload, PT(&msg)); err != nil {
+		return msg, fmt.Errorf("%w: %w", ErrAuthMalformedJSON, err)
 	}
-	if header.Type != wantType {
-		return zero, fmt.Errorf("unexpected auth message type %q (want %q)", header.Type, wantType)
+
+	typ, v := PT(&msg).header()
+	if typ != wantType {
+		return msg, fmt.Errorf("%w: got %q (want %q)", ErrAuthWrongType, typ, wantType)
 	}
-	if header.V != authVersion {
-		return zero, fmt.Errorf("unsupported auth version %d (want %d)", header.V, authVersion)
+	if v != authVersion {
+		return msg, fmt.Errorf("%w: got %d (want %d)", ErrAuthUnsupportedVersion, v, authVersion)
 	}
+	return msg, nil
+}
 
-	return zero, nil
+// checkJSONDepth reports an error if objects and arrays in b nest deeper than
+// max. It only tracks brackets outside strings, leaving validation to the
+// JSON parser, and so runs in a single cheap pass.
+func checkJSONDepth(b []byte, max int) error {
+	depth := 0
+	inString, escaped := false, false
+	for _, c := range b {
+		switch {
+		case inString:
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			if depth++; depth > max {
+				return fmt.Errorf("nesting deeper than %d", max)
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return nil
 }
 
+// validationCode maps an unmarshalAndValidate error to the auth_error code
+// reported to the peer.
+func validationCode(err error) string {
+	switch {
+	case errors.Is(err, ErrAuthUnsupportedVersion):
+		return "unsupported_version"
+	case errors.Is(err, ErrAuthWrongType):
+		return "unexpected_message"
+	default:
+		return "malformed_message"
+	}
+}
@@ -0,0 +1,192 @@
+package auth
+
+import "time"
+
+// Option configures the behavior of the authentication handshake.
+type Option func(*config)
+
+type config struct {
+	now                func() time.Time
+	label              string
+	maxClockSkew       time.Duration
+	signingVersion     int
+	signingGraceUntil  time.Time
+	deniedAgentIDs     map[string]bool
+	serverInfo         func(AuthResult) map[string]string
+	agentIDDerivation  AgentIDDerivation
+	maxServerClockSkew time.Duration
+	replayStore        *ChallengeReplayStore
+	auditSink          AuditSink
+	ticketIssuer       *TicketIssuer
+	ticket             *Ticket
+
+	// randomBytes generates nonces and challenge IDs; tests replace it.
+	randomBytes func(n int) ([]byte, error)
+}
+
+func newConfig(opts []Option) *config {
+	cfg := &config{
+		now:         time.Now,
+		randomBytes: randomBytes,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// WithClock overrides the time source used for timestamps and challenge expiry.
+// It defaults to time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(cfg *config) {
+		if now != nil {
+			cfg.now = now
+		}
+	}
+}
+
+func (cfg *config) nowMS() int64 { return cfg.now().UnixMilli() }
+
+// WithLabel sets a human-readable label (e.g. "edge-node-fra-3") that the
+// client presents in auth_begin. The label is informational only; see
+// AuthResult.Label for its trust properties.
+func WithLabel(label string) Option {
+	return func(cfg *config) {
+		cfg.label = label
+	}
+}
+
+// WithMaxClientClockSkew makes the server reject, with a clock_skew
+// auth_error and before issuing a challenge, clients whose auth_begin
+// client_time_ms differs from server time by more than d. Clients that omit
+// client_time_ms are not checked. It is disabled by default.
+//
+// The check is advisory: client_time_ms is not signed, so it only catches
+// misconfigured clocks, not a client lying about its time.
+func WithMaxClientClockSkew(d time.Duration) Option {
+	return func(cfg *config) {
+		if d > 0 {
+			cfg.maxClockSkew = d
+		}
+	}
+}
+
+// WithMaxServerClockSkew makes the client reject an auth_ok whose
+// authenticated_at_ms differs from local time by more than d, closing the
+// connection. It guards audit logs, which record that timestamp, against
+// broken servers. It is disabled by default because clock skew is real.
+func WithMaxServerClockSkew(d time.Duration) Option {
+	return func(cfg *config) {
+		if d > 0 {
+			cfg.maxServerClockSkew = d
+		}
+	}
+}
+
+// WithSigningVersion makes the server advertise signing version v in
+// auth_challenge and accept only proofs signed with it. Clients sign with the
+// advertised version, or fail if they do not support it. By default nothing
+// is advertised and the client's choice (v1, or v2 with a label) is accepted.
+//
+// Rolling to a new version is done by upgrading clients first and then
+// enabling this option on servers.
+func WithSigningVersion(v int) Option {
+	return func(cfg *config) {
+		cfg.signingVersion = v
+	}
+}
+
+// WithSigningVersionGrace makes a server configured with WithSigningVersion
+// also accept proofs signed with the version just before it (v1 for v2) until
+// the given time, so that clients that do not follow the advertised version
+// yet keep authenticating while they are upgraded. A proof without sig_v
+// counts as v1. From until on, only the advertised version is accepted.
+//
+// The grace ends at a fixed time rather than after a duration so that server
+// restarts during the migration do not extend it.
+func WithSigningVersionGrace(until time.Time) Option {
+	return func(cfg *config) {
+		cfg.signingGraceUntil = until
+	}
+}
+
+// acceptsSigningVersion reports whether a proof with sig_v v is acceptable to
+// a server advertising cfg.signingVersion. A proof without sig_v is v1.
+func (cfg *config) acceptsSigningVersion(v int) bool {
+	if v == 0 {
+		v = signingV1
+	}
+	if v == cfg.signingVersion {
+		return true
+	}
+	return v == cfg.signingVersion-1 && cfg.now().Before(cfg.signingGraceUntil)
+}
+
+// WithDeniedAgentIDs makes the server reject the given agent IDs with a
+// denied_agent auth_error right after auth_begin, before looking up a key.
+// A node that is both client and server can deny its own ID to catch
+// loopback misconfigurations where it ends up authenticating itself.
+func WithDeniedAgentIDs(ids ...string) Option {
+	return func(cfg *config) {
+		if cfg.deniedAgentIDs == nil {
+			cfg.deniedAgentIDs = make(map[string]bool, len(ids))
+		}
+		for _, id := range ids {
+			cfg.deniedAgentIDs[id] = true
+		}
+	}
+}
+
+// WithServerInfo makes the server include the metadata returned by info in
+// auth_ok, so that clients learn which node they landed on (node ID, region,
+// capabilities) without another round trip. info is called with the result of
+// a successful handshake; returning nil sends nothing. Clients surface the
+// metadata as AuthResult.ServerInfo; older clients ignore it.
+func WithServerInfo(info func(AuthResult) map[string]string) Option {
+	return func(cfg *config) {
+		cfg.serverInfo = info
+	}
+}
+
+// WithAgentIDDerivation selects how agent IDs are derived from public keys,
+// on both the client (the agent_id it presents) and the server (the check
+// that agent_id matches the registered key). Both sides must agree. The
+// default is RawKeySHA256.
+func WithAgentIDDerivation(d AgentIDDerivation) Option {
+	return func(cfg *config) {
+		cfg.agentIDDerivation = d
+	}
+}
+
+// WithChallengeReplayStore makes the server consult store after a proof's
+// signature verifies and reject, with a replayed_challenge auth_error, a proof
+// for a challenge the store has already seen accepted. Sharing store between
+// connections catches a proof relayed to another connection that was issued
+// the same challenge. While the store is full, handshakes are rejected with
+// server_busy. It is disabled by default.
+func WithChallengeReplayStore(store *ChallengeReplayStore) Option {
+	return func(cfg *config) {
+		cfg.replayStore = store
+	}
+}
+
+// WithTicketIssuer makes the server issue a resumption ticket in every
+// auth_ok and accept one in auth_begin in place of a challenge; see Ticket.
+// A ticket that is rejected for any reason (expired, redeemed before, sealed
+// under another key, badly signed) makes the server fall back to a regular
+// challenge. Tickets are disabled by default.
+func WithTicketIssuer(issuer *TicketIssuer) Option {
+	return func(cfg *config) {
+		cfg.ticketIssuer = issuer
+	}
+}
+
+// WithTicket makes the client present t in auth_begin to skip the challenge
+// round trip, signing it with the agent key. If the server does not accept
+// it, the handshake continues with a challenge as usual. A nil or locally
+// expired ticket is not sent.
+func WithTicket(t *Ticket) Option {
+	return func(cfg *config) {
+		cfg.ticket = t
+	}
+}
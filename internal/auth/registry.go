@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Registry is an in-memory key registry that can be changed while handshakes
+// are running, e.g. from a control plane, without restarting the server. Agent
+// IDs are derived with Derivation, which must match the server's
+// WithAgentIDDerivation. The zero value is an empty registry ready to use with
+// the default derivation.
+//
+// All methods are safe for concurrent use; pass Lookup as the lookupPublicKey
+// argument of WaitForAgentAuthentication. A handshake looks its key up once,
+// right after auth_begin, so a key removed later in the handshake is still
+// accepted for it; connections already authenticated are not affected either.
+type Registry struct {
+	// Derivation derives the agent ID of each key added. Set it before the
+	// first Add or Replace; changing it later leaves the keys already
+	// registered under IDs the server no longer accepts.
+	Derivation AgentIDDerivation
+
+	mu   sync.RWMutex
+	keys map[string]ed25519.PublicKey
+}
+
+// Add registers a copy of pub and returns the agent ID it authenticates.
+// Adding a key that is already registered is a no-op.
+func (r *Registry) Add(pub ed25519.PublicKey) (string, error) {
+	agentID, err := r.Derivation.AgentID(pub)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.keys == nil {
+		r.keys = make(map[string]ed25519.PublicKey)
+	}
+	r.keys[agentID] = bytes.Clone(pub)
+	return agentID, nil
+}
+
+// Remove unregisters agentID and reports whether it was registered.
+func (r *Registry) Remove(agentID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.keys[agentID]
+	delete(r.keys, agentID)
+	return ok
+}
+
+// Replace atomically swaps the whole key set for copies of pubs, so that a
+// handshake sees either the old set or the new one, never a mix. If any key is
+// invalid the registry is left unchanged.
+func (r *Registry) Replace(pubs ...ed25519.PublicKey) error {
+	keys := make(map[string]ed25519.PublicKey, len(pubs))
+	for _, pub := range pubs {
+		agentID, err := r.Derivation.AgentID(pub)
+		if err != nil {
+			return err
+		}
+		keys[agentID] = bytes.Clone(pub)
+	}
+	r.mu.Lock()
+	r.keys = keys
+	r.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the public key registered for agentID.
+func (r *Registry) Lookup(agentID string) (ed25519.PublicKey, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	pub, ok := r.keys[agentID]
+	return pub, ok
+}
+
+// Len returns the number of keys registered.
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.keys)
+}
+
+// publicKeyFilePattern matches the files NewDirectoryRegistry loads.
+const publicKeyFilePattern = "*.pub.pem"
+
+// DirectoryRegistry is a key registry loaded from a directory holding one
+// PEM-encoded public key per authorized agent, in files named *.pub.pem (as
+// written by GenerateAgentKey, renamed per agent). Agent IDs are derived from
+// the keys, so file names do not matter beyond the suffix.
+//
+// Lookup is safe to call concurrently with Reload; pass it as the
+// lookupPublicKey argument of WaitForAgentAuthentication.
+type DirectoryRegistry struct {
+	dir        string
+	derivation AgentIDDerivation
+
+	mu   sync.RWMutex
+	keys map[string]ed25519.PublicKey
+}
+
+// NewDirectoryRegistry loads the public keys in dir. Files that cannot be
+// parsed, and every file after the first that yields an already loaded agent
+// ID, are skipped: the registry is still returned, together with an error
+// describing each skipped file. Callers that must not run with a partial
+// registry should treat any error as fatal. If dir cannot be read, the
+// registry is nil.
+//
+// Agent IDs are derived as configured by WithAgentIDDerivation; pass the same
+// options as to WaitForAgentAuthentication if they change the derivation.
+func NewDirectoryRegistry(dir string, opts ...Option) (*DirectoryRegistry, error) {
+	r := &DirectoryRegistry{dir: dir, derivation: newConfig(opts).agentIDDerivation}
+	err := r.Reload()
+	if r.keys == nil {
+		return nil, err
+	}
+	return r, err
+}
+
+// Lookup returns the public key registered for agentID.
+func (r *DirectoryRegistry) Lookup(agentID string) (ed25519.PublicKey, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	pub, ok := r.keys[agentID]
+	return pub, ok
+}
+
+// Len returns the number of keys loaded.
+func (r *DirectoryRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.keys)
+}
+
+// Reload reads the directory again and atomically replaces the loaded keys,
+// e.g. after files were added or removed. Skipped files are reported as by
+// NewDirectoryRegistry. If the directory cannot be read, the keys loaded
+// before are kept.
+func (r *DirectoryRegistry) Reload() error {
+	paths, err := filepath.Glob(filepath.Join(r.dir, publicKeyFilePattern))
+	if err == nil {
+		// Glob ignores I/O errors; surface a missing or unreadable directory.
+		_, err = os.ReadDir(r.dir)
+	}
+	if err != nil {
+		return fmt.Errorf("read key directory: %w", err)
+	}
+
+	keys := make(map[string]ed25519.PublicKey, len(paths))
+	sources := make(map[string]string, len(paths))
+	var errs []error
+	for _, path := range paths { // Glob sorts, so the first file wins
+		b, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		pub, err := parseEd25519PublicKeySPKI(b)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		agentID, err := r.derivation.AgentID(pub)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		if first, ok := sources[agentID]; ok {
+			errs = append(errs, fmt.Errorf("%w: %s and %s both hold the key of agent %s", ErrInconsistentRegistry, first, path, agentID))
+			continue
+		}
+		keys[agentID] = pub
+		sources[agentID] = path
+	}
+
+	r.mu.Lock()
+	r.keys = keys
+	r.mu.Unlock()
+	return errors.Join(errs...)
+}
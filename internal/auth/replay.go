@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultMaxReplayEntries bounds a ChallengeReplayStore by default. An entry
+// costs on the order of a hundred bytes, so the default caps the store at
+// roughly 10 MB.
+const defaultMaxReplayEntries = 100_000
+
+var (
+	// errChallengeReplayed is returned by markUsed for an ID it still
+	// remembers.
+	errChallengeReplayed = errors.New("challenge already used")
+
+	// errReplayStoreFull is returned by markUsed when the store holds
+	// maxEntries unexpired IDs.
+	errReplayStoreFull = errors.New("replay store full")
+)
+
+// ChallengeReplayStore remembers the challenge IDs of accepted proofs so that
+// a server rejects a proof for a challenge it has already accepted, even on
+// another connection. Share one store between all handshakes of a process via
+// WithChallengeReplayStore; it is safe for concurrent use.
+//
+// The store is in memory only: it does not survive restarts and is not shared
+// between processes. Its size is capped: once it holds the maximum number of
+// IDs that are all still within the TTL, it refuses to record more, and the
+// server rejects further handshakes with server_busy until the oldest IDs
+// expire. Evicting them early instead would reopen the replay window the
+// store exists to close.
+type ChallengeReplayStore struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu   sync.Mutex
+	seen map[string]time.Time // challenge ID -> forget after
+	// order holds the IDs in seen by insertion, hence by expiry as long as
+	// the clock does not go backwards; entries before head were pruned.
+	order []replayEntry
+	head  int
+}
+
+type replayEntry struct {
+	id    string
+	until time.Time
+}
+
+// NewChallengeReplayStore returns an empty store that remembers each challenge
+// ID for ttl and holds at most maxEntries IDs. A non-positive ttl defaults to
+// the challenge lifetime, after which proofs are rejected as expired anyway; a
+// non-positive maxEntries defaults to 100,000.
+//
+// Size maxEntries for the highest rate of successful handshakes to sustain
+// times the TTL: only proofs with a valid signature are recorded, so an
+// attacker without a registered key cannot fill the store.
+func NewChallengeReplayStore(ttl time.Duration, maxEntries int) *ChallengeReplayStore {
+	if ttl <= 0 {
+		ttl = challengeTTL
+	}
+	if maxEntries <= 0 {
+		maxEntries = defaultMaxReplayEntries
+	}
+	return &ChallengeReplayStore{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		seen:       make(map[string]time.Time),
+	}
+}
+
+// markUsed records challengeID as used at now. It returns
+// errChallengeReplayed if the ID was already recorded and has not been
+// forgotten yet, and errReplayStoreFull if the store has no room for it.
+func (s *ChallengeReplayStore) markUsed(challengeID string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneLocked(now)
+	if until, ok := s.seen[challengeID]; ok && now.Before(until) {
+		return errChallengeReplayed
+	}
+	if len(s.seen) >= s.maxEntries {
+		return errReplayStoreFull
+	}
+	until := now.Add(s.ttl)
+	s.seen[challengeID] = until
+	s.order = append(s.order, replayEntry{id: challengeID, until: until})
+	return nil
+}
+
+// pruneLocked forgets the IDs that expired by now, oldest first, so each
+// entry is visited once however often markUsed runs.
+func (s *ChallengeReplayStore) pruneLocked(now time.Time) {
+	for s.head < len(s.order) && !now.Before(s.order[s.head].until) {
+		e := s.order[s.head]
+		s.order[s.head] = replayEntry{}
+		s.head++
+		// The ID may have been recorded again since, under a new entry.
+		if until, ok := s.seen[e.id]; ok && until.Equal(e.until) {
+			delete(s.seen, e.id)
+		}
+	}
+	if s.head > len(s.order)/2 {
+		s.order = append(s.order[:0], s.order[s.head:]...)
+		s.head = 0
+	}
+}
+
+// Len returns the number of challenge IDs currently remembered, including
+// ones that have outlived the TTL but were not pruned yet.
+func (s *ChallengeReplayStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.seen)
+}
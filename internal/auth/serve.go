@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"switchboard/internal/protocol"
+)
+
+const defaultMaxConcurrentHandshakes = 64
+
+// Serve retries temporary Accept errors, such as running out of file
+// descriptors, after a delay that doubles from minAcceptRetryDelay up to
+// maxAcceptRetryDelay, as net/http does.
+const (
+	minAcceptRetryDelay = 5 * time.Millisecond
+	maxAcceptRetryDelay = time.Second
+)
+
+// AuthenticatedConn is a connection whose handshake succeeded, together with
+// the identity it authenticated as, so the two cannot be mixed up once
+// passed around.
+type AuthenticatedConn struct {
+	*protocol.Conn
+
+	// Result is what the handshake established; Result.AgentID is the
+	// principal to authorize against.
+	Result AuthResult
+}
+
+// ServeConfig configures Serve.
+type ServeConfig struct {
+	// LookupPublicKey resolves an agent ID to its registered public key. It is
+	// required.
+	LookupPublicKey func(agentID string) (ed25519.PublicKey, bool)
+
+	// MaxConcurrentHandshakes bounds the number of connections that may be
+	// authenticating at the same time. Once the limit is reached Serve stops
+	// accepting, so further connections queue in the listener backlog until a
+	// handshake finishes. Zero or negative means 64.
+	MaxConcurrentHandshakes int
+
+	// ConnOptions are applied to every accepted protocol.Conn.
+	ConnOptions []protocol.Option
+
+	// AuthOptions are passed to WaitForAgentAuthentication.
+	AuthOptions []Option
+}
+
+// Serve accepts connections from ln, authenticates each one with
+// WaitForAgentAuthentication and passes authenticated connections to handle,
+// which is called on its own goroutine and owns the connection from then on.
+// Connections that fail authentication are closed.
+//
+// When ctx is cancelled Serve closes ln, closes connections that are still
+// authenticating, waits for their handshakes to return and returns ctx.Err().
+// Temporary Accept errors are retried with backoff; any other Accept error is
+// returned after the same cleanup.
+func Serve(ctx context.Context, ln net.Listener, cfg ServeConfig, handle func(*AuthenticatedConn)) error {
+	if ln == nil {
+		return errors.New("nil listener")
+	}
+	if cfg.LookupPublicKey == nil {
+		return errors.New("LookupPublicKey is nil")
+	}
+	if handle == nil {
+		return errors.New("handle is nil")
+	}
+	limit := cfg.MaxConcurrentHandshakes
+	if limit <= 0 {
+		limit = defaultMaxConcurrentHandshakes
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// Cancelling serveCtx closes ln and the connections still authenticating,
+	// on return as well as when ctx is done, before wg.Wait runs.
+	serveCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	context.AfterFunc(serveCtx, func() { _ = ln.Close() })
+
+	var retryDelay time.Duration
+	slots := make(chan struct{}, limit)
+	for {
+		// Acquire a handshake slot before accepting so that excess
+		// connections wait in the backlog instead of holding goroutines.
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		nc, err := ln.Accept()
+		if err != nil {
+			<-slots
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				retryDelay = min(max(2*retryDelay, minAcceptRetryDelay), maxAcceptRetryDelay)
+				select {
+				case <-time.After(retryDelay):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				continue
+			}
+			return err
+		}
+		retryDelay = 0
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			stopConnClose := context.AfterFunc(serveCtx, func() { _ = nc.Close() })
+			conn := protocol.New(nc, cfg.ConnOptions...)
+			res, err := WaitForAgentAuthentication(conn, cfg.LookupPublicKey, cfg.AuthOptions...)
+			if !stopConnClose() || err != nil {
+				_ = conn.Close()
+				return
+			}
+			go handle(&AuthenticatedConn{Conn: conn, Result: res})
+		}()
+	}
+}
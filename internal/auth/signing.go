@@ -3,11 +3,15 @@ package auth
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"strconv"
+	"strings"
 
 	"crypto/ed25519"
 )
@@ -33,7 +37,9 @@ func randomBytes(n int) ([]byte, error) {
 	return b, nil
 }
 
-func agentIDFromPublicKey(pub ed25519.PublicKey) (string, error) {
+// AgentIDFromPublicKey derives the agent ID for pub: the hex-encoded SHA-256
+// of the raw Ed25519 public key. Servers use it to map registered keys to IDs.
+func AgentIDFromPublicKey(pub ed25519.PublicKey) (string, error) {
 	if l := len(pub); l != ed25519.PublicKeySize {
 		return "", fmt.Errorf("invalid public key length %d", l)
 	}
@@ -41,6 +47,64 @@ func agentIDFromPublicKey(pub ed25519.PublicKey) (string, error) {
 	return hex.EncodeToString(sum[:]), nil
 }
 
+// AgentIDDerivation selects how an agent ID is derived from its public key.
+// Clients and servers must be configured with the same derivation.
+type AgentIDDerivation int
+
+const (
+	// RawKeySHA256 is the hex SHA-256 of the raw 32-byte public key; see
+	// AgentIDFromPublicKey. It is the default.
+	RawKeySHA256 AgentIDDerivation = iota
+
+	// SPKISHA256 is the hex SHA-256 of the DER-encoded SubjectPublicKeyInfo,
+	// the key fingerprint commonly used by PKI tooling.
+	SPKISHA256
+)
+
+// AgentID derives the agent ID for pub.
+func (d AgentIDDerivation) AgentID(pub ed25519.PublicKey) (string, error) {
+	switch d {
+	case RawKeySHA256:
+		return AgentIDFromPublicKey(pub)
+	case SPKISHA256:
+		if l := len(pub); l != ed25519.PublicKeySize {
+			return "", fmt.Errorf("invalid public key length %d", l)
+		}
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(der)
+		return hex.EncodeToString(sum[:]), nil
+	default:
+		return "", fmt.Errorf("unknown agent ID derivation %d", d)
+	}
+}
+
+// ValidateRegistry checks that every agent ID in entries is the one derived
+// from its public key. The server rejects a mismatched entry as
+// unknown_agent, which hides the registry bug behind an auth failure; run
+// ValidateRegistry when loading the registry instead, with the same options
+// as the server if they change the agent ID derivation. The returned error
+// wraps ErrInconsistentRegistry and lists every offending ID.
+func ValidateRegistry(entries map[string]ed25519.PublicKey, opts ...Option) error {
+	derivation := newConfig(opts).agentIDDerivation
+	var offenders []string
+	for _, id := range slices.Sorted(maps.Keys(entries)) {
+		derived, err := derivation.AgentID(entries[id])
+		switch {
+		case err != nil:
+			offenders = append(offenders, fmt.Sprintf("%s (%v)", id, err))
+		case derived != id:
+			offenders = append(offenders, fmt.Sprintf("%s (key derives %s)", id, derived))
+		}
+	}
+	if len(offenders) > 0 {
+		return fmt.Errorf("%w: %s", ErrInconsistentRegistry, strings.Join(offenders, ", "))
+	}
+	return nil
+}
+
 func stringToSignV1(agentID, challengeID, nonce string, issuedAtMS int64) string {
 	// IMPORTANT: This must remain deterministic and must use LF only.
 	return "switchboard-auth-v1\n" +
@@ -50,3 +114,66 @@ func stringToSignV1(agentID, challengeID, nonce string, issuedAtMS int64) string
 		"issued_at_ms=" + strconv.FormatInt(issuedAtMS, 10) + "\n"
 }
 
+// Signing versions carried in auth_challenge.sig_v and auth_proof.sig_v. An
+// absent sig_v means v1.
+const (
+	signingV1 = 1
+	signingV2 = 2
+)
+
+// signingInput holds the handshake fields covered by a signature.
+type signingInput struct {
+	agentID     string
+	challengeID string
+	nonce       string
+	issuedAtMS  int64
+	label       string
+}
+
+// signingVersions is the registry of string-to-sign variants known to both
+// sides. Adding a version here (with a new domain-separation header) lets a
+// server roll to it by advertising it, without a flag day.
+var signingVersions = map[int]func(signingInput) string{
+	signingV1: func(in signingInput) string {
+		return stringToSignV1(in.agentID, in.challengeID, in.nonce, in.issuedAtMS)
+	},
+	signingV2: func(in signingInput) string {
+		return stringToSignV2(in.agentID, in.challengeID, in.nonce, in.issuedAtMS, in.label)
+	},
+}
+
+// stringToSign builds the string to sign for version v, treating 0 as v1.
+func stringToSign(v int, in signingInput) (string, bool) {
+	if v == 0 {
+		v = signingV1
+	}
+	build, ok := signingVersions[v]
+	if !ok {
+		return "", false
+	}
+	return build(in), true
+}
+
+// stringToSignV2 extends v1 with the agent label so that it is bound to the
+// identity by the signature.
+func stringToSignV2(agentID, challengeID, nonce string, issuedAtMS int64, label string) string {
+	// IMPORTANT: This must remain deterministic and must use LF only.
+	return "switchboard-auth-v2\n" +
+		"agent_id=" + agentID + "\n" +
+		"challenge_id=" + challengeID + "\n" +
+		"nonce=" + nonce + "\n" +
+		"issued_at_ms=" + strconv.FormatInt(issuedAtMS, 10) + "\n" +
+		"label=" + label + "\n"
+}
+
+// stringToSignTicket is what a client signs to redeem a resumption ticket in
+// auth_begin. Signing proves the client still holds the agent key, so a
+// ticket alone is not a bearer credential, and binds the label as v2 does.
+func stringToSignTicket(agentID, ticket string, clientTimeMS int64, label string) string {
+	// IMPORTANT: This must remain deterministic and must use LF only.
+	return "switchboard-auth-ticket-v1\n" +
+		"agent_id=" + agentID + "\n" +
+		"ticket=" + ticket + "\n" +
+		"client_time_ms=" + strconv.FormatInt(clientTimeMS, 10) + "\n" +
+		"label=" + label + "\n"
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// TicketKeySize is the size of a TicketIssuer key (AES-256-GCM).
+	TicketKeySize = 32
+
+	defaultTicketTTL = time.Hour
+
+	// ticketAAD binds sealed tickets to their purpose and format version.
+	ticketAAD = "switchboard-auth-ticket-v1"
+)
+
+// Ticket is a resumption ticket the server issued in auth_ok. Presenting it
+// with WithTicket on the next connection skips the challenge round trip. A
+// ticket is single-use: every successful handshake returns a fresh one.
+type Ticket struct {
+	// Value is the opaque ticket, sealed by the server.
+	Value string
+
+	// ExpiresAt is when the server stops accepting the ticket.
+	ExpiresAt time.Time
+}
+
+// ticketState is the sealed content of a ticket. Only the server that issued
+// it, or one sharing its key, can read it.
+type ticketState struct {
+	AgentID     string `json:"agent_id"`
+	ID          string `json:"id"`
+	ExpiresAtMS int64  `json:"exp_ms"`
+}
+
+// TicketIssuer issues and redeems resumption tickets on the server; see
+// WithTicketIssuer. It is safe for concurrent use and meant to be shared by
+// all handshakes of a process, since it remembers redeemed tickets.
+//
+// Tickets are sealed with AES-256-GCM under the issuer's key, so servers
+// sharing a key accept each other's tickets. Single use is only enforced per
+// TicketIssuer, though: a ticket stolen together with the agent's signature
+// could be redeemed once on every server holding the key. Changing the key
+// invalidates all outstanding tickets; clients then fall back to a challenge.
+type TicketIssuer struct {
+	aead cipher.AEAD
+	ttl  time.Duration
+	used *ChallengeReplayStore
+}
+
+// NewTicketIssuer returns an issuer sealing tickets with key, which must be
+// TicketKeySize random bytes, and issuing them for ttl. A non-positive ttl
+// defaults to an hour.
+func NewTicketIssuer(key []byte, ttl time.Duration) (*TicketIssuer, error) {
+	if len(key) != TicketKeySize {
+		return nil, fmt.Errorf("invalid ticket key length %d (want %d)", len(key), TicketKeySize)
+	}
+	if ttl <= 0 {
+		ttl = defaultTicketTTL
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// Redeemed ticket IDs are remembered for a full ttl, which outlasts the
+	// remaining lifetime of any ticket. If more tickets are redeemed within
+	// a ttl than the store holds, the excess fall back to a challenge.
+	return &TicketIssuer{aead: aead, ttl: ttl, used: NewChallengeReplayStore(ttl, 0)}, nil
+}
+
+// issue seals a new ticket for agentID, valid from now for the issuer's ttl.
+func (ti *TicketIssuer) issue(agentID string, now time.Time, random func(n int) ([]byte, error)) (Ticket, error) {
+	id, err := random(16)
+	if err != nil {
+		return Ticket{}, err
+	}
+	nonce, err := random(ti.aead.NonceSize())
+	if err != nil {
+		return Ticket{}, err
+	}
+	expiresAt := now.Add(ti.ttl)
+	plain, err := json.Marshal(ticketState{AgentID: agentID, ID: b64Encode(id), ExpiresAtMS: expiresAt.UnixMilli()})
+	if err != nil {
+		return Ticket{}, err
+	}
+	sealed := ti.aead.Seal(nonce, nonce, plain, []byte(ticketAAD))
+	return Ticket{Value: b64Encode(sealed), ExpiresAt: time.UnixMilli(expiresAt.UnixMilli())}, nil
+}
+
+// redeem checks the ticket presented in begin for the agent whose registered
+// key is pub, and marks it used. The ticket must be one this issuer sealed,
+// for begin's agent_id, unexpired, signed by pub and not redeemed before.
+func (ti *TicketIssuer) redeem(begin authBegin, pub ed25519.PublicKey, now time.Time) error {
+	sealed, err := b64Decode(begin.Ticket)
+	if err != nil || len(sealed) < ti.aead.NonceSize() {
+		return errors.New("ticket: malformed")
+	}
+	nonce, ciphertext := sealed[:ti.aead.NonceSize()], sealed[ti.aead.NonceSize():]
+	plain, err := ti.aead.Open(nil, nonce, ciphertext, []byte(ticketAAD))
+	if err != nil {
+		return errors.New("ticket: not issued by this server")
+	}
+	var state ticketState
+	if err := json.Unmarshal(plain, &state); err != nil {
+		return fmt.Errorf("ticket: %w", err)
+	}
+	if state.AgentID != begin.AgentID {
+		return errors.New("ticket: issued to another agent")
+	}
+	if now.UnixMilli() > state.ExpiresAtMS {
+		return fmt.Errorf("ticket: expired at %s", time.UnixMilli(state.ExpiresAtMS).UTC().Format(time.RFC3339))
+	}
+
+	sig, err := b64Decode(begin.TicketSig)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("ticket: bad signature")
+	}
+	toVerify := stringToSignTicket(begin.AgentID, begin.Ticket, begin.ClientTimeMS, begin.Label)
+	if !ed25519.Verify(pub, []byte(toVerify), sig) {
+		return errors.New("ticket: bad signature")
+	}
+	switch err := ti.used.markUsed(state.ID, now); {
+	case errors.Is(err, errChallengeReplayed):
+		return errors.New("ticket: already redeemed")
+	case err != nil:
+		return fmt.Errorf("ticket: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+)
+
+// sqlStateQueryCanceled is the PostgreSQL error code reported when a
+// statement is cancelled, including by a statement timeout.
+const sqlStateQueryCanceled = "57014"
+
+// Config tunes how RunWithConfig applies migrations.
+type Config struct {
+	// StatementTimeout bounds the execution time of each migration statement.
+	// A statement that runs longer is cancelled and the run fails with
+	// ErrStatementTimeout, instead of holding its locks indefinitely. Zero
+	// means no limit.
+	StatementTimeout time.Duration
+
+	// LockDB, if set, is where RunWithConfig takes an advisory lock that it
+	// holds for the whole run, on a dedicated connection, while db only runs
+	// the DDL. This lets the migrations run as a limited role while the lock
+	// is held by an administrative one.
+	//
+	// The lock is taken in addition to golang-migrate's own advisory lock on
+	// db, which cannot be disabled but needs no privileges, and under a
+	// different key: runs are only serialized with other runs using a LockDB
+	// connected to the same database.
+	LockDB *sql.DB
+}
+
+// lockDBName distinguishes the Config.LockDB advisory lock from the one
+// golang-migrate takes, which a LockDB session holding it would deadlock.
+const lockDBName = "lock_db"
+
+// RunWithConfig applies all pending migrations like Run, with cfg applied to
+// the migration driver.
+//
+// A migration cancelled by cfg.StatementTimeout leaves the database dirty at
+// its version, exactly like any other failed migration.
+//
+// A failure to take either advisory lock is reported as ErrLockFailed, and
+// a failure while migrating as ErrMigrationFailed.
+func RunWithConfig(db *sql.DB, cfg Config) error {
+	if cfg.LockDB != nil {
+		unlock, err := lockSeparately(cfg.LockDB)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	m, err := newMigrateWithConfig(db, &postgres.Config{StatementTimeout: cfg.StatementTimeout})
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
+		if isStatementTimeout(err) {
+			return fmt.Errorf("%w: %w after %s: %w", ErrMigrationFailed, ErrStatementTimeout, cfg.StatementTimeout, err)
+		}
+		return migrateError(err)
+	}
+	return nil
+}
+
+// lockSeparately takes the Config.LockDB advisory lock on a dedicated
+// connection from lockDB. The returned function releases the lock and the
+// connection.
+func lockSeparately(lockDB *sql.DB) (unlock func(), err error) {
+	ctx := context.Background()
+	conn, err := lockDB.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrLockFailed, err)
+	}
+
+	var databaseName, schemaName string
+	if err := conn.QueryRowContext(ctx, `SELECT CURRENT_DATABASE(), CURRENT_SCHEMA()`).Scan(&databaseName, &schemaName); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: %w", ErrLockFailed, err)
+	}
+	lockID, err := database.GenerateAdvisoryLockId(databaseName, schemaName, postgres.DefaultMigrationsTable, lockDBName)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: %w", ErrLockFailed, err)
+	}
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: %w", ErrLockFailed, err)
+	}
+
+	return func() {
+		// Closing the session would release the lock too, but the pool keeps
+		// the connection open.
+		_, _ = conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, lockID)
+		_ = conn.Close()
+	}, nil
+}
+
+// migrateError wraps an error returned by Up or Down in ErrLockFailed if
+// golang-migrate could not take its advisory lock, and in ErrMigrationFailed
+// otherwise.
+func migrateError(err error) error {
+	if isLockError(err) {
+		return fmt.Errorf("%w: %w", ErrLockFailed, err)
+	}
+	return fmt.Errorf("%w: %w", ErrMigrationFailed, err)
+}
+
+// isLockError reports whether err comes from golang-migrate failing to take
+// its advisory lock.
+func isLockError(err error) bool {
+	if errors.Is(err, migrate.ErrLocked) || errors.Is(err, migrate.ErrLockTimeout) || errors.Is(err, database.ErrLocked) {
+		return true
+	}
+	// The postgres driver's only way of reporting a failed pg_advisory_lock.
+	var dbErr database.Error
+	if errors.As(err, &dbErr) {
+		return dbErr.Err == "try lock failed"
+	}
+	var dbErrPtr *database.Error
+	return errors.As(err, &dbErrPtr) && dbErrPtr.Err == "try lock failed"
+}
+
+// isStatementTimeout reports whether err is a migration statement that was
+// cancelled, either by the driver's context deadline or by the server.
+func isStatementTimeout(err error) bool {
+	var dbErr database.Error
+	if errors.As(err, &dbErr) {
+		err = dbErr.OrigErr
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var pgErr interface{ SQLState() string }
+	return errors.As(err, &pgErr) && pgErr.SQLState() == sqlStateQueryCanceled
+}
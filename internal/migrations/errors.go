@@ -12,6 +12,33 @@ var (
 	// ErrMigrateInstance is returned when the migrate instance cannot be created.
 	ErrMigrateInstance = errors.New("failed to create migrate instance")
 
+	// ErrLockFailed is returned when the migration advisory lock cannot be
+	// acquired, before any migration ran.
+	ErrLockFailed = errors.New("failed to acquire migration lock")
+
+	// ErrResetNotAllowed is returned by Reset when the opt-in environment
+	// variable is not set.
+	ErrResetNotAllowed = errors.New("migration reset not allowed")
+
 	// ErrMigrationFailed is returned when migrations fail to run.
 	ErrMigrationFailed = errors.New("failed to run migrations")
+
+	// ErrStatementTimeout is returned, wrapped in ErrMigrationFailed, when a
+	// migration statement exceeds Config.StatementTimeout.
+	ErrStatementTimeout = errors.New("migration statement timed out")
+
+	// ErrVerificationFailed is returned when migration checksums cannot be verified.
+	ErrVerificationFailed = errors.New("failed to verify migrations")
+
+	// ErrChecksumMismatch is returned when an applied migration was edited afterwards.
+	ErrChecksumMismatch = errors.New("applied migration checksum mismatch")
+
+	// ErrVersionRead is returned when the current schema version cannot be read.
+	ErrVersionRead = errors.New("failed to read schema version")
+
+	// ErrListFailed is returned when the embedded migrations cannot be listed.
+	ErrListFailed = errors.New("failed to list migrations")
+
+	// ErrVersionMismatch is returned when the schema is not at the required version.
+	ErrVersionMismatch = errors.New("schema version mismatch")
 )
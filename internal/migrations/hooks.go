@@ -0,0 +1,77 @@
+package migrations
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/golang-migrate/migrate/v4"
+)
+
+// Hooks are callbacks invoked by RunWithHooks around each applied migration.
+// Either may be nil.
+type Hooks struct {
+	// BeforeEach runs before the migration to version is applied. Returning
+	// an error aborts the run without applying it.
+	BeforeEach func(version uint) error
+
+	// AfterEach runs after the migration to version was attempted, with the
+	// error it produced, if any.
+	AfterEach func(version uint, err error)
+}
+
+// RunWithHooks applies all pending migrations like Run, one at a time, calling
+// hooks around each one. This allows snapshotting, notifying or gating on
+// external conditions per migration.
+func RunWithHooks(db *sql.DB, hooks Hooks) error {
+	m, err := newMigrate(db)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	src, err := newSource()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	for {
+		current, err := currentVersion(m)
+		if err != nil {
+			return err
+		}
+
+		// Find the next pending migration.
+		var next uint
+		if current == 0 {
+			next, err = src.First()
+		} else {
+			next, err = src.Next(current)
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrMigrationFailed, err)
+		}
+
+		if hooks.BeforeEach != nil {
+			if err := hooks.BeforeEach(next); err != nil {
+				return fmt.Errorf("%w: before migration %d: %w", ErrMigrationFailed, next, err)
+			}
+		}
+
+		stepErr := m.Steps(1)
+		if errors.Is(stepErr, migrate.ErrNoChange) {
+			stepErr = nil
+		}
+		if hooks.AfterEach != nil {
+			hooks.AfterEach(next, stepErr)
+		}
+		if stepErr != nil {
+			return fmt.Errorf("%w: migration %d: %w", ErrMigrationFailed, next, stepErr)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// MigrationInfo describes one embedded migration.
+type MigrationInfo struct {
+	Version uint
+	Name    string
+	HasUp   bool
+	HasDown bool
+}
+
+// List returns every embedded migration in version order. It reads only the
+// embedded source and never touches a database, so tooling and tests can use
+// it to inspect the schema history.
+func List() ([]MigrationInfo, error) {
+	src, err := newSource()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	var infos []MigrationInfo
+	version, err := src.First()
+	for err == nil {
+		upName, hasUp, upErr := readIdentifier(src.ReadUp(version))
+		downName, hasDown, downErr := readIdentifier(src.ReadDown(version))
+		if readErr := errors.Join(upErr, downErr); readErr != nil {
+			return nil, fmt.Errorf("%w: version %d: %w", ErrListFailed, version, readErr)
+		}
+		info := MigrationInfo{Version: version, Name: upName, HasUp: hasUp, HasDown: hasDown}
+		if !hasUp {
+			info.Name = downName
+		}
+		infos = append(infos, info)
+
+		version, err = src.Next(version)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %w", ErrListFailed, err)
+	}
+	return infos, nil
+}
+
+// readIdentifier reports the identifier of a migration file as returned by
+// the source's ReadUp or ReadDown, and whether the file exists.
+func readIdentifier(r io.ReadCloser, identifier string, err error) (string, bool, error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	_ = r.Close()
+	return identifier, true, nil
+}
@@ -0,0 +1,125 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+)
+
+func TestList(t *testing.T) {
+	infos, err := List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	want := []MigrationInfo{
+		{Version: 1, Name: "create_agent_key_status_enum", HasUp: true, HasDown: true},
+		{Version: 2, Name: "create_agent_keys_table", HasUp: true, HasDown: true},
+		{Version: 3, Name: "create_outbound_observations_table", HasUp: true, HasDown: true},
+		{Version: 4, Name: "create_partition_procedure", HasUp: true, HasDown: true},
+	}
+	if len(infos) != len(want) {
+		t.Fatalf("got %d migrations want %d: %+v", len(infos), len(want), infos)
+	}
+	for i := range want {
+		if infos[i] != want[i] {
+			t.Errorf("migration %d: got %+v want %+v", i, infos[i], want[i])
+		}
+	}
+}
+
+func TestCountVersionsBetween(t *testing.T) {
+	for _, tt := range []struct {
+		from, to uint
+		want     int
+	}{
+		{0, 4, 4},
+		{1, 3, 2},
+		{4, 4, 0},
+		{0, 0, 0},
+	} {
+		got, err := countVersionsBetween(tt.from, tt.to)
+		if err != nil || got != tt.want {
+			t.Errorf("countVersionsBetween(%d, %d) = %d, %v; want %d", tt.from, tt.to, got, err, tt.want)
+		}
+	}
+}
+
+func TestRunStepsRejectsNonPositive(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		if _, err := RunSteps(nil, n); !errors.Is(err, ErrMigrationFailed) {
+			t.Errorf("RunSteps(%d): got %v want ErrMigrationFailed", n, err)
+		}
+	}
+}
+
+func TestResetRequiresOptIn(t *testing.T) {
+	t.Setenv(allowResetEnv, "")
+	if err := Reset(nil); !errors.Is(err, ErrResetNotAllowed) {
+		t.Fatalf("Reset: got %v want ErrResetNotAllowed", err)
+	}
+}
+
+// sqlStateError stands in for a driver error carrying a PostgreSQL SQLSTATE.
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "pq: " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func TestIsLockError(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"migrate locked", migrate.ErrLocked, true},
+		{"migrate lock timeout", fmt.Errorf("up: %w", migrate.ErrLockTimeout), true},
+		{"driver locked", database.ErrLocked, true},
+		{"try lock failed", database.Error{Err: "try lock failed", OrigErr: errors.New("conn reset")}, true},
+		{"try lock failed pointer", &database.Error{Err: "try lock failed"}, true},
+		{"other database error", database.Error{Err: "migration failed", OrigErr: errors.New("syntax error")}, false},
+		{"unrelated", errors.New("boom"), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLockError(tt.err); got != tt.want {
+				t.Fatalf("isLockError(%v) = %v want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrateError(t *testing.T) {
+	err := migrateError(migrate.ErrLocked)
+	if !errors.Is(err, ErrLockFailed) || errors.Is(err, ErrMigrationFailed) || !errors.Is(err, migrate.ErrLocked) {
+		t.Fatalf("lock error: got %v want ErrLockFailed", err)
+	}
+	cause := errors.New("syntax error")
+	err = migrateError(cause)
+	if !errors.Is(err, ErrMigrationFailed) || errors.Is(err, ErrLockFailed) || !errors.Is(err, cause) {
+		t.Fatalf("migration error: got %v want ErrMigrationFailed", err)
+	}
+}
+
+func TestIsStatementTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"context deadline", database.Error{OrigErr: context.DeadlineExceeded}, true},
+		{"query canceled", database.Error{OrigErr: sqlStateError(sqlStateQueryCanceled)}, true},
+		{"bare query canceled", fmt.Errorf("exec: %w", sqlStateError(sqlStateQueryCanceled)), true},
+		{"other SQLSTATE", database.Error{OrigErr: sqlStateError("42601")}, false},
+		{"context canceled", database.Error{OrigErr: context.Canceled}, false},
+		{"unrelated", errors.New("boom"), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isStatementTimeout(tt.err); got != tt.want {
+				t.Fatalf("isStatementTimeout(%v) = %v want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
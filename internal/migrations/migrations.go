@@ -1,12 +1,14 @@
 package migrations
 
 import (
+	"context"
 	"database/sql"
 	"embed"
 	"fmt"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 )
 
@@ -15,29 +17,68 @@ var migrationsFS embed.FS
 
 // Run applies all database migrations to the provided database connection.
 // It uses golang-migrate internally to run migrations from embedded SQL files.
+//
+// Failing to take golang-migrate's advisory lock is reported as ErrLockFailed
+// and any later failure as ErrMigrationFailed.
 func Run(db *sql.DB) error {
+	m, err := newMigrate(db)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	// Run all pending migrations
+	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
+		return migrateError(err)
+	}
+
+	return nil
+}
+
+// newMigrate creates a migrate instance backed by the embedded migrations.
+//
+// The postgres driver is bound to a dedicated connection taken from db, so
+// closing the returned instance releases that connection without closing db.
+func newMigrate(db *sql.DB) (*migrate.Migrate, error) {
+	return newMigrateWithConfig(db, &postgres.Config{})
+}
+
+// newMigrateWithConfig is newMigrate with a custom postgres driver config.
+func newMigrateWithConfig(db *sql.DB, cfg *postgres.Config) (*migrate.Migrate, error) {
 	// Create postgres driver instance
-	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	conn, err := db.Conn(context.Background())
 	if err != nil {
-		return fmt.Errorf("%w: %w", ErrDriverCreation, err)
+		return nil, fmt.Errorf("%w: %w", ErrDriverCreation, err)
+	}
+	driver, err := postgres.WithConnection(context.Background(), conn, cfg)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: %w", ErrDriverCreation, err)
 	}
 
 	// Create source driver from embedded filesystem
-	sourceDriver, err := iofs.New(migrationsFS, "migrations")
+	sourceDriver, err := newSource()
 	if err != nil {
-		return fmt.Errorf("%w: %w", ErrSourceCreation, err)
+		_ = driver.Close()
+		return nil, err
 	}
 
 	// Create migrate instance
 	m, err := migrate.NewWithInstance("iofs", sourceDriver, "postgres", driver)
 	if err != nil {
-		return fmt.Errorf("%w: %w", ErrMigrateInstance, err)
+		_ = sourceDriver.Close()
+		_ = driver.Close()
+		return nil, fmt.Errorf("%w: %w", ErrMigrateInstance, err)
 	}
 
-	// Run all pending migrations
-	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
-		return fmt.Errorf("%w: %w", ErrMigrationFailed, err)
-	}
+	return m, nil
+}
 
-	return nil
+// newSource creates a source driver reading the embedded migrations.
+func newSource() (source.Driver, error) {
+	sourceDriver, err := iofs.New(migrationsFS, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSourceCreation, err)
+	}
+	return sourceDriver, nil
 }
@@ -0,0 +1,40 @@
+package migrations
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang-migrate/migrate/v4"
+)
+
+// allowResetEnv must be set to "1" for Reset to run.
+const allowResetEnv = "SWITCHBOARD_ALLOW_MIGRATION_RESET"
+
+// Reset reverts every applied migration and then applies them all again,
+// leaving db with a freshly migrated schema. It is meant for integration tests
+// that need a deterministic starting point; all data in the migrated tables is
+// lost.
+//
+// To keep it away from production databases, Reset refuses to run, returning
+// ErrResetNotAllowed, unless the SWITCHBOARD_ALLOW_MIGRATION_RESET environment
+// variable is set to 1. A dirty database cannot be reverted and fails with
+// ErrMigrationFailed; it has to be repaired by hand.
+func Reset(db *sql.DB) error {
+	if os.Getenv(allowResetEnv) != "1" {
+		return fmt.Errorf("%w: set %s=1 to allow it", ErrResetNotAllowed, allowResetEnv)
+	}
+
+	m, err := newMigrate(db)
+	if err != nil {
+		return err
+	}
+	err = m.Down()
+	// Release the connection newMigrate took before Run takes another.
+	m.Close()
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("reverting: %w", migrateError(err))
+	}
+	return Run(db)
+}
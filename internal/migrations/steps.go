@@ -0,0 +1,90 @@
+package migrations
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/golang-migrate/migrate/v4"
+)
+
+// RunSteps applies at most maxSteps pending migrations and returns how many
+// were actually applied. Fewer pending migrations than maxSteps is not an
+// error: RunSteps applies what is pending and stops. It gives operators
+// incremental control during incidents, where Run applies everything.
+//
+// If a migration fails, the returned count covers the migrations applied
+// before it.
+func RunSteps(db *sql.DB, maxSteps int) (int, error) {
+	if maxSteps <= 0 {
+		return 0, fmt.Errorf("%w: maxSteps must be positive, got %d", ErrMigrationFailed, maxSteps)
+	}
+
+	m, err := newMigrate(db)
+	if err != nil {
+		return 0, err
+	}
+	defer m.Close()
+
+	before, err := currentVersion(m)
+	if err != nil {
+		return 0, err
+	}
+
+	stepErr := m.Steps(maxSteps)
+
+	after, err := currentVersion(m)
+	if err != nil {
+		return 0, err
+	}
+	applied, err := countVersionsBetween(before, after)
+	if err != nil {
+		return 0, err
+	}
+
+	var short migrate.ErrShortLimit
+	switch {
+	case stepErr == nil,
+		errors.As(stepErr, &short),
+		errors.Is(stepErr, migrate.ErrNoChange),
+		stepErr == fs.ErrNotExist: // nothing pending; a wrapped ErrNotExist means an unknown version
+		return applied, nil
+	default:
+		return applied, fmt.Errorf("%w: %w", ErrMigrationFailed, stepErr)
+	}
+}
+
+// currentVersion returns the applied schema version, or 0 if none.
+func currentVersion(m *migrate.Migrate) (uint, error) {
+	version, _, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrVersionRead, err)
+	}
+	return version, nil
+}
+
+// countVersionsBetween counts the embedded migrations in (from, to].
+func countVersionsBetween(from, to uint) (int, error) {
+	src, err := newSource()
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	count := 0
+	version, err := src.First()
+	for err == nil {
+		if version > from && version <= to {
+			count++
+		}
+		version, err = src.Next(version)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return 0, fmt.Errorf("%w: %w", ErrSourceCreation, err)
+	}
+	return count, nil
+}
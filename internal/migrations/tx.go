@@ -0,0 +1,105 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+)
+
+// RunTx applies all pending migrations inside a transaction controlled by the
+// caller, without committing it.
+//
+// golang-migrate cannot run inside a caller's transaction: its postgres driver
+// holds a session-level advisory lock on its own connection and commits every
+// version change separately. PostgreSQL DDL is transactional, however, so RunTx
+// executes the embedded up files directly on tx and records the resulting
+// version in the same schema_migrations table Run uses. Rolling back tx undoes
+// both the schema changes and the version bump, which lets tests exercise
+// migrations against a shared database and discard them afterwards.
+//
+// RunTx takes the same advisory lock as Run, scoped to the transaction, so it
+// never races a concurrent Run against the same database.
+func RunTx(tx *sql.Tx) error {
+	ctx := context.Background()
+
+	// Serialize with Run using golang-migrate's advisory lock id.
+	var databaseName, schemaName string
+	if err := tx.QueryRowContext(ctx, `SELECT CURRENT_DATABASE(), CURRENT_SCHEMA()`).Scan(&databaseName, &schemaName); err != nil {
+		return fmt.Errorf("%w: %w", ErrMigrationFailed, err)
+	}
+	lockID, err := database.GenerateAdvisoryLockId(databaseName, schemaName, postgres.DefaultMigrationsTable)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrMigrationFailed, err)
+	}
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, lockID); err != nil {
+		return fmt.Errorf("%w: %w", ErrMigrationFailed, err)
+	}
+
+	// Read the current version, creating the version table like golang-migrate does.
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+postgres.DefaultMigrationsTable+
+		` (version bigint not null primary key, dirty boolean not null)`); err != nil {
+		return fmt.Errorf("%w: %w", ErrMigrationFailed, err)
+	}
+	var (
+		current int64 = -1
+		dirty   bool
+	)
+	err = tx.QueryRowContext(ctx, `SELECT version, dirty FROM `+postgres.DefaultMigrationsTable+` LIMIT 1`).Scan(&current, &dirty)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %w", ErrMigrationFailed, err)
+	}
+	if dirty {
+		return fmt.Errorf("%w: database is dirty at version %d", ErrMigrationFailed, current)
+	}
+
+	src, err := newSource()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Apply every embedded migration above the current version, in order.
+	applied := current
+	version, err := src.First()
+	for ; err == nil; version, err = src.Next(version) {
+		if int64(version) <= current {
+			continue
+		}
+		r, identifier, readErr := src.ReadUp(version)
+		if readErr != nil {
+			return fmt.Errorf("%w: %w", ErrMigrationFailed, readErr)
+		}
+		body, readErr := io.ReadAll(r)
+		_ = r.Close()
+		if readErr != nil {
+			return fmt.Errorf("%w: %w", ErrMigrationFailed, readErr)
+		}
+		if _, execErr := tx.ExecContext(ctx, string(body)); execErr != nil {
+			return fmt.Errorf("%w: migration %d_%s: %w", ErrMigrationFailed, version, identifier, execErr)
+		}
+		applied = int64(version)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %w", ErrMigrationFailed, err)
+	}
+
+	if applied == current {
+		return nil
+	}
+
+	// Record the new version the same way golang-migrate does.
+	if _, err := tx.ExecContext(ctx, `TRUNCATE `+postgres.DefaultMigrationsTable); err != nil {
+		return fmt.Errorf("%w: %w", ErrMigrationFailed, err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO `+postgres.DefaultMigrationsTable+` (version, dirty) VALUES ($1, false)`, applied); err != nil {
+		return fmt.Errorf("%w: %w", ErrMigrationFailed, err)
+	}
+
+	return nil
+}
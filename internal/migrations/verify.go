@@ -0,0 +1,131 @@
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/golang-migrate/migrate/v4"
+)
+
+// checksumsTable records the checksum of each applied migration. It is managed
+// by Verify and never touched by Run.
+const checksumsTable = "schema_migration_checksums"
+
+type migrationChecksum struct {
+	version    uint
+	identifier string
+	checksum   string
+}
+
+// Verify detects applied migrations whose embedded SQL changed after they were
+// applied.
+//
+// For every embedded migration at or below the current schema version, Verify
+// computes the SHA-256 of its up file and compares it with the checksum stored
+// in the schema_migration_checksums table. Checksums seen for the first time
+// are recorded, so the first call establishes the baseline. Any mismatch is
+// reported as an error wrapping ErrChecksumMismatch that lists the offending
+// migrations.
+//
+// Verify is opt-in: Run neither records nor checks checksums.
+func Verify(db *sql.DB) error {
+	m, err := newMigrate(db)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	current, _, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		// Nothing applied yet, so nothing can have drifted.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+	}
+
+	sums, err := embeddedChecksums(current)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+checksumsTable+` (
+  version BIGINT PRIMARY KEY,
+  checksum TEXT NOT NULL,
+  recorded_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`); err != nil {
+		return fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+	}
+
+	var changed []string
+	for _, sum := range sums {
+		var stored string
+		err := db.QueryRowContext(ctx,
+			`SELECT checksum FROM `+checksumsTable+` WHERE version = $1`, sum.version).Scan(&stored)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			if _, err := db.ExecContext(ctx,
+				`INSERT INTO `+checksumsTable+` (version, checksum) VALUES ($1, $2) ON CONFLICT (version) DO NOTHING`,
+				sum.version, sum.checksum); err != nil {
+				return fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+			}
+		case err != nil:
+			return fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+		case stored != sum.checksum:
+			changed = append(changed, fmt.Sprintf("%d_%s", sum.version, sum.identifier))
+		}
+	}
+
+	if len(changed) > 0 {
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// embeddedChecksums hashes the up file of every embedded migration whose
+// version is at or below upTo.
+func embeddedChecksums(upTo uint) ([]migrationChecksum, error) {
+	src, err := newSource()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	var sums []migrationChecksum
+	version, err := src.First()
+	for err == nil && version <= upTo {
+		sum, sumErr := checksumUp(src.ReadUp(version))
+		if sumErr != nil {
+			return nil, fmt.Errorf("%w: %w", ErrVerificationFailed, sumErr)
+		}
+		sum.version = version
+		sums = append(sums, sum)
+
+		version, err = src.Next(version)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+	}
+	return sums, nil
+}
+
+func checksumUp(r io.ReadCloser, identifier string, err error) (migrationChecksum, error) {
+	if err != nil {
+		return migrationChecksum{}, err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return migrationChecksum{}, err
+	}
+	return migrationChecksum{identifier: identifier, checksum: hex.EncodeToString(h.Sum(nil))}, nil
+}
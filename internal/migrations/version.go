@@ -0,0 +1,50 @@
+package migrations
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/golang-migrate/migrate/v4"
+)
+
+// Version returns the current schema version of the database and whether the
+// last migration left it dirty. It returns version 0 when no migration has been
+// applied yet. Version never applies any migration.
+func Version(db *sql.DB) (version uint, dirty bool, err error) {
+	m, err := newMigrate(db)
+	if err != nil {
+		return 0, false, err
+	}
+	defer m.Close()
+
+	version, dirty, err = m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("%w: %w", ErrVersionRead, err)
+	}
+	return version, dirty, nil
+}
+
+// RequireVersion returns an error unless the database is exactly at the
+// expected schema version and not dirty. It never attempts to migrate, which
+// makes it suitable for read replicas that must refuse to serve until the
+// primary has been migrated.
+func RequireVersion(db *sql.DB, expected uint) error {
+	version, dirty, err := Version(db)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case dirty:
+		return fmt.Errorf("%w: database is dirty at version %d (expected %d)", ErrVersionMismatch, version, expected)
+	case version < expected:
+		return fmt.Errorf("%w: database is behind at version %d (expected %d)", ErrVersionMismatch, version, expected)
+	case version > expected:
+		return fmt.Errorf("%w: database is ahead at version %d (expected %d)", ErrVersionMismatch, version, expected)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package protocol
+
+import "time"
+
+const (
+	// coalesceMaxBytes is how much WithWriteCoalesce buffers before flushing
+	// without waiting for the window to pass.
+	coalesceMaxBytes = 64 << 10
+
+	// coalesceCloseTimeout bounds the flush of buffered frames on Close, and
+	// of a background flush unless the window is longer.
+	coalesceCloseTimeout = time.Second
+)
+
+// coalesces reports whether Send buffers msg instead of writing it.
+func (c *Conn) coalesces(msg Message) bool {
+	return c.coalesceWindow > 0 &&
+		msg.Type == TypeMessagePayload &&
+		msg.Kind == PayloadKindOneway &&
+		len(msg.Data) < coalesceMaxBytes
+}
+
+// sendCoalesced appends msg to the coalescing buffer and arms the flush timer.
+// The caller must hold writeMu.
+func (c *Conn) sendCoalesced(msg Message) error {
+	if err := c.writeMessage(&c.coalesceBuf, msg); err != nil {
+		return err
+	}
+	if c.coalesceBuf.Len() >= coalesceMaxBytes {
+		return c.flushCoalescedLocked()
+	}
+	if !c.coalesceArmed {
+		if c.coalesceTimer == nil {
+			c.coalesceTimer = time.AfterFunc(c.coalesceWindow, c.flushCoalescedAsync)
+		} else {
+			c.coalesceTimer.Reset(c.coalesceWindow)
+		}
+		c.coalesceArmed = true
+	}
+	return nil
+}
+
+// flushCoalescedLocked writes every buffered frame in one write. Every other
+// write path calls it first so that buffered frames keep their order. The
+// caller must hold writeMu.
+func (c *Conn) flushCoalescedLocked() error {
+	if c.coalesceArmed {
+		c.coalesceTimer.Stop()
+		c.coalesceArmed = false
+	}
+	if c.coalesceBuf.Len() == 0 {
+		return nil
+	}
+
+	_, err := statsWriter{c}.Write(c.coalesceBuf.Bytes())
+	if err == nil {
+		c.framesSent.Add(c.coalesceBuf.frames)
+	}
+	c.coalesceBuf.Reset()
+	c.coalesceBuf.frames = 0
+	return err
+}
+
+// flushCoalescedAsync runs when the coalescing window has passed. Nobody is
+// left to report a failure to, so a failed flush closes the connection.
+//
+// The flush holds writeMu, so every other write method queues behind it
+// whatever its context says. Its write is therefore bounded even without
+// WithWriteTimeout: a peer that stopped reading gets the connection closed
+// after the longer of the window and coalesceCloseTimeout.
+func (c *Conn) flushCoalescedAsync() {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.coalesceArmed = false
+	c.writing.Store(true)
+	if c.coalesceBuf.Len() > 0 {
+		_ = c.nc.SetWriteDeadline(time.Now().Add(max(c.coalesceWindow, coalesceCloseTimeout)))
+	}
+	err := c.flushCoalescedLocked()
+	_ = c.nc.SetWriteDeadline(time.Time{})
+	c.writing.Store(false)
+	if err != nil {
+		_ = c.Close()
+	}
+}
+
+// flushCoalescedOnClose flushes buffered frames before the connection closes.
+// A write that is already in progress owns writeMu and may be blocked on the
+// transport, so the flush is skipped rather than waiting for it.
+func (c *Conn) flushCoalescedOnClose() {
+	if c.coalesceWindow == 0 || !c.writeMu.TryLock() {
+		return
+	}
+	defer c.writeMu.Unlock()
+
+	if c.coalesceBuf.Len() > 0 {
+		_ = c.nc.SetWriteDeadline(time.Now().Add(coalesceCloseTimeout))
+	}
+	_ = c.flushCoalescedLocked()
+}
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+)
+
+// maxDecompressedLen bounds what the data of a compressed message may expand
+// to, so that a small message cannot make the receiver allocate without
+// limit. Send only compresses data up to this size.
+const maxDecompressedLen = 64 << 20
+
+// compresses reports whether Send compresses message data of n bytes that
+// leaves firstDataCap bytes of room in the first frame: only data that would
+// be fragmented is worth the CPU.
+func (c *Conn) compresses(n, firstDataCap int) bool {
+	return c.compress && n > firstDataCap && n <= maxDecompressedLen
+}
+
+// compressData returns data as a zlib stream using the WithCompressionDictionary
+// dictionary, and false if compressing does not make it smaller.
+func (c *Conn) compressData(data []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	buf.Grow(len(data) / 2)
+	zw, _ := c.compressors.Get().(*zlib.Writer)
+	if zw == nil {
+		// The level is valid, so NewWriterLevelDict cannot fail.
+		zw, _ = zlib.NewWriterLevelDict(&buf, flate.DefaultCompression, c.compressDict)
+	} else {
+		zw.Reset(&buf)
+	}
+	_, err := zw.Write(data)
+	if err == nil {
+		err = zw.Close()
+	}
+	zw.Reset(io.Discard)
+	c.compressors.Put(zw)
+	if err != nil || buf.Len() >= len(data) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// decompressData expands the zlib stream of a compressed message. The caller
+// must hold readMu.
+func (c *Conn) decompressData(data []byte) ([]byte, error) {
+	src := bytes.NewReader(data)
+	var err error
+	if c.decompressor == nil {
+		c.decompressor, err = zlib.NewReaderDict(src, c.compressDict)
+	} else {
+		err = c.decompressor.(zlib.Resetter).Reset(src, c.compressDict)
+	}
+	if errors.Is(err, zlib.ErrDictionary) {
+		return nil, fmt.Errorf("%w: message needs dictionary %08x, ours is %08x", ErrCompressionDictionary, streamDictID(data), adler32.Checksum(c.compressDict))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCompression, err)
+	}
+
+	var out bytes.Buffer
+	n, err := out.ReadFrom(io.LimitReader(c.decompressor, maxDecompressedLen+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCompression, err)
+	}
+	if n > maxDecompressedLen {
+		return nil, fmt.Errorf("%w: data expands beyond %d bytes", ErrCompression, maxDecompressedLen)
+	}
+	return out.Bytes(), nil
+}
+
+// streamDictID returns the DICTID of the zlib stream data, the Adler-32
+// checksum of the dictionary it was compressed with. NewReaderDict only
+// reports ErrDictionary for a stream that has one.
+func streamDictID(data []byte) uint32 {
+	if len(data) < 6 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(data[2:6])
+}
@@ -3,41 +3,122 @@ package protocol
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const defaultMaxFramePayload = 16 << 20 // 16 MiB
 
-type Option func(*Conn)
+// defaultMaxEmptyFragments is the default WithMaxEmptyFragments limit.
+const defaultMaxEmptyFragments = 32
 
-func WithMaxFramePayloadBytes(n int) Option {
-	return func(c *Conn) {
-		if n > 0 {
-			c.maxFramePayload = n
-		}
-	}
-}
+// forceCloseGrace is how long a cancelled read may stay blocked before
+// WithForceCloseOnCancel closes the connection.
+const forceCloseGrace = 100 * time.Millisecond
 
-// Conn wraps a net.Conn and provides tunnel protocol send/receive.
+// Conn wraps a net.Conn, or any io.ReadWriteCloser via NewRWC, and provides
+// tunnel protocol send/receive.
 //
 // Conn is safe for one concurrent reader and one concurrent writer.
 type Conn struct {
-	nc net.Conn
-
-	maxFramePayload int
+	nc transport
+
+	maxFramePayload     int
+	maxPayloadByType    map[Type]int
+	readIdleTimeout     time.Duration
+	defaultReadTimeout  time.Duration
+	reassemblyTimeout   time.Duration
+	maxEmptyFragments   int
+	writeTimeout        time.Duration
+	writeStallTimeout   time.Duration
+	defaultWriteTimeout time.Duration
+	skipUnknown         bool
+	forceCloseOnCancel  bool
+	keepOpenOnEnvelope  bool
+	validators          map[PayloadFormat]func([]byte) error
+	requireAuthFirst    bool
+	autoPong            bool
+	allowedKinds        map[PayloadKind]bool
+	unfragmentedAuth    bool
+	defaultFormat       PayloadFormat
+	coalesceWindow      time.Duration
+	padBuckets          []int
+	compress            bool
+	compressDict        []byte
+	keepAliveJitter     float64
+	frameObserver       func(FrameInfo)
+	controlHandler      func(Message)
+	controlTypes        map[Type]bool
+
+	authenticated atomic.Bool
+	readerActive  atomic.Bool
+	closed        atomic.Bool
+
+	bytesSent      atomic.Uint64
+	bytesReceived  atomic.Uint64
+	framesSent     atomic.Uint64
+	framesReceived atomic.Uint64
+	reading        atomic.Bool
+	writing        atomic.Bool
 
 	readMu  sync.Mutex
 	writeMu sync.Mutex
+
+	// done is closed by the first Close.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// resumed is non-nil while reads are paused and is closed by
+	// ResumeReads. Guarded by pauseMu.
+	pauseMu sync.Mutex
+	resumed chan struct{}
+
+	// Guarded by writeMu; see WithWriteCoalesce.
+	coalesceBuf   batchBuffer
+	coalesceTimer *time.Timer
+	coalesceArmed bool
+
+	// reassemblyDeadline bounds the reassembly in progress, if any. Guarded
+	// by readMu.
+	reassemblyDeadline time.Time
+
+	// emptyFragments counts the consecutive empty continuation frames of the
+	// message being reassembled. Guarded by readMu.
+	emptyFragments int
+
+	// writeCtx is the context of the write in progress, if any. Guarded by
+	// writeMu.
+	writeCtx context.Context
+
+	// stallDeadline is the WithWriteStallTimeout deadline of the write in
+	// progress. Guarded by writeMu.
+	stallDeadline time.Time
+
+	// compressors holds idle *zlib.Writer for WithCompressionDictionary.
+	// SendBatch encodes outside writeMu, hence a pool.
+	compressors sync.Pool
+
+	// decompressor is reused across compressed messages. Guarded by readMu.
+	decompressor io.ReadCloser
 }
 
 func New(nc net.Conn, opts ...Option) *Conn {
+	return newConn(nc, opts...)
+}
+
+func newConn(nc transport, opts ...Option) *Conn {
 	c := &Conn{
-		nc:              nc,
-		maxFramePayload: defaultMaxFramePayload,
+		nc:                nc,
+		maxFramePayload:   defaultMaxFramePayload,
+		maxEmptyFragments: defaultMaxEmptyFragments,
+		done:              make(chan struct{}),
 	}
 	for _, opt := range opts {
 		opt(c)
@@ -45,12 +126,85 @@ func New(nc net.Conn, opts ...Option) *Conn {
 	return c
 }
 
-func (c *Conn) Close() error { return c.nc.Close() }
+func (c *Conn) Close() error {
+	c.closed.Store(true)
+	c.closeOnce.Do(func() { close(c.done) })
+	c.flushCoalescedOnClose()
+	return c.nc.Close()
+}
+
+// closedErr replaces err with ErrConnClosed if Close was called, so callers
+// see a stable error instead of whatever the transport reports.
+func (c *Conn) closedErr(err error) error {
+	if err != nil && c.closed.Load() && !errors.Is(err, ErrWriteStall) && !errors.Is(err, errFrameCutShort) {
+		return ErrConnClosed
+	}
+	return err
+}
+
+// MarkAuthenticated records that the handshake on this connection succeeded,
+// lifting the WithRequireAuthFirst gate. It is exported only so that the auth
+// package can call it once the handshake it ran on this Conn completes; no
+// other code may call it, since doing so admits a peer that never
+// authenticated.
+func (c *Conn) MarkAuthenticated() { c.authenticated.Store(true) }
+
+// checkAuthenticated enforces WithRequireAuthFirst for a received frame of
+// type typ, closing the connection if the frame is not allowed yet.
+func (c *Conn) checkAuthenticated(typ Type) error {
+	if c.requireAuthFirst && !isAuthType(typ) && !c.authenticated.Load() {
+		_ = c.Close()
+		return errors.Join(ErrProtocol, ErrUnauthenticated)
+	}
+	return nil
+}
+
+// RemoteAddr returns the peer's address if the transport reports one, as a
+// net.Conn does, and nil otherwise.
+func (c *Conn) RemoteAddr() net.Addr {
+	if ra, ok := c.nc.(interface{ RemoteAddr() net.Addr }); ok {
+		return ra.RemoteAddr()
+	}
+	return nil
+}
+
+// CloseWrite half-closes the write direction so the peer observes EOF after
+// every frame we already sent, while this side may keep reading. Transports
+// without half-close support (anything lacking a CloseWrite method, such as
+// net.Pipe) are fully closed instead.
+//
+// CloseWrite waits for any in-progress Send to finish so a frame is never cut.
+func (c *Conn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.flushCoalescedLocked(); err != nil {
+		return err
+	}
+	if hc, ok := c.nc.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return c.Close()
+}
 
+// Send writes msg as one logical message, fragmenting it as needed.
+//
+// message_payload Data is written straight from msg.Data without being copied
+// (unless headers or padding are added), so the caller must not modify it
+// until Send returns.
 func (c *Conn) Send(ctx context.Context, msg Message) error {
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	ctx, cancel := withDefaultTimeout(ctx, c.defaultWriteTimeout)
+	defer cancel()
+
+	if c.closed.Load() {
+		return ErrConnClosed
+	}
+	if err := c.validateOutgoing(msg); err != nil {
+		return err
+	}
 
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
@@ -61,86 +215,218 @@ func (c *Conn) Send(ctx context.Context, msg Message) error {
 		restore()
 	}()
 
-	switch msg.Type {
-	case TypePing, TypePong:
-		if msg.StreamID != 0 {
-			return errors.Join(ErrProtocol, ErrInvalidStreamID)
+	if c.coalesces(msg) {
+		return c.closedErr(c.sendCoalesced(msg))
+	}
+	if err := c.flushCoalescedLocked(); err != nil {
+		return c.closedErr(err)
+	}
+	return c.closedErr(c.writeMessage(statsWriter{c}, msg))
+}
+
+// SendBatch sends msgs back to back while holding the write lock once, encoding
+// every frame into a single buffer that is flushed with one write.
+//
+// All messages are validated before anything is written: if any message is
+// invalid, SendBatch returns an error and nothing reaches the wire.
+func (c *Conn) SendBatch(ctx context.Context, msgs []Message) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := withDefaultTimeout(ctx, c.defaultWriteTimeout)
+	defer cancel()
+
+	if c.closed.Load() {
+		return ErrConnClosed
+	}
+	for i, msg := range msgs {
+		if err := c.validateOutgoing(msg); err != nil {
+			return fmt.Errorf("batch message %d: %w", i, err)
 		}
-		if len(msg.Payload) != 0 || len(msg.Data) != 0 {
-			return fmt.Errorf("%w: ping/pong payload must be empty", ErrProtocol)
+	}
+
+	var buf batchBuffer
+	for _, msg := range msgs {
+		if err := c.writeMessage(&buf, msg); err != nil {
+			return err
 		}
-		return encodeFrameTo(c.nc, msg.Type, startEndFlags, 0, nil)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 
-	case TypeAuthBegin, TypeAuthChallenge, TypeAuthProof, TypeAuthOK, TypeAuthError:
-		if msg.StreamID != 0 {
-			return errors.Join(ErrProtocol, ErrInvalidStreamID)
+	restore, stop := c.applyWriteContext(ctx)
+	defer func() {
+		stop()
+		restore()
+	}()
+
+	if err := c.flushCoalescedLocked(); err != nil {
+		return c.closedErr(err)
+	}
+	if _, err := (statsWriter{c}).Write(buf.Bytes()); err != nil {
+		return c.closedErr(err)
+	}
+	c.framesSent.Add(buf.frames)
+	return nil
+}
+
+// validateOutgoing checks msg against the per-type rules without writing.
+func (c *Conn) validateOutgoing(msg Message) error {
+	info, ok := lookupTypeInfo(msg.Type)
+	if !ok {
+		return errors.Join(ErrProtocol, ErrUnknownType)
+	}
+	if !info.validStreamID(msg.StreamID) {
+		return errors.Join(ErrProtocol, ErrInvalidStreamID)
+	}
+	if info.EmptyPayload && (len(msg.Payload) != 0 || len(msg.Data) != 0) {
+		return fmt.Errorf("%w: %s payload must be empty", ErrProtocol, info.Name)
+	}
+	if c.unfragmentedAuth && isAuthType(msg.Type) && len(msg.Payload) > c.maxFramePayload {
+		return errors.Join(ErrProtocol, ErrAuthFragmented)
+	}
+
+	switch msg.Type {
+	case TypeResume:
+		if _, err := ParseResume(msg.Payload); err != nil {
+			return err
 		}
-		return c.sendWithFragmentation(msg.Type, 0, msg.Payload)
+		return nil
 
-	case TypeMessagePayload:
-		if msg.StreamID == 0 {
-			return errors.Join(ErrProtocol, ErrInvalidStreamID)
+	case TypeError:
+		if _, err := ParseError(msg.Payload); err != nil {
+			return err
 		}
-		format := msg.Format
-		if format == 0 {
-			format = PayloadFormatOpaqueBytes
+		return nil
+
+	case TypeReset:
+		if len(msg.Payload) > min(maxResetReasonLen, c.maxFramePayload) {
+			return fmt.Errorf("%w: reset reason of %d bytes too long", ErrProtocol, len(msg.Payload))
 		}
-		if format != PayloadFormatOpaqueBytes {
+		return nil
+
+	case TypeMessagePayload:
+		format := c.outgoingFormat(msg.Format)
+		if !isKnownFormat(format) {
 			return fmt.Errorf("%w: unsupported payload format %d", ErrProtocol, format)
 		}
-		if msg.Kind != PayloadKindRequest && msg.Kind != PayloadKindResponse && msg.Kind != PayloadKindOneway {
+		if !isKnownKind(msg.Kind) {
 			return fmt.Errorf("%w: unsupported payload kind %d", ErrProtocol, msg.Kind)
 		}
-
-		// First fragment carries envelope + first chunk of Data.
-		envelope := []byte{byte(msg.Kind), byte(format), 0x00, 0x00}
-
-		if len(envelope) > c.maxFramePayload {
+		if !c.kindAllowed(msg.Kind) {
+			return errors.Join(ErrProtocol, ErrDisallowedKind)
+		}
+		if format == PayloadFormatHeaders {
+			if _, err := headerBlockLen(msg.Headers); err != nil {
+				return err
+			}
+		} else if len(msg.Headers) > 0 {
+			return fmt.Errorf("%w: %w: headers require PayloadFormatHeaders", ErrProtocol, ErrHeaders)
+		}
+		if envelopeLen+c.padLenFieldLen() > c.maxFramePayload {
 			return fmt.Errorf("%w: maxFramePayload too small for envelope", ErrProtocol)
 		}
+		return nil
 
-		// How much data can we pack into the first frame?
-		firstDataCap := c.maxFramePayload - len(envelope)
-		firstData := msg.Data
-		if len(firstData) > firstDataCap {
-			firstData = firstData[:firstDataCap]
-		}
-		firstPayload := append(envelope, firstData...)
+	default:
+		return nil
+	}
+}
 
-		remaining := msg.Data[len(firstData):]
-		if len(remaining) == 0 {
-			return encodeFrameTo(c.nc, TypeMessagePayload, startEndFlags, msg.StreamID, firstPayload)
-		}
+// kindAllowed reports whether WithAllowedPayloadKinds permits kind.
+func (c *Conn) kindAllowed(kind PayloadKind) bool {
+	return c.allowedKinds == nil || c.allowedKinds[kind]
+}
+
+// outgoingFormat resolves the format sent for a message_payload whose Format
+// is f: zero means the WithDefaultPayloadFormat default, if any.
+func (c *Conn) outgoingFormat(f PayloadFormat) PayloadFormat {
+	if f == 0 {
+		return c.defaultFormat
+	}
+	return f
+}
+
+// writeMessage encodes an already validated msg to w as one or more frames.
+func (c *Conn) writeMessage(w io.Writer, msg Message) error {
+	switch msg.Type {
+	case TypePing, TypePong:
+		return encodeFrameTo(w, msg.Type, startEndFlags, 0, nil)
+	case TypeMessagePayload:
+		return c.writeMessagePayload(w, msg)
+	default:
+		return c.writeWithFragmentation(w, msg.Type, msg.StreamID, msg.Payload)
+	}
+}
 
-		// Fragmented: first START (no END), then middle, then END.
-		if err := encodeFrameTo(c.nc, TypeMessagePayload, flagStart, msg.StreamID, firstPayload); err != nil {
+func (c *Conn) writeMessagePayload(w io.Writer, msg Message) error {
+	format := c.outgoingFormat(msg.Format)
+
+	// First fragment carries envelope + first chunk of Data.
+	var prefixBuf [envelopeLen + padLenLen]byte
+	prefix := Envelope{Kind: msg.Kind, Format: format, RouteHint: msg.RouteHint}.appendTo(prefixBuf[:0])
+	data := msg.Data
+	if format == PayloadFormatHeaders {
+		var err error
+		if data, err = withHeaders(msg.Headers, msg.Data); err != nil {
 			return err
 		}
-		for len(remaining) > 0 {
-			chunk := remaining
-			if len(chunk) > c.maxFramePayload {
-				chunk = chunk[:c.maxFramePayload]
-			}
-			remaining = remaining[len(chunk):]
+	}
+	var padFlag Flags
+	if c.compresses(len(data), c.maxFramePayload-len(prefix)-c.padLenFieldLen()) {
+		if compressed, ok := c.compressData(data); ok {
+			data = compressed
+			padFlag |= flagCompressed
+		}
+	}
+	if len(c.padBuckets) > 0 {
+		unpadded := len(data)
+		data = padData(data, c.padBuckets)
+		prefix = binary.BigEndian.AppendUint32(prefix, uint32(len(data)-unpadded))
+		padFlag |= flagPadded
+	}
 
-			flags := uint16(0)
-			if len(remaining) == 0 {
-				flags = flagEnd
-			}
-			if err := encodeFrameTo(c.nc, TypeMessagePayload, flags, msg.StreamID, chunk); err != nil {
-				return err
-			}
+	// How much data can we pack into the first frame?
+	firstDataCap := c.maxFramePayload - len(prefix)
+	firstData := data
+	if len(firstData) > firstDataCap {
+		firstData = firstData[:firstDataCap]
+	}
+
+	remaining := data[len(firstData):]
+	if len(remaining) == 0 {
+		return encodeEnvelopeFrameTo(w, startEndFlags|padFlag, msg.StreamID, prefix, firstData)
+	}
+
+	// Fragmented: first START (no END), then middle, then END.
+	if err := encodeEnvelopeFrameTo(w, FlagStart|padFlag, msg.StreamID, prefix, firstData); err != nil {
+		return err
+	}
+	for len(remaining) > 0 {
+		chunk := remaining
+		if len(chunk) > c.maxFramePayload {
+			chunk = chunk[:c.maxFramePayload]
 		}
-		return nil
+		remaining = remaining[len(chunk):]
 
-	default:
-		return errors.Join(ErrProtocol, ErrUnknownType)
+		var flags Flags
+		if len(remaining) == 0 {
+			flags = FlagEnd
+		}
+		if err := encodeFrameTo(w, TypeMessagePayload, flags, msg.StreamID, chunk); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func (c *Conn) sendWithFragmentation(typ Type, streamID uint64, payload []byte) error {
+func (c *Conn) writeWithFragmentation(w io.Writer, typ Type, streamID uint64, payload []byte) error {
 	if len(payload) <= c.maxFramePayload {
-		return encodeFrameTo(c.nc, typ, startEndFlags, streamID, payload)
+		return encodeFrameTo(w, typ, startEndFlags, streamID, payload)
 	}
 
 	remaining := payload
@@ -152,26 +438,58 @@ func (c *Conn) sendWithFragmentation(typ Type, streamID uint64, payload []byte)
 		}
 		remaining = remaining[len(chunk):]
 
-		flags := uint16(0)
+		var flags Flags
 		if first {
-			flags |= flagStart
+			flags |= FlagStart
 			first = false
 		}
 		if len(remaining) == 0 {
-			flags |= flagEnd
+			flags |= FlagEnd
 		}
 
-		if err := encodeFrameTo(c.nc, typ, flags, streamID, chunk); err != nil {
+		if err := encodeFrameTo(w, typ, flags, streamID, chunk); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// FrameCount returns the number of frames Send would write for msg under the
+// connection's current settings, including the envelope, headers, padding and
+// compression of a message_payload. It returns 0 if Send would reject msg.
+// FrameCount runs the same encoding as Send against a writer that discards the
+// bytes, so the two cannot disagree; it does not touch the transport.
+func (c *Conn) FrameCount(msg Message) int {
+	if err := c.validateOutgoing(msg); err != nil {
+		return 0
+	}
+	var w frameCountWriter
+	if err := c.writeMessage(&w, msg); err != nil {
+		return 0
+	}
+	return w.frames
+}
+
+// ReadNext reads the next logical message, reassembling fragments.
+//
+// When the peer closes the connection cleanly between two messages, ReadNext
+// returns io.EOF, and keeps returning it on later calls: every message sent
+// before the close, including one whose END frame was the last thing
+// written, has been returned by then. A close in the middle of a message,
+// inside a frame or between fragments, returns io.ErrUnexpectedEOF instead.
 func (c *Conn) ReadNext(ctx context.Context) (Message, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	ctx, cancel := withDefaultTimeout(ctx, c.defaultReadTimeout)
+	defer cancel()
+
+	if c.closed.Load() {
+		return Message{}, ErrConnClosed
+	}
+	if err := c.waitReadable(ctx); err != nil {
+		return Message{}, err
+	}
 
 	c.readMu.Lock()
 	defer c.readMu.Unlock()
@@ -182,151 +500,320 @@ func (c *Conn) ReadNext(ctx context.Context) (Message, error) {
 		restore()
 	}()
 
+	for {
+		msg, err := c.readMessage(ctx)
+		if err != nil || !c.controlTypes[msg.Type] {
+			return msg, err
+		}
+		c.controlHandler(msg)
+	}
+}
+
+// readMessage reads and reassembles the next message for ReadNext. The caller
+// must hold readMu.
+func (c *Conn) readMessage(ctx context.Context) (Message, error) {
 	fr, err := c.readFrame(ctx)
 	if err != nil {
 		return Message{}, err
 	}
 
-	if fr.flags&flagStart == 0 {
-		_ = c.nc.Close()
+	if !fr.flags.IsStart() {
+		_ = c.Close()
 		return Message{}, errors.Join(ErrProtocol, ErrFragmentation)
 	}
 
 	typ := fr.typ
 	streamID := fr.streamID
 
-	// Type-specific base validation.
-	switch typ {
-	case TypePing, TypePong:
-		if streamID != 0 || len(fr.payload) != 0 || fr.flags != startEndFlags {
-			_ = c.nc.Close()
-			return Message{}, fmt.Errorf("%w: ping/pong must have stream_id=0, empty payload, START|END", ErrProtocol)
-		}
-		return Message{Type: typ, StreamID: 0}, nil
-	case TypeAuthBegin, TypeAuthChallenge, TypeAuthProof, TypeAuthOK, TypeAuthError:
-		if streamID != 0 {
-			_ = c.nc.Close()
-			return Message{}, errors.Join(ErrProtocol, ErrInvalidStreamID)
-		}
-	case TypeMessagePayload:
-		if streamID == 0 {
-			_ = c.nc.Close()
-			return Message{}, errors.Join(ErrProtocol, ErrInvalidStreamID)
+	if err := c.checkAuthenticated(typ); err != nil {
+		return Message{}, err
+	}
+
+	// Type-specific base validation. decodeFrameFrom only returns known types.
+	info, _ := lookupTypeInfo(typ)
+	if !info.validStreamID(streamID) {
+		_ = c.Close()
+		return Message{}, errors.Join(ErrProtocol, ErrInvalidStreamID)
+	}
+	if c.unfragmentedAuth && isAuthType(typ) && fr.flags != startEndFlags {
+		// Fail before reassembly so a stalled fragment cannot hold the read.
+		_ = c.Close()
+		return Message{}, errors.Join(ErrProtocol, ErrAuthFragmented)
+	}
+	if !info.Fragmentable && fr.flags != startEndFlags {
+		_ = c.Close()
+		return Message{}, fmt.Errorf("%w: %s must be START|END", ErrProtocol, info.Name)
+	}
+	if info.EmptyPayload {
+		if len(fr.payload) != 0 {
+			_ = c.Close()
+			return Message{}, fmt.Errorf("%w: %s payload must be empty", ErrProtocol, info.Name)
 		}
+		return Message{Type: typ, StreamID: streamID}, nil
 	}
 
-	isDone := fr.flags&flagEnd != 0
+	isDone := fr.flags.IsEnd()
+	c.emptyFragments = 0
+	if !isDone && c.reassemblyTimeout > 0 {
+		c.reassemblyDeadline = time.Now().Add(c.reassemblyTimeout)
+		defer func() { c.reassemblyDeadline = time.Time{} }()
+	}
 
 	if typ == TypeMessagePayload {
-		if len(fr.payload) < 4 {
-			_ = c.nc.Close()
-			return Message{}, errors.Join(ErrProtocol, ErrEnvelope)
+		padded := fr.flags&flagPadded != 0
+		if padded && len(fr.payload) < info.MinPayload+padLenLen {
+			return Message{}, c.envelopeError(ctx, fr, &EnvelopeError{Reason: fmt.Sprintf("payload of %d bytes too short for envelope", len(fr.payload))})
 		}
-		kind := PayloadKind(fr.payload[0])
-		format := PayloadFormat(fr.payload[1])
-		reserved := uint16(fr.payload[2])<<8 | uint16(fr.payload[3])
-		if reserved != 0 {
-			_ = c.nc.Close()
-			return Message{}, errors.Join(ErrProtocol, ErrEnvelope)
+		env, rest, envErr := decodeEnvelope(fr.payload)
+		if envErr != nil {
+			return Message{}, c.envelopeError(ctx, fr, envErr)
 		}
-		if format != PayloadFormatOpaqueBytes {
-			_ = c.nc.Close()
-			return Message{}, errors.Join(ErrProtocol, ErrEnvelope)
+		padLen := 0
+		if padded {
+			padLen = int(binary.BigEndian.Uint32(rest[:padLenLen]))
+			rest = rest[padLenLen:]
 		}
-		if kind != PayloadKindRequest && kind != PayloadKindResponse && kind != PayloadKindOneway {
-			_ = c.nc.Close()
-			return Message{}, errors.Join(ErrProtocol, ErrEnvelope)
+		if !c.kindAllowed(env.Kind) {
+			return Message{}, c.envelopeError(ctx, fr, &EnvelopeError{Reason: fmt.Sprintf("payload kind %d not allowed", env.Kind), Err: ErrDisallowedKind})
 		}
 
 		var data bytes.Buffer
-		if len(fr.payload) > 4 {
-			_, _ = data.Write(fr.payload[4:])
+		if len(rest) > 0 {
+			_, _ = data.Write(rest)
 		}
 
 		for !isDone {
-			next, err := c.readFrame(ctx)
+			next, err := c.readFragment(ctx, typ, streamID)
 			if err != nil {
 				return Message{}, err
 			}
-			if next.typ != typ || next.streamID != streamID {
-				_ = c.nc.Close()
-				return Message{}, errors.Join(ErrProtocol, ErrFragmentation)
-			}
-			if next.flags&flagStart != 0 {
-				_ = c.nc.Close()
-				return Message{}, errors.Join(ErrProtocol, ErrFragmentation)
+			_, _ = data.Write(next.payload)
+			isDone = next.flags.IsEnd()
+		}
+
+		if padLen > data.Len() {
+			// The whole message was read, so there is nothing left to discard.
+			fr.flags |= FlagEnd
+			return Message{}, c.envelopeError(ctx, fr, &EnvelopeError{Reason: fmt.Sprintf("pad length %d exceeds data length %d", padLen, data.Len())})
+		}
+		data.Truncate(data.Len() - padLen)
+
+		body := data.Bytes()
+		if fr.flags&flagCompressed != 0 {
+			var err error
+			if body, err = c.decompressData(body); err != nil {
+				fr.flags |= FlagEnd
+				return Message{}, c.envelopeError(ctx, fr, &EnvelopeError{Reason: err.Error(), Err: err})
 			}
-			if next.flags != 0 && next.flags != flagEnd {
-				_ = c.nc.Close()
-				return Message{}, errors.Join(ErrProtocol, ErrFragmentation)
+		}
+		var headers map[string]string
+		if env.Format == PayloadFormatHeaders {
+			var err error
+			if headers, body, err = splitHeaders(body); err != nil {
+				fr.flags |= FlagEnd
+				return Message{}, c.envelopeError(ctx, fr, &EnvelopeError{Reason: err.Error(), Err: ErrHeaders})
 			}
+		}
 
-			_, _ = data.Write(next.payload)
-			isDone = next.flags&flagEnd != 0
+		if validate := c.validators[env.Format]; validate != nil {
+			if err := validate(body); err != nil {
+				return Message{}, fmt.Errorf("%w: stream %d: %w", ErrPayloadValidation, streamID, err)
+			}
 		}
 
 		return Message{
-			Type:     TypeMessagePayload,
-			StreamID: streamID,
-			Kind:     kind,
-			Format:   format,
-			Data:     data.Bytes(),
+			Type:      TypeMessagePayload,
+			StreamID:  streamID,
+			Kind:      env.Kind,
+			Format:    env.Format,
+			RouteHint: env.RouteHint,
+			Headers:   headers,
+			Data:      body,
 		}, nil
 	}
 
-	// Generic reassembly (concatenate payload fragments).
-	var payload bytes.Buffer
-	if len(fr.payload) > 0 {
-		_, _ = payload.Write(fr.payload)
-	}
-
-	for !isDone {
-		next, err := c.readFrame(ctx)
-		if err != nil {
-			return Message{}, err
+	// Fast path: a single START|END frame needs no reassembly buffer.
+	assembled := fr.payload
+	if !isDone {
+		// Generic reassembly (concatenate payload fragments).
+		var payload bytes.Buffer
+		if len(fr.payload) > 0 {
+			_, _ = payload.Write(fr.payload)
 		}
-		if next.typ != typ || next.streamID != streamID {
-			_ = c.nc.Close()
-			return Message{}, errors.Join(ErrProtocol, ErrFragmentation)
+
+		for !isDone {
+			next, err := c.readFragment(ctx, typ, streamID)
+			if err != nil {
+				return Message{}, err
+			}
+			if len(next.payload) > 0 {
+				_, _ = payload.Write(next.payload)
+			}
+			isDone = next.flags.IsEnd()
 		}
-		if next.flags&flagStart != 0 {
-			_ = c.nc.Close()
-			return Message{}, errors.Join(ErrProtocol, ErrFragmentation)
+		assembled = payload.Bytes()
+	}
+
+	switch typ {
+	case TypeReset:
+		err := parseReset(fr)
+		if errors.Is(err, ErrProtocol) {
+			_ = c.Close()
 		}
-		if next.flags != 0 && next.flags != flagEnd {
-			_ = c.nc.Close()
-			return Message{}, errors.Join(ErrProtocol, ErrFragmentation)
+		return Message{}, err
+	case TypeResume:
+		if _, err := ParseResume(assembled); err != nil {
+			_ = c.Close()
+			return Message{}, err
 		}
-
-		if len(next.payload) > 0 {
-			_, _ = payload.Write(next.payload)
+	case TypeError:
+		// The peer is terminating the connection; surface its reason.
+		remote, err := ParseError(assembled)
+		_ = c.Close()
+		if err != nil {
+			return Message{}, err
 		}
-		isDone = next.flags&flagEnd != 0
+		return Message{}, remote
 	}
 
 	return Message{
 		Type:     typ,
 		StreamID: streamID,
-		Payload:  payload.Bytes(),
+		Payload:  assembled,
 	}, nil
 }
 
+// readFragment reads the next fragment of the typ message streamID whose START
+// was already read, closing the connection if it does not continue that
+// message.
+func (c *Conn) readFragment(ctx context.Context, typ Type, streamID uint64) (frame, error) {
+	next, err := c.readContinuation(ctx)
+	if err != nil {
+		return frame{}, err
+	}
+	if next.typ == TypeReset && next.streamID == streamID {
+		// The sender abandoned the message; the partial data is dropped.
+		err := parseReset(next)
+		if errors.Is(err, ErrProtocol) {
+			_ = c.Close()
+		}
+		return frame{}, err
+	}
+	if next.typ != typ || next.streamID != streamID {
+		_ = c.Close()
+		return frame{}, errors.Join(ErrProtocol, ErrFragmentation)
+	}
+	if next.flags.IsStart() {
+		_ = c.Close()
+		return frame{}, errors.Join(ErrProtocol, ErrFragmentation)
+	}
+	if next.flags != 0 && next.flags != FlagEnd {
+		_ = c.Close()
+		return frame{}, errors.Join(ErrProtocol, ErrFragmentation)
+	}
+	if len(next.payload) > 0 || next.flags.IsEnd() {
+		c.emptyFragments = 0
+	} else if c.emptyFragments++; c.emptyFragments > c.maxEmptyFragments {
+		_ = c.Close()
+		return frame{}, errors.Join(ErrProtocol, ErrEmptyFragmentFlood)
+	}
+	return next, nil
+}
+
+// envelopeError completes e with the START frame fr and applies the envelope
+// error policy: the connection is closed unless WithKeepOpenOnEnvelopeError
+// is set, in which case the rest of the message is discarded so the stream
+// stays aligned on a message boundary.
+func (c *Conn) envelopeError(ctx context.Context, fr frame, e *EnvelopeError) error {
+	e.StreamID = fr.streamID
+	e.Payload = fr.payload
+	if !c.keepOpenOnEnvelope {
+		_ = c.Close()
+		return e
+	}
+	if !fr.flags.IsEnd() {
+		if err := c.drainFragments(ctx, fr.typ, fr.streamID); err != nil {
+			return err
+		}
+	}
+	return e
+}
+
+// readContinuation reads the next fragment of a message whose START was
+// already read. The peer closing here truncates the message, so a clean EOF
+// is reported as io.ErrUnexpectedEOF.
+func (c *Conn) readContinuation(ctx context.Context) (frame, error) {
+	fr, err := c.readFrame(ctx)
+	if errors.Is(err, io.EOF) {
+		return frame{}, io.ErrUnexpectedEOF
+	}
+	return fr, err
+}
+
 func (c *Conn) readFrame(ctx context.Context) (frame, error) {
-	fr, err := decodeFrameFrom(c.nc, c.maxFramePayload)
+	for {
+		fr, err := c.readOneFrame(ctx)
+		if errors.Is(err, errSkippedFrame) {
+			continue
+		}
+		return fr, err
+	}
+}
+
+func (c *Conn) readOneFrame(ctx context.Context) (frame, error) {
+	if c.readIdleTimeout > 0 || !c.reassemblyDeadline.IsZero() {
+		deadline := c.reassemblyDeadline
+		if c.readIdleTimeout > 0 {
+			if d := time.Now().Add(c.readIdleTimeout); deadline.IsZero() || d.Before(deadline) {
+				deadline = d
+			}
+		}
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		_ = c.nc.SetReadDeadline(deadline)
+
+		// Re-arming may have overwritten the deadline set by a cancellation
+		// that raced with us; honor the cancellation explicitly.
+		if err := ctx.Err(); err != nil {
+			return frame{}, err
+		}
+	}
+
+	fr, err := decodeFrameFrom(statsReader{c}, decodeOptions{
+		maxPayload:       c.maxFramePayload,
+		maxPayloadByType: c.maxPayloadByType,
+		skipUnknown:      c.skipUnknown,
+	})
 	if err == nil {
+		c.framesReceived.Add(1)
+		if c.frameObserver != nil {
+			c.frameObserver(FrameInfo{Type: fr.typ, Flags: fr.flags, StreamID: fr.streamID, PayloadLen: int(fr.payloadLn)})
+		}
 		return fr, nil
 	}
 
-	// If context was cancelled, prefer ctx.Err().
+	// If context was cancelled, prefer ctx.Err(). The transport deadline
+	// derived from ctx may fire just before ctx itself reports it.
 	select {
 	case <-ctx.Done():
 		return frame{}, ctx.Err()
 	default:
 	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) && errors.Is(err, os.ErrDeadlineExceeded) {
+		return frame{}, context.DeadlineExceeded
+	}
+	if c.closed.Load() {
+		return frame{}, ErrConnClosed
+	}
+	if !c.reassemblyDeadline.IsZero() && !time.Now().Before(c.reassemblyDeadline) && errors.Is(err, os.ErrDeadlineExceeded) {
+		_ = c.Close()
+		return frame{}, ErrReassemblyTimeout
+	}
 
 	// On protocol errors, close connection best-effort.
 	if isProtocolErr(err) {
-		_ = c.nc.Close()
+		_ = c.Close()
 	}
 	return frame{}, err
 }
@@ -340,26 +827,65 @@ func isProtocolErr(err error) bool {
 		errors.Is(err, ErrInvalidFlags) ||
 		errors.Is(err, ErrFragmentation) ||
 		errors.Is(err, ErrEnvelope) ||
+		errors.Is(err, ErrErrorFrame) ||
 		errors.Is(err, ErrInvalidStreamID))
 }
 
+// withDefaultTimeout bounds ctx by d when ctx has no deadline of its own and
+// d is positive; see WithDefaultReadTimeout and WithDefaultWriteTimeout.
+func withDefaultTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
+}
+
 func (c *Conn) applyReadContext(ctx context.Context) (restore func(), stop func() bool) {
+	c.reading.Store(true)
 	var (
-		restoreDeadline             = func() { _ = c.nc.SetReadDeadline(time.Time{}) }
-		stopAfter       func() bool = func() bool { return true }
+		restoreDeadline = func() {
+			_ = c.nc.SetReadDeadline(time.Time{})
+			c.reading.Store(false)
+		}
+		stopAfter func() bool = func() bool { return true }
 	)
 
 	if d, ok := ctx.Deadline(); ok {
 		_ = c.nc.SetReadDeadline(d)
 	}
-	stopAfter = context.AfterFunc(ctx, func() { _ = c.nc.SetReadDeadline(time.Now()) })
+	if !c.forceCloseOnCancel {
+		stopAfter = context.AfterFunc(ctx, func() { _ = c.nc.SetReadDeadline(time.Now()) })
+		return restoreDeadline, stopAfter
+	}
+
+	// The transport may ignore deadlines: if the read is still blocked shortly
+	// after cancellation, close the connection to force it to return.
+	returned := make(chan struct{})
+	cancelAfter := context.AfterFunc(ctx, func() {
+		_ = c.nc.SetReadDeadline(time.Now())
+		select {
+		case <-returned:
+		case <-time.After(forceCloseGrace):
+			_ = c.Close()
+		}
+	})
+	stopAfter = func() bool {
+		close(returned)
+		return cancelAfter()
+	}
 	return restoreDeadline, stopAfter
 }
 
 func (c *Conn) applyWriteContext(ctx context.Context) (restore func(), stop func() bool) {
+	c.writing.Store(true)
+	c.writeCtx = ctx
 	var (
-		restoreDeadline             = func() { _ = c.nc.SetWriteDeadline(time.Time{}) }
-		stopAfter       func() bool = func() bool { return true }
+		restoreDeadline = func() {
+			_ = c.nc.SetWriteDeadline(time.Time{})
+			c.writeCtx = nil
+			c.writing.Store(false)
+		}
+		stopAfter func() bool = func() bool { return true }
 	)
 
 	if d, ok := ctx.Deadline(); ok {
@@ -368,3 +894,60 @@ func (c *Conn) applyWriteContext(ctx context.Context) (restore func(), stop func
 	stopAfter = context.AfterFunc(ctx, func() { _ = c.nc.SetWriteDeadline(time.Now()) })
 	return restoreDeadline, stopAfter
 }
+
+// armWriteTimeout re-arms the WithWriteTimeout and WithWriteStallTimeout
+// deadline before a write to the transport. The caller must hold writeMu.
+func (c *Conn) armWriteTimeout() error {
+	timeout := c.writeTimeout
+	if s := c.writeStallTimeout; s > 0 && (timeout <= 0 || s < timeout) {
+		timeout = s
+	}
+	if timeout <= 0 {
+		return nil
+	}
+	now := time.Now()
+	deadline := now.Add(timeout)
+	if c.writeStallTimeout > 0 {
+		c.stallDeadline = now.Add(c.writeStallTimeout)
+	}
+	ctx := c.writeCtx
+	if ctx == nil {
+		_ = c.nc.SetWriteDeadline(deadline)
+		return nil
+	}
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = c.nc.SetWriteDeadline(deadline)
+
+	// Re-arming may have overwritten the deadline set by a cancellation that
+	// raced with us; honor the cancellation explicitly.
+	return ctx.Err()
+}
+
+// writeTimedOut checks err, returned by a write of n bytes to the transport,
+// for a WithWriteStallTimeout or WithWriteTimeout deadline having expired.
+//
+// A stall means the peer stopped reading, and the frame is cut short:
+// writeTimedOut closes the connection and returns an error matching
+// ErrWriteStall. A write timeout after part of the frame was written leaves
+// the peer expecting the rest of it, so the connection is closed too and the
+// timeout returned. A write timeout before any byte was written, and timeouts
+// caused by the context, are returned unchanged. The caller must hold writeMu.
+func (c *Conn) writeTimedOut(n int64, err error) error {
+	if err == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	if ctx := c.writeCtx; ctx != nil && ctx.Err() != nil {
+		return err
+	}
+	if c.writeStallTimeout > 0 && !time.Now().Before(c.stallDeadline) {
+		_ = c.Close()
+		return fmt.Errorf("%w: frame write blocked for %s: %w", ErrWriteStall, c.writeStallTimeout, err)
+	}
+	if c.writeTimeout > 0 && n > 0 {
+		_ = c.Close()
+		return fmt.Errorf("%w after %d bytes: %w", errFrameCutShort, n, err)
+	}
+	return err
+}
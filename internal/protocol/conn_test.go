@@ -1,9 +1,19 @@
 package protocol
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"maps"
 	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -166,6 +176,28 @@ func TestUnknownTypeCloses(t *testing.T) {
 	}
 }
 
+func TestSkipUnknownFrames(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	cb := New(b, WithSkipUnknownFrames(true))
+
+	go func() {
+		_ = encodeFrameTo(a, Type(0x99), 0xFFFF, 42, []byte("from the future"))
+		_ = encodeFrameTo(a, Type(0x98), startEndFlags, 0, nil)
+		_ = encodeFrameTo(a, TypePing, startEndFlags, 0, nil)
+	}()
+
+	msg, err := cb.ReadNext(context.Background())
+	if err != nil {
+		t.Fatalf("ReadNext: %v", err)
+	}
+	if msg.Type != TypePing {
+		t.Fatalf("expected ping after skipped frames, got %#v", msg)
+	}
+}
+
 func TestContextCancelUnblocksRead(t *testing.T) {
 	a, b := net.Pipe()
 	defer a.Close()
@@ -188,3 +220,2857 @@ func TestContextCancelUnblocksRead(t *testing.T) {
 		t.Fatalf("ReadNext took too long after cancel")
 	}
 }
+
+func TestReadIdleTimeoutDetectsStalledFragment(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	cb := New(b, WithReadIdleTimeout(50*time.Millisecond))
+
+	go func() {
+		first := append([]byte{byte(PayloadKindOneway), byte(PayloadFormatOpaqueBytes), 0x00, 0x00}, "part1"...)
+		if err := encodeFrameTo(a, TypeMessagePayload, FlagStart, 7, first); err != nil {
+			return
+		}
+		// Stall well past the idle timeout before the final fragment.
+		time.Sleep(500 * time.Millisecond)
+		_ = encodeFrameTo(a, TypeMessagePayload, FlagEnd, 7, []byte("part2"))
+	}()
+
+	start := time.Now()
+	_, err := cb.ReadNext(context.Background())
+	if err == nil {
+		t.Fatalf("expected idle timeout error")
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Fatalf("stalled fragment detected too late: %v", elapsed)
+	}
+}
+
+func TestReadIdleTimeoutAllowsSteadyFragments(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ca := New(a, WithMaxFramePayloadBytes(16))
+	cb := New(b, WithMaxFramePayloadBytes(16), WithReadIdleTimeout(time.Second))
+
+	want := make([]byte, 64)
+	go func() {
+		_ = ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: want})
+	}()
+
+	msg, err := cb.ReadNext(context.Background())
+	if err != nil {
+		t.Fatalf("ReadNext: %v", err)
+	}
+	if len(msg.Data) != len(want) {
+		t.Fatalf("data length: got %d want %d", len(msg.Data), len(want))
+	}
+}
+
+func TestCloseWriteHalfClosesTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		nc, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- nc
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	server, ok := <-accepted
+	if !ok {
+		t.Fatalf("accept failed")
+	}
+	defer server.Close()
+
+	cc := New(client)
+	sc := New(server)
+
+	if err := cc.Send(context.Background(), Message{Type: TypePing}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := cc.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+
+	// The server sees the frame, then a clean EOF.
+	if msg, err := sc.ReadNext(context.Background()); err != nil || msg.Type != TypePing {
+		t.Fatalf("ReadNext: msg=%#v err=%v", msg, err)
+	}
+	if _, err := sc.ReadNext(context.Background()); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF after half-close, got %v", err)
+	}
+
+	// The client can still read.
+	if err := sc.Send(context.Background(), Message{Type: TypePong}); err != nil {
+		t.Fatalf("server Send: %v", err)
+	}
+	if msg, err := cc.ReadNext(context.Background()); err != nil || msg.Type != TypePong {
+		t.Fatalf("client ReadNext after CloseWrite: msg=%#v err=%v", msg, err)
+	}
+}
+
+func TestCloseWriteFallsBackToClose(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	ca := New(a)
+	if err := ca.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	if _, err := ca.ReadNext(context.Background()); err == nil {
+		t.Fatalf("expected read on fully closed pipe to fail")
+	}
+}
+
+// countingConn counts Write calls on the wrapped net.Conn.
+type countingConn struct {
+	net.Conn
+	writes atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+// aliasConn records whether a Write was handed the watched slice itself rather
+// than a copy of it.
+type aliasConn struct {
+	net.Conn
+	watched []byte
+	aliased bool
+}
+
+func (c *aliasConn) Write(p []byte) (int, error) {
+	if len(p) > 0 && &p[0] == &c.watched[0] {
+		c.aliased = true
+	}
+	return c.Conn.Write(p)
+}
+
+func TestSendDoesNotCopyData(t *testing.T) {
+	for _, size := range []int{10, 100} {
+		t.Run(fmt.Sprintf("%d bytes", size), func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+
+			data := bytes.Repeat([]byte{'z'}, size)
+			conn := &aliasConn{Conn: a, watched: data}
+			ca := New(conn, WithMaxFramePayloadBytes(64))
+			cb := New(b)
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: data})
+			}()
+
+			msg, err := cb.ReadNext(context.Background())
+			if err != nil {
+				t.Fatalf("ReadNext: %v", err)
+			}
+			if !bytes.Equal(msg.Data, data) {
+				t.Fatalf("data mismatch")
+			}
+			if err := <-errCh; err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if !conn.aliased {
+				t.Fatalf("Data was copied before being written")
+			}
+		})
+	}
+}
+
+func TestSendBatchRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	counted := &countingConn{Conn: a}
+	ca := New(counted)
+	cb := New(b)
+
+	batch := []Message{
+		{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: []byte("one")},
+		{Type: TypePing},
+		{Type: TypeMessagePayload, StreamID: 2, Kind: PayloadKindOneway, Data: []byte("two")},
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- ca.SendBatch(context.Background(), batch) }()
+
+	for i, want := range batch {
+		msg, err := cb.ReadNext(context.Background())
+		if err != nil {
+			t.Fatalf("ReadNext %d: %v", i, err)
+		}
+		if msg.Type != want.Type || msg.StreamID != want.StreamID || string(msg.Data) != string(want.Data) {
+			t.Fatalf("message %d: got %#v want %#v", i, msg, want)
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("SendBatch: %v", err)
+	}
+	if n := counted.writes.Load(); n != 1 {
+		t.Fatalf("expected a single write, got %d", n)
+	}
+}
+
+func TestSendBatchIsAtomicOnInvalidMessage(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	counted := &countingConn{Conn: a}
+	ca := New(counted)
+
+	err := ca.SendBatch(context.Background(), []Message{
+		{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: []byte("ok")},
+		{Type: TypeMessagePayload, StreamID: 0, Kind: PayloadKindOneway, Data: []byte("bad stream")},
+	})
+	if !errors.Is(err, ErrInvalidStreamID) {
+		t.Fatalf("expected ErrInvalidStreamID, got %v", err)
+	}
+	if n := counted.writes.Load(); n != 0 {
+		t.Fatalf("expected nothing written, got %d writes", n)
+	}
+}
+
+func benchmarkOnewayBurst(b *testing.B, batched bool, opts ...Option) {
+	a, p := net.Pipe()
+	defer a.Close()
+	defer p.Close()
+	go func() { _, _ = io.Copy(io.Discard, p) }()
+
+	counted := &countingConn{Conn: a}
+	c := New(counted, opts...)
+
+	burst := make([]Message, 32)
+	for i := range burst {
+		burst[i] = Message{Type: TypeMessagePayload, StreamID: uint64(i + 1), Kind: PayloadKindOneway, Data: []byte("telemetry sample")}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if batched {
+			if err := c.SendBatch(context.Background(), burst); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		for _, msg := range burst {
+			if err := c.Send(context.Background(), msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(counted.writes.Load())/float64(b.N), "writes/op")
+}
+
+func BenchmarkSendOnewayBurst(b *testing.B)      { benchmarkOnewayBurst(b, false) }
+func BenchmarkSendBatchOnewayBurst(b *testing.B) { benchmarkOnewayBurst(b, true) }
+func BenchmarkSendCoalescedOnewayBurst(b *testing.B) {
+	benchmarkOnewayBurst(b, false, WithWriteCoalesce(100*time.Microsecond))
+}
+
+func TestWriteCoalesce(t *testing.T) {
+	oneway := func(id uint64) Message {
+		return Message{Type: TypeMessagePayload, StreamID: id, Kind: PayloadKindOneway, Data: []byte("sample")}
+	}
+
+	t.Run("flushes after window", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		counted := &countingConn{Conn: a}
+		ca := New(counted, WithWriteCoalesce(20*time.Millisecond))
+		cb := New(b)
+
+		for i := uint64(1); i <= 5; i++ {
+			if err := ca.Send(context.Background(), oneway(i)); err != nil {
+				t.Fatalf("Send %d: %v", i, err)
+			}
+		}
+		for i := uint64(1); i <= 5; i++ {
+			msg, err := cb.ReadNext(context.Background())
+			if err != nil {
+				t.Fatalf("ReadNext: %v", err)
+			}
+			if msg.StreamID != i {
+				t.Fatalf("stream id: got %d want %d", msg.StreamID, i)
+			}
+		}
+		if n := counted.writes.Load(); n != 1 {
+			t.Fatalf("writes: got %d want 1", n)
+		}
+
+		// A ping is written once the flush has released the write lock, so
+		// the coalesced frames are counted by then.
+		go func() { _ = ca.Send(context.Background(), Message{Type: TypePing}) }()
+		if _, err := cb.ReadNext(context.Background()); err != nil {
+			t.Fatalf("ReadNext: %v", err)
+		}
+		if st := ca.Stats(); st.FramesSent < 5 {
+			t.Fatalf("frames sent: got %d want at least 5", st.FramesSent)
+		}
+	})
+
+	t.Run("request flushes and bypasses", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		ca := New(a, WithWriteCoalesce(time.Hour))
+		cb := New(b)
+
+		go func() {
+			_ = ca.Send(context.Background(), oneway(1))
+			_ = ca.Send(context.Background(), oneway(2))
+			_ = ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 3, Kind: PayloadKindRequest, Data: []byte("rpc")})
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		for i := uint64(1); i <= 3; i++ {
+			msg, err := cb.ReadNext(ctx)
+			if err != nil {
+				t.Fatalf("ReadNext: %v", err)
+			}
+			if msg.StreamID != i {
+				t.Fatalf("stream id: got %d want %d", msg.StreamID, i)
+			}
+		}
+	})
+
+	t.Run("close flushes", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer b.Close()
+
+		ca := New(a, WithWriteCoalesce(time.Hour))
+		cb := New(b)
+
+		go func() {
+			_ = ca.Send(context.Background(), oneway(1))
+			_ = ca.Close()
+		}()
+
+		msg, err := cb.ReadNext(context.Background())
+		if err != nil {
+			t.Fatalf("ReadNext: %v", err)
+		}
+		if msg.StreamID != 1 {
+			t.Fatalf("stream id: got %d want 1", msg.StreamID)
+		}
+		if _, err := cb.ReadNext(context.Background()); !errors.Is(err, io.EOF) {
+			t.Fatalf("ReadNext after close: got %v want io.EOF", err)
+		}
+	})
+
+	t.Run("background flush to a peer that never reads", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		ca := New(a, WithWriteCoalesce(10*time.Millisecond))
+		if err := ca.Send(context.Background(), oneway(1)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+
+		// The flush blocks on the pipe while holding the write lock. It must
+		// give up and close the connection instead of holding it forever.
+		done := make(chan error, 1)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			done <- ca.Send(ctx, Message{Type: TypePing})
+		}()
+		select {
+		case err := <-done:
+			if !errors.Is(err, ErrConnClosed) {
+				t.Fatalf("Send: got %v want ErrConnClosed", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Send still blocked behind the background flush")
+		}
+		if !ca.State().Closed {
+			t.Fatal("connection not closed after the background flush timed out")
+		}
+	})
+}
+
+// replayConn is a net.Conn whose reads endlessly repeat the same bytes.
+type replayConn struct {
+	net.Conn
+	data []byte
+	off  int
+}
+
+func (r *replayConn) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+func (r *replayConn) SetReadDeadline(time.Time) error  { return nil }
+func (r *replayConn) SetWriteDeadline(time.Time) error { return nil }
+func (r *replayConn) Close() error                     { return nil }
+
+func BenchmarkReadNextSingleFrameAuth(b *testing.B) {
+	var wire bytes.Buffer
+	if err := encodeFrameTo(&wire, TypeAuthBegin, startEndFlags, 0, []byte(`{"type":"auth_begin","v":1,"agent_id":"abc"}`)); err != nil {
+		b.Fatal(err)
+	}
+	c := New(&replayConn{data: wire.Bytes()})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.ReadNext(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestResumeStreamRoundTrip(t *testing.T) {
+	// With 32-byte frames and a 19-byte prefix, 45 bytes of data fill exactly
+	// two frames, exercising the END lookahead.
+	for _, size := range []int{0, 13, 45, 100} {
+		a, b := net.Pipe()
+
+		ca := New(a, WithMaxFramePayloadBytes(32))
+		cb := New(b, WithMaxFramePayloadBytes(32))
+
+		rest := make([]byte, size)
+		for i := range rest {
+			rest[i] = byte(i)
+		}
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- ca.ResumeStream(context.Background(), "upload-42", 4096, bytes.NewReader(rest))
+		}()
+
+		msg, err := cb.ReadNext(context.Background())
+		if err != nil {
+			t.Fatalf("size %d: ReadNext: %v", size, err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("size %d: ResumeStream: %v", size, err)
+		}
+		if msg.Type != TypeResume || msg.StreamID != 0 {
+			t.Fatalf("size %d: unexpected msg: %#v", size, msg)
+		}
+		res, err := ParseResume(msg.Payload)
+		if err != nil {
+			t.Fatalf("size %d: ParseResume: %v", size, err)
+		}
+		if res.Key != "upload-42" || res.Offset != 4096 || !bytes.Equal(res.Data, rest) {
+			t.Fatalf("size %d: unexpected resume: key=%q offset=%d data=%d bytes", size, res.Key, res.Offset, len(res.Data))
+		}
+
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestResumeRejectsMalformedPayload(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	cb := New(b)
+
+	go func() {
+		// Claims a 5-byte key but carries none.
+		_ = encodeFrameTo(a, TypeResume, startEndFlags, 0, []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 5})
+	}()
+
+	if _, err := cb.ReadNext(context.Background()); !errors.Is(err, ErrResume) {
+		t.Fatalf("expected ErrResume, got %v", err)
+	}
+}
+
+func TestPerTypePayloadLimits(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ca := New(a)
+	cb := New(b, WithMaxPayloadForType(TypeAuthBegin, 64))
+
+	big := make([]byte, 4096)
+	go func() {
+		_ = ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: big})
+		_ = ca.Send(context.Background(), Message{Type: TypeAuthBegin, Payload: make([]byte, 65)})
+	}()
+
+	msg, err := cb.ReadNext(context.Background())
+	if err != nil {
+		t.Fatalf("large message payload should pass: %v", err)
+	}
+	if len(msg.Data) != len(big) {
+		t.Fatalf("data length: got %d want %d", len(msg.Data), len(big))
+	}
+
+	if _, err := cb.ReadNext(context.Background()); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expected oversized auth frame to be rejected, got %v", err)
+	}
+}
+
+// deadlineIgnoringConn wraps a net.Conn whose deadlines are silently ignored.
+type deadlineIgnoringConn struct{ net.Conn }
+
+func (deadlineIgnoringConn) SetReadDeadline(time.Time) error  { return nil }
+func (deadlineIgnoringConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestForceCloseOnCancelUnblocksDeadlineIgnoringConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	cb := New(deadlineIgnoringConn{b}, WithForceCloseOnCancel(true))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := cb.ReadNext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("ReadNext took too long after cancel: %v", elapsed)
+	}
+
+	// The connection was closed to unblock the read.
+	if _, err := b.Write([]byte{0}); err == nil {
+		t.Fatalf("expected underlying conn to be closed")
+	}
+}
+
+func TestRawFramePassThroughPreservesFragments(t *testing.T) {
+	senderSide, proxyIn := net.Pipe()
+	proxyOut, receiverSide := net.Pipe()
+	defer senderSide.Close()
+	defer proxyIn.Close()
+	defer proxyOut.Close()
+	defer receiverSide.Close()
+
+	sender := New(senderSide, WithMaxFramePayloadBytes(16))
+	in := New(proxyIn, WithMaxFramePayloadBytes(16))
+	out := New(proxyOut, WithMaxFramePayloadBytes(16))
+	receiver := New(receiverSide, WithMaxFramePayloadBytes(16))
+
+	want := make([]byte, 40)
+	for i := range want {
+		want[i] = byte(i)
+	}
+	go func() {
+		_ = sender.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 5, Kind: PayloadKindRequest, Data: want})
+	}()
+
+	flagsCh := make(chan []Flags, 1)
+	go func() {
+		var seen []Flags
+		for {
+			f, err := in.ReadRawFrame(context.Background())
+			if err != nil {
+				flagsCh <- seen
+				return
+			}
+			seen = append(seen, f.Flags)
+			if err := out.WriteRawFrame(context.Background(), f); err != nil {
+				flagsCh <- seen
+				return
+			}
+			if f.Flags&FlagEnd != 0 {
+				flagsCh <- seen
+				return
+			}
+		}
+	}()
+
+	msg, err := receiver.ReadNext(context.Background())
+	if err != nil {
+		t.Fatalf("ReadNext: %v", err)
+	}
+	if msg.StreamID != 5 || msg.Kind != PayloadKindRequest || !bytes.Equal(msg.Data, want) {
+		t.Fatalf("unexpected msg: %#v", msg)
+	}
+
+	// 4-byte envelope + 40 bytes of data in 16-byte frames: START, middle, END.
+	seen := <-flagsCh
+	wantFlags := []Flags{FlagStart, 0, FlagEnd}
+	if len(seen) != len(wantFlags) {
+		t.Fatalf("proxy saw flags %v, want %v", seen, wantFlags)
+	}
+	for i := range wantFlags {
+		if seen[i] != wantFlags[i] {
+			t.Fatalf("proxy saw flags %v, want %v", seen, wantFlags)
+		}
+	}
+}
+
+func TestRawFramePassThroughPaddedAndCompressed(t *testing.T) {
+	dict := WithCompressionDictionary(compressionDictionary)
+	for _, tc := range []struct {
+		name      string
+		opts      []Option
+		wantFlags Flags
+	}{
+		{"padding", []Option{WithPadding([]int{512})}, flagPadded},
+		{"compression", []Option{dict}, flagCompressed},
+		{"both", []Option{dict, WithPadding([]int{64})}, flagPadded | flagCompressed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			senderSide, proxyIn := net.Pipe()
+			proxyOut, receiverSide := net.Pipe()
+			defer senderSide.Close()
+			defer proxyIn.Close()
+			defer proxyOut.Close()
+			defer receiverSide.Close()
+
+			sender := New(senderSide, append([]Option{WithMaxFramePayloadBytes(256)}, tc.opts...)...)
+			in, out := New(proxyIn), New(proxyOut)
+			receiver := New(receiverSide, dict)
+
+			want := sampleJSON(3)
+			go func() {
+				_ = sender.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 5, Kind: PayloadKindOneway, Data: want})
+			}()
+
+			proxyErr := make(chan error, 1)
+			go func() {
+				for {
+					f, err := in.ReadRawFrame(context.Background())
+					if err == nil && f.Flags.IsStart() && f.Flags&tc.wantFlags != tc.wantFlags {
+						err = fmt.Errorf("first frame flags %#x lack %#x", f.Flags, tc.wantFlags)
+					}
+					if err == nil {
+						err = out.WriteRawFrame(context.Background(), f)
+					}
+					if err != nil || f.Flags.IsEnd() {
+						proxyErr <- err
+						return
+					}
+				}
+			}()
+
+			msg, err := receiver.ReadNext(context.Background())
+			if err != nil {
+				t.Fatalf("ReadNext: %v", err)
+			}
+			if err := <-proxyErr; err != nil {
+				t.Fatalf("proxy: %v", err)
+			}
+			if !bytes.Equal(msg.Data, want) {
+				t.Fatalf("data: got %d bytes want %d", len(msg.Data), len(want))
+			}
+		})
+	}
+}
+
+func TestWriteRawFrameRejectsReservedFlags(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	for _, f := range []Frame{
+		{Type: TypePing, Flags: startEndFlags | flagPadded},
+		{Type: TypeMessagePayload, StreamID: 1, Flags: FlagEnd | flagCompressed},
+		{Type: TypeMessagePayload, StreamID: 1, Flags: startEndFlags | 0x0010},
+	} {
+		if err := New(a).WriteRawFrame(context.Background(), f); !errors.Is(err, ErrInvalidFlags) {
+			t.Fatalf("flags %#x on %v: expected ErrInvalidFlags, got %v", f.Flags, f.Type, err)
+		}
+	}
+}
+
+// TestRawFramesEmptyEndTerminatesMessage pins that an END frame with an empty
+// payload is a valid terminator, for the generic reassembly path and for
+// message_payload.
+func TestRawFramesEmptyEndTerminatesMessage(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ca, cb := New(a), New(b)
+
+	frames := []Frame{
+		{Type: TypeAuthBegin, Flags: FlagStart, Payload: []byte(`{"type":`)},
+		{Type: TypeAuthBegin, Payload: []byte(`"auth_begin"}`)},
+		{Type: TypeAuthBegin, Flags: FlagEnd},
+		{Type: TypeMessagePayload, Flags: FlagStart, StreamID: 3, Payload: []byte{byte(PayloadKindOneway), 0, 0, 0, 'h', 'i'}},
+		{Type: TypeMessagePayload, Flags: FlagEnd, StreamID: 3},
+	}
+	go func() {
+		for _, f := range frames {
+			if err := ca.WriteRawFrame(context.Background(), f); err != nil {
+				return
+			}
+		}
+	}()
+
+	msg, err := cb.ReadNext(context.Background())
+	if err != nil {
+		t.Fatalf("auth_begin: %v", err)
+	}
+	if msg.Type != TypeAuthBegin || string(msg.Payload) != `{"type":"auth_begin"}` {
+		t.Fatalf("auth_begin: got %+v", msg)
+	}
+	msg, err = cb.ReadNext(context.Background())
+	if err != nil {
+		t.Fatalf("message_payload: %v", err)
+	}
+	if msg.StreamID != 3 || string(msg.Data) != "hi" {
+		t.Fatalf("message_payload: got %+v", msg)
+	}
+}
+
+func TestReaderContinuesAfterRecoverableErrors(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ca := New(a, WithMaxFramePayloadBytes(32))
+	cb := New(b, WithKeepOpenOnEnvelopeError(true), WithPayloadValidator(PayloadFormatJSON, func(p []byte) error {
+		if !json.Valid(p) {
+			return errors.New("invalid JSON")
+		}
+		return nil
+	}))
+
+	go func() {
+		ctx := context.Background()
+		_ = ca.SendStream(ctx, Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway},
+			&failingReader{data: make([]byte, 100), err: errors.New("boom")})
+		_ = ca.Send(ctx, Message{Type: TypeMessagePayload, StreamID: 2, Kind: PayloadKindOneway, Format: PayloadFormatJSON, Data: []byte(`{"a":`)})
+		_ = encodeFrameTo(a, TypeMessagePayload, startEndFlags, 3, []byte{0x7f, 0, 0, 0, 'x'})
+		_ = ca.Send(ctx, Message{Type: TypeMessagePayload, StreamID: 4, Kind: PayloadKindOneway, Data: []byte("ok")})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msgs, errs := cb.Reader(ctx)
+
+	var ee *EnvelopeError
+	for _, want := range []func(error) bool{
+		func(err error) bool { return errors.Is(err, ErrStreamReset) },
+		func(err error) bool { return errors.Is(err, ErrPayloadValidation) },
+		func(err error) bool { return errors.As(err, &ee) },
+	} {
+		if err := <-errs; !want(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if msg := <-msgs; msg.StreamID != 4 || string(msg.Data) != "ok" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	// An error that ends the connection still ends the loop.
+	_ = a.Close()
+	if err := <-errs; err == nil || readErrRecoverable(cb, err) {
+		t.Fatalf("terminating error: got %v", err)
+	}
+	if _, ok := <-msgs; ok {
+		t.Fatalf("message channel not closed")
+	}
+}
+
+func TestPayloadValidatorRejectsInvalidJSON(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	validJSON := func(p []byte) error {
+		if !json.Valid(p) {
+			return errors.New("invalid JSON")
+		}
+		return nil
+	}
+	ca := New(a, WithMaxFramePayloadBytes(8))
+	cb := New(b, WithPayloadValidator(PayloadFormatJSON, validJSON))
+
+	go func() {
+		msgs := []Message{
+			{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Format: PayloadFormatJSON, Data: []byte(`{"a":[1,2`)},
+			{Type: TypeMessagePayload, StreamID: 2, Kind: PayloadKindOneway, Format: PayloadFormatOpaqueBytes, Data: []byte(`{"a":`)},
+			{Type: TypeMessagePayload, StreamID: 3, Kind: PayloadKindOneway, Format: PayloadFormatJSON, Data: []byte(`{"a":[1,2,3]}`)},
+		}
+		for _, msg := range msgs {
+			_ = ca.Send(context.Background(), msg)
+		}
+	}()
+
+	// Invalid JSON is rejected after reassembly, without closing the conn.
+	if _, err := cb.ReadNext(context.Background()); !errors.Is(err, ErrPayloadValidation) || errors.Is(err, ErrProtocol) {
+		t.Fatalf("ReadNext: got %v want ErrPayloadValidation", err)
+	}
+	// Other formats are not validated.
+	if msg, err := cb.ReadNext(context.Background()); err != nil || msg.StreamID != 2 {
+		t.Fatalf("ReadNext opaque: msg=%+v err=%v", msg, err)
+	}
+	msg, err := cb.ReadNext(context.Background())
+	if err != nil {
+		t.Fatalf("ReadNext valid JSON: %v", err)
+	}
+	if msg.StreamID != 3 || msg.Format != PayloadFormatJSON || string(msg.Data) != `{"a":[1,2,3]}` {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+}
+
+func TestRequireAuthFirst(t *testing.T) {
+	payload := Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: []byte("x")}
+
+	t.Run("rejects payload before auth", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		ca := New(a)
+		cb := New(b, WithRequireAuthFirst(true))
+
+		go func() { _ = ca.Send(context.Background(), payload) }()
+
+		if _, err := cb.ReadNext(context.Background()); !errors.Is(err, ErrUnauthenticated) {
+			t.Fatalf("ReadNext: got %v want ErrUnauthenticated", err)
+		}
+		// The connection is closed after the violation.
+		if _, err := b.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("expected closed connection")
+		}
+	})
+
+	t.Run("accepts payload after MarkAuthenticated", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		ca := New(a)
+		cb := New(b, WithRequireAuthFirst(true))
+
+		go func() {
+			_ = ca.Send(context.Background(), Message{Type: TypeAuthBegin, Payload: []byte("{}")})
+			_ = ca.Send(context.Background(), payload)
+		}()
+
+		if msg, err := cb.ReadNext(context.Background()); err != nil || msg.Type != TypeAuthBegin {
+			t.Fatalf("ReadNext auth: msg=%+v err=%v", msg, err)
+		}
+		cb.MarkAuthenticated()
+		if msg, err := cb.ReadNext(context.Background()); err != nil || msg.StreamID != 1 {
+			t.Fatalf("ReadNext payload: msg=%+v err=%v", msg, err)
+		}
+	})
+
+	t.Run("raw reads are gated too", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		ca := New(a)
+		cb := New(b, WithRequireAuthFirst(true))
+
+		go func() {
+			_ = ca.Send(context.Background(), Message{Type: TypeAuthBegin, Payload: []byte("{}")})
+			_ = ca.Send(context.Background(), payload)
+		}()
+
+		if f, err := cb.ReadRawFrame(context.Background()); err != nil || f.Type != TypeAuthBegin {
+			t.Fatalf("ReadRawFrame auth: frame=%+v err=%v", f, err)
+		}
+		if _, err := cb.ReadRawFrame(context.Background()); !errors.Is(err, ErrUnauthenticated) {
+			t.Fatalf("ReadRawFrame: got %v want ErrUnauthenticated", err)
+		}
+		if !cb.State().Closed {
+			t.Fatal("connection left open after an unauthenticated raw frame")
+		}
+	})
+
+	t.Run("drain is gated", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		cb := New(b, WithRequireAuthFirst(true))
+		last := Frame{Type: TypeMessagePayload, Flags: FlagStart, StreamID: 1}
+		if err := cb.DrainMessage(context.Background(), last); !errors.Is(err, ErrUnauthenticated) {
+			t.Fatalf("DrainMessage: got %v want ErrUnauthenticated", err)
+		}
+	})
+}
+
+func TestKnownTypesCoverEveryKnownType(t *testing.T) {
+	infos := KnownTypes()
+	seen := make(map[Type]bool, len(infos))
+	for _, info := range infos {
+		if !isKnownType(info.Type) {
+			t.Errorf("TypeInfo for unknown type 0x%02x", info.Type)
+		}
+		if seen[info.Type] {
+			t.Errorf("duplicate TypeInfo for type 0x%02x", info.Type)
+		}
+		if info.Name == "" {
+			t.Errorf("type 0x%02x has no name", info.Type)
+		}
+		seen[info.Type] = true
+	}
+	declared := []Type{
+		TypeAuthBegin, TypeAuthChallenge, TypeAuthProof, TypeAuthOK, TypeAuthError,
+		TypeMessagePayload, TypeReset, TypeResume, TypeError, TypePing, TypePong,
+	}
+	for _, typ := range declared {
+		if !isKnownType(typ) || !seen[typ] {
+			t.Errorf("declared type 0x%02x has no TypeInfo", typ)
+		}
+	}
+	if len(infos) != len(declared) {
+		t.Errorf("got %d TypeInfos for %d declared types", len(infos), len(declared))
+	}
+
+	// The returned slice is a copy.
+	infos[0].Name = "mutated"
+	if KnownTypes()[0].Name == "mutated" {
+		t.Fatalf("KnownTypes exposes internal table")
+	}
+}
+
+func TestReaderFiltersKeepalives(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ca := New(a)
+	cb := New(b, WithAutoPong(true))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs, errs := cb.Reader(ctx)
+
+	if _, again := cb.Reader(ctx); !errors.Is(<-again, ErrReaderActive) {
+		t.Fatalf("second Reader: want ErrReaderActive")
+	}
+
+	go func() {
+		_ = ca.Send(context.Background(), Message{Type: TypePong})
+		_ = ca.Send(context.Background(), Message{Type: TypePing})
+	}()
+	// The ping is answered automatically and never delivered.
+	if msg, err := ca.ReadNext(context.Background()); err != nil || msg.Type != TypePong {
+		t.Fatalf("expected pong: msg=%+v err=%v", msg, err)
+	}
+
+	go func() {
+		_ = ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 7, Kind: PayloadKindOneway, Data: []byte("x")})
+	}()
+	if msg := <-msgs; msg.Type != TypeMessagePayload || msg.StreamID != 7 {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("error: got %v want context.Canceled", err)
+	}
+	if _, ok := <-msgs; ok {
+		t.Fatalf("message channel not closed")
+	}
+}
+
+func TestRouteHintRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ca := New(a, WithMaxFramePayloadBytes(8))
+	cb := New(b)
+
+	go func() {
+		_ = ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindRequest, RouteHint: 0xBEEF, Data: []byte("fragmented data")})
+		_ = ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 2, Kind: PayloadKindRequest, Data: []byte("x")})
+	}()
+
+	for _, want := range []uint16{0xBEEF, 0} {
+		msg, err := cb.ReadNext(context.Background())
+		if err != nil {
+			t.Fatalf("ReadNext: %v", err)
+		}
+		if msg.RouteHint != want {
+			t.Fatalf("stream %d: route hint got %#x want %#x", msg.StreamID, msg.RouteHint, want)
+		}
+	}
+}
+
+func TestDefaultPayloadFormat(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ca := New(a, WithDefaultPayloadFormat(PayloadFormatJSON))
+	cb := New(b, WithDefaultPayloadFormat(PayloadFormat(0x7F)))
+
+	go func() {
+		_ = ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: []byte(`{}`)})
+		_ = cb.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 2, Kind: PayloadKindOneway, Data: []byte("x")})
+	}()
+
+	msg, err := cb.ReadNext(context.Background())
+	if err != nil {
+		t.Fatalf("ReadNext: %v", err)
+	}
+	if msg.Format != PayloadFormatJSON {
+		t.Fatalf("format got %d want %d", msg.Format, PayloadFormatJSON)
+	}
+
+	// The unknown default was ignored, so cb still sends opaque bytes.
+	msg, err = ca.ReadNext(context.Background())
+	if err != nil {
+		t.Fatalf("ReadNext: %v", err)
+	}
+	if msg.Format != PayloadFormatOpaqueBytes {
+		t.Fatalf("format got %d want %d", msg.Format, PayloadFormatOpaqueBytes)
+	}
+}
+
+func TestReadNextEOFAtMessageBoundary(t *testing.T) {
+	t.Run("close after END", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer b.Close()
+
+		ca := New(a, WithMaxFramePayloadBytes(8))
+		cb := New(b)
+
+		go func() {
+			_ = ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: []byte("last message")})
+			_ = ca.Close()
+		}()
+
+		msg, err := cb.ReadNext(context.Background())
+		if err != nil {
+			t.Fatalf("ReadNext: %v", err)
+		}
+		if string(msg.Data) != "last message" {
+			t.Fatalf("data: got %q", msg.Data)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := cb.ReadNext(context.Background()); err != io.EOF {
+				t.Fatalf("ReadNext %d after close: got %v want io.EOF", i, err)
+			}
+		}
+	})
+
+	t.Run("close between fragments", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer b.Close()
+
+		ca := New(a)
+		cb := New(b)
+
+		go func() {
+			_ = ca.WriteRawFrame(context.Background(), Frame{Type: TypeMessagePayload, Flags: FlagStart, StreamID: 1, Payload: []byte{byte(PayloadKindOneway), 0, 0, 0, 'x'}})
+			_ = ca.Close()
+		}()
+
+		if _, err := cb.ReadNext(context.Background()); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("ReadNext: got %v want io.ErrUnexpectedEOF", err)
+		}
+	})
+}
+
+// sampleJSON returns a telemetry record of the kind agents send, about 1 KiB.
+func sampleJSON(i int) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, `{"agent_id":"agent-%04d","timestamp_ms":%d,"status":"healthy","metrics":[`, i%97, 1700000000000+int64(i)*1000)
+	for j := 0; j < 12; j++ {
+		if j > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `{"name":"cpu.core%d.utilization","unit":"percent","value":%d.%d}`, j, (i*7+j*13)%100, (i+j)%10)
+	}
+	b.WriteString(`],"labels":{"region":"eu-west-1","environment":"production","service":"switchboard-agent"}}`)
+	return []byte(b.String())
+}
+
+// compressionDictionary is a preset dictionary built from sample traffic.
+var compressionDictionary = []byte(`{"agent_id":"agent-","timestamp_ms":,"status":"healthy","metrics":[{"name":"cpu.core` +
+	`.utilization","unit":"percent","value":},],"labels":{"region":"eu-west-1","environment":"production","service":"switchboard-agent"}}`)
+
+func TestCompressionDictionary(t *testing.T) {
+	// roundTrip sends msg from a Conn with sendOpts to one with recvOpts and
+	// returns the first frame on the wire and what ReadNext returned.
+	roundTrip := func(t *testing.T, msg Message, sendOpts, recvOpts []Option) (Frame, Message, error) {
+		t.Helper()
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		var first Frame
+		observed := false
+		observe := WithFrameObserver(func(fi FrameInfo) {
+			if !observed {
+				first, observed = Frame{Type: fi.Type, Flags: fi.Flags, StreamID: fi.StreamID}, true
+			}
+		})
+		ca := New(a, append([]Option{WithMaxFramePayloadBytes(256)}, sendOpts...)...)
+		cb := New(b, append([]Option{observe}, recvOpts...)...)
+
+		go func() { _ = ca.Send(context.Background(), msg) }()
+		got, err := cb.ReadNext(context.Background())
+		return first, got, err
+	}
+	dict := WithCompressionDictionary(compressionDictionary)
+	large := Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Format: PayloadFormatJSON, Data: sampleJSON(1)}
+
+	t.Run("large message", func(t *testing.T) {
+		first, got, err := roundTrip(t, large, []Option{dict}, []Option{dict})
+		if err != nil {
+			t.Fatalf("ReadNext: %v", err)
+		}
+		if first.Flags&flagCompressed == 0 {
+			t.Fatalf("flags: got %#x want compressed", first.Flags)
+		}
+		if !bytes.Equal(got.Data, large.Data) || got.Format != PayloadFormatJSON {
+			t.Fatalf("got %+v", got)
+		}
+	})
+
+	t.Run("small message is sent as is", func(t *testing.T) {
+		small := Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: []byte(`{"status":"healthy"}`)}
+		first, got, err := roundTrip(t, small, []Option{dict}, []Option{dict})
+		if err != nil || !bytes.Equal(got.Data, small.Data) {
+			t.Fatalf("ReadNext: %+v, %v", got, err)
+		}
+		if first.Flags != startEndFlags {
+			t.Fatalf("flags: got %#x want START|END", first.Flags)
+		}
+	})
+
+	t.Run("with headers and padding", func(t *testing.T) {
+		msg := large
+		msg.Format = PayloadFormatHeaders
+		msg.Headers = map[string]string{"content-type": "application/json"}
+		opts := []Option{dict, WithPadding([]int{128})}
+		first, got, err := roundTrip(t, msg, opts, []Option{dict})
+		if err != nil {
+			t.Fatalf("ReadNext: %v", err)
+		}
+		if first.Flags&(flagCompressed|flagPadded) != flagCompressed|flagPadded {
+			t.Fatalf("flags: got %#x want compressed and padded", first.Flags)
+		}
+		if !bytes.Equal(got.Data, msg.Data) || got.Headers["content-type"] != "application/json" {
+			t.Fatalf("got %+v", got)
+		}
+	})
+
+	t.Run("without dictionary", func(t *testing.T) {
+		nodict := WithCompressionDictionary(nil)
+		if _, got, err := roundTrip(t, large, []Option{nodict}, nil); err != nil || !bytes.Equal(got.Data, large.Data) {
+			t.Fatalf("ReadNext: %+v, %v", got, err)
+		}
+	})
+
+	t.Run("dictionary mismatch", func(t *testing.T) {
+		other := WithCompressionDictionary([]byte(`{"something":"else entirely"}`))
+		for name, recvOpts := range map[string][]Option{"other dictionary": {other}, "no dictionary": nil} {
+			t.Run(name, func(t *testing.T) {
+				_, _, err := roundTrip(t, large, []Option{dict}, recvOpts)
+				if !errors.Is(err, ErrCompressionDictionary) || !errors.Is(err, ErrCompression) || !errors.Is(err, ErrEnvelope) {
+					t.Fatalf("ReadNext: got %v want ErrCompressionDictionary", err)
+				}
+			})
+		}
+	})
+
+	t.Run("corrupt data", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		payload := append([]byte{byte(PayloadKindOneway), 0, 0, 0}, "not zlib"...)
+		go func() { _ = encodeFrameTo(a, TypeMessagePayload, startEndFlags|flagCompressed, 1, payload) }()
+
+		_, err := New(b).ReadNext(context.Background())
+		if !errors.Is(err, ErrCompression) || errors.Is(err, ErrCompressionDictionary) {
+			t.Fatalf("ReadNext: got %v want ErrCompression", err)
+		}
+	})
+}
+
+// BenchmarkSendCompressedJSON sends about 1 KiB JSON records, fragmented at
+// 256 bytes, and reports the bytes each one takes on the wire.
+func BenchmarkSendCompressedJSON(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"uncompressed", nil},
+		{"no dictionary", []Option{WithCompressionDictionary(nil)}},
+		{"dictionary", []Option{WithCompressionDictionary(compressionDictionary)}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			a, p := net.Pipe()
+			defer a.Close()
+			defer p.Close()
+			go func() { _, _ = io.Copy(io.Discard, p) }()
+
+			c := New(a, append([]Option{WithMaxFramePayloadBytes(256)}, bc.opts...)...)
+			msgs := make([]Message, 64)
+			for i := range msgs {
+				msgs[i] = Message{Type: TypeMessagePayload, StreamID: uint64(i + 1), Kind: PayloadKindOneway, Format: PayloadFormatJSON, Data: sampleJSON(i)}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.Send(context.Background(), msgs[i%len(msgs)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(c.Stats().BytesSent)/float64(b.N), "wire-bytes/op")
+		})
+	}
+}
+
+func TestPadding(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		for _, size := range []int{0, 10, 64, 65, 300} {
+			t.Run(fmt.Sprintf("%d bytes", size), func(t *testing.T) {
+				a, b := net.Pipe()
+				defer a.Close()
+				defer b.Close()
+
+				ca := New(a, WithPadding([]int{256, 64}), WithMaxFramePayloadBytes(100))
+				cb := New(b)
+
+				data := bytes.Repeat([]byte{'p'}, size)
+				go func() {
+					_ = ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: data})
+				}()
+
+				msg, err := cb.ReadNext(context.Background())
+				if err != nil {
+					t.Fatalf("ReadNext: %v", err)
+				}
+				if !bytes.Equal(msg.Data, data) {
+					t.Fatalf("data: got %d bytes want %d", len(msg.Data), size)
+				}
+			})
+		}
+	})
+
+	t.Run("wire size", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		ca := New(a, WithPadding([]int{64, 256}))
+		cb := New(b)
+
+		go func() {
+			_ = ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: []byte("short")})
+		}()
+
+		fr, err := cb.ReadRawFrame(context.Background())
+		if err != nil {
+			t.Fatalf("ReadRawFrame: %v", err)
+		}
+		if fr.Flags != startEndFlags|flagPadded {
+			t.Fatalf("flags: got %#x", fr.Flags)
+		}
+		if want := envelopeLen + padLenLen + 64; len(fr.Payload) != want {
+			t.Fatalf("payload length: got %d want %d", len(fr.Payload), want)
+		}
+	})
+
+	t.Run("pad length beyond data", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		payload := []byte{byte(PayloadKindOneway), 0, 0, 0, 0, 0, 0, 9, 'x'}
+		go func() { _ = encodeFrameTo(a, TypeMessagePayload, startEndFlags|flagPadded, 1, payload) }()
+
+		_, err := New(b).ReadNext(context.Background())
+		if !errors.Is(err, ErrEnvelope) || !errors.Is(err, ErrProtocol) {
+			t.Fatalf("ReadNext: got %v want ErrEnvelope", err)
+		}
+	})
+
+	t.Run("padded flag only on START of message_payload", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		go func() { _ = encodeFrameTo(a, TypeAuthBegin, startEndFlags|flagPadded, 0, []byte("{}")) }()
+
+		_, err := New(b).ReadNext(context.Background())
+		if !errors.Is(err, ErrInvalidFlags) {
+			t.Fatalf("ReadNext: got %v want ErrInvalidFlags", err)
+		}
+	})
+}
+
+func TestReassemblyTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// Each fragment arrives well within the idle timeout, but the message as
+	// a whole takes far longer than the reassembly bound.
+	go func() {
+		if err := encodeFrameTo(a, TypeMessagePayload, FlagStart, 1, []byte{byte(PayloadKindOneway), 0, 0, 0, 'a'}); err != nil {
+			return
+		}
+		for i := 0; i < 50; i++ {
+			time.Sleep(20 * time.Millisecond)
+			if err := encodeFrameTo(a, TypeMessagePayload, 0, 1, []byte("drip")); err != nil {
+				return
+			}
+		}
+		_ = encodeFrameTo(a, TypeMessagePayload, FlagEnd, 1, nil)
+	}()
+
+	cb := New(b, WithReadIdleTimeout(time.Second), WithReassemblyTimeout(100*time.Millisecond))
+	start := time.Now()
+	_, err := cb.ReadNext(context.Background())
+	if !errors.Is(err, ErrReassemblyTimeout) {
+		t.Fatalf("ReadNext: got %v want ErrReassemblyTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("ReadNext took %s", elapsed)
+	}
+	if !cb.State().Closed {
+		t.Fatalf("connection not closed")
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ca := New(a, WithWriteTimeout(50*time.Millisecond), WithMaxFramePayloadBytes(8))
+	cb := New(b)
+
+	// The peer reads the first frame of a fragmented message, then stalls.
+	go func() { _, _ = cb.ReadRawFrame(context.Background()) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	start := time.Now()
+	err := ca.Send(ctx, Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: []byte("a message in several frames")})
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Send: got %v want os.ErrDeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Send took %s", elapsed)
+	}
+	// The timeout hit between frames, so the connection is still usable.
+	if ca.State().Closed {
+		t.Fatal("connection closed after a timeout at a frame boundary")
+	}
+}
+
+func TestWriteTimeoutMidFrame(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ca := New(a, WithWriteTimeout(50*time.Millisecond))
+
+	// The peer reads the first bytes of the frame, then stalls.
+	go func() { _, _ = io.ReadFull(b, make([]byte, 5)) }()
+
+	err := ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: []byte("cut short")})
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Send: got %v want os.ErrDeadlineExceeded", err)
+	}
+	if st := ca.Stats(); st.BytesSent != 5 {
+		t.Fatalf("bytes sent: got %d want 5", st.BytesSent)
+	}
+	if !ca.State().Closed {
+		t.Fatal("connection left open with a truncated frame on the wire")
+	}
+	if err := ca.Send(context.Background(), Message{Type: TypePing}); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("Send after truncated frame: got %v want ErrConnClosed", err)
+	}
+}
+
+func TestWriteStallTimeout(t *testing.T) {
+	msg := Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: []byte("a message in several frames")}
+
+	t.Run("peer stops reading", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		ca := New(a, WithWriteStallTimeout(50*time.Millisecond), WithMaxFramePayloadBytes(8))
+		cb := New(b)
+
+		// The peer reads the first frame of a fragmented message, then stalls.
+		go func() { _, _ = cb.ReadRawFrame(context.Background()) }()
+
+		start := time.Now()
+		err := ca.Send(context.Background(), msg)
+		if !errors.Is(err, ErrWriteStall) {
+			t.Fatalf("Send: got %v want ErrWriteStall", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("Send took %s", elapsed)
+		}
+		if !ca.State().Closed {
+			t.Fatal("connection left open after a write stall")
+		}
+		if err := ca.Send(context.Background(), Message{Type: TypePing}); !errors.Is(err, ErrConnClosed) {
+			t.Fatalf("Send after stall: got %v want ErrConnClosed", err)
+		}
+	})
+
+	t.Run("context deadline is not a stall", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		ca := New(a, WithWriteStallTimeout(time.Hour), WithMaxFramePayloadBytes(8))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := ca.Send(ctx, msg)
+		if err == nil || errors.Is(err, ErrWriteStall) {
+			t.Fatalf("Send: got %v want a deadline error", err)
+		}
+	})
+
+	t.Run("slow reader is not a stall", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		ca := New(a, WithWriteStallTimeout(200*time.Millisecond), WithMaxFramePayloadBytes(8))
+		cb := New(b)
+
+		// Every frame is read well within the stall timeout, but the whole
+		// message takes longer than it.
+		go func() {
+			for {
+				f, err := cb.ReadRawFrame(context.Background())
+				if err != nil || f.Flags.IsEnd() {
+					return
+				}
+				time.Sleep(80 * time.Millisecond)
+			}
+		}()
+		if err := ca.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	})
+}
+
+func TestReadAndSendAfterClose(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	c := New(a)
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if _, err := c.ReadNext(context.Background()); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("ReadNext: got %v want ErrConnClosed", err)
+	}
+	err := c.Send(context.Background(), Message{Type: TypePing})
+	if !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("Send: got %v want ErrConnClosed", err)
+	}
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Send: %v does not match net.ErrClosed", err)
+	}
+	if err := c.SendBatch(context.Background(), []Message{{Type: TypePing}}); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("SendBatch: got %v want ErrConnClosed", err)
+	}
+}
+
+func TestCloseInterruptsBlockedRead(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	c := New(a)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.ReadNext(context.Background())
+		errCh <- err
+	}()
+
+	for !c.Stats().ReadInProgress {
+		time.Sleep(time.Millisecond)
+	}
+	_ = c.Close()
+
+	if err := <-errCh; !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("ReadNext: got %v want ErrConnClosed", err)
+	}
+}
+
+func TestCloseWithErrorSurfacesRemoteError(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ca := New(a)
+	cb := New(b)
+
+	go func() { _ = ca.CloseWithError(context.Background(), "policy_violation", "too many streams") }()
+
+	_, err := cb.ReadNext(context.Background())
+	var remote *RemoteError
+	if !errors.As(err, &remote) {
+		t.Fatalf("ReadNext: got %v want *RemoteError", err)
+	}
+	if remote.Code != "policy_violation" || remote.Message != "too many streams" {
+		t.Fatalf("unexpected remote error: %+v", remote)
+	}
+}
+
+func TestErrorFrameValidation(t *testing.T) {
+	c := New(nil)
+	if err := c.validateOutgoing(Message{Type: TypeError, Payload: []byte{5, 'x'}}); !errors.Is(err, ErrErrorFrame) {
+		t.Fatalf("truncated code: got %v want ErrErrorFrame", err)
+	}
+	if err := c.validateOutgoing(Message{Type: TypeError, StreamID: 1, Payload: []byte{1, 'x'}}); !errors.Is(err, ErrInvalidStreamID) {
+		t.Fatalf("non-zero stream: got %v want ErrInvalidStreamID", err)
+	}
+	if _, err := EncodeError("", "msg"); err == nil {
+		t.Fatalf("expected error for empty code")
+	}
+}
+
+// TestReassemblyFlagCrossProduct drives ReadNext with every flag combination
+// on the first and the continuation frame, for message_payload and a generic
+// type, and asserts exactly which sequences reassemble.
+func TestReassemblyFlagCrossProduct(t *testing.T) {
+	const reservedFlag Flags = 0x0004
+	allFlags := []Flags{0, FlagStart, FlagEnd, startEndFlags, reservedFlag}
+
+	flagName := func(f Flags) string {
+		switch f {
+		case 0:
+			return "none"
+		case FlagStart:
+			return "START"
+		case FlagEnd:
+			return "END"
+		case startEndFlags:
+			return "START|END"
+		default:
+			return "reserved"
+		}
+	}
+
+	for _, typ := range []Type{TypeMessagePayload, TypeAuthBegin} {
+		streamID := uint64(0)
+		var head []byte
+		if typ == TypeMessagePayload {
+			streamID = 9
+			head = []byte{byte(PayloadKindOneway), byte(PayloadFormatOpaqueBytes), 0, 0}
+		}
+
+		for _, first := range allFlags {
+			for _, cont := range allFlags {
+				for _, emptyCont := range []bool{false, true} {
+					info, _ := lookupTypeInfo(typ)
+					name := fmt.Sprintf("%s/first=%s/cont=%s/empty=%v", info.Name, flagName(first), flagName(cont), emptyCont)
+					t.Run(name, func(t *testing.T) {
+						contPayload := []byte("cd")
+						if emptyCont {
+							contPayload = nil
+						}
+
+						// Frames: first, continuation and, when the
+						// continuation leaves the message open, a final END.
+						type rawFrame struct {
+							flags   Flags
+							payload []byte
+						}
+						frames := []rawFrame{{first, append(append([]byte(nil), head...), "ab"...)}}
+						if first != startEndFlags {
+							frames = append(frames, rawFrame{cont, contPayload})
+							if cont == 0 {
+								frames = append(frames, rawFrame{FlagEnd, []byte("ef")})
+							}
+						}
+
+						var want string
+						var wantErr error
+						switch {
+						case first == reservedFlag || (first == FlagStart && cont == reservedFlag):
+							wantErr = ErrInvalidFlags
+						case first&FlagStart == 0:
+							wantErr = ErrFragmentation
+						case first == startEndFlags:
+							want = "ab"
+						case cont&FlagStart != 0:
+							wantErr = ErrFragmentation
+						case cont == FlagEnd:
+							want = "ab" + string(contPayload)
+						default: // cont == 0
+							want = "ab" + string(contPayload) + "ef"
+						}
+
+						a, b := net.Pipe()
+						defer a.Close()
+						defer b.Close()
+
+						go func() {
+							for _, fr := range frames {
+								if err := encodeFrameTo(a, typ, fr.flags, streamID, fr.payload); err != nil {
+									return
+								}
+							}
+						}()
+
+						ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+						defer cancel()
+						msg, err := New(b).ReadNext(ctx)
+						if wantErr != nil {
+							if !errors.Is(err, wantErr) || !errors.Is(err, ErrProtocol) {
+								t.Fatalf("ReadNext: got %v want %v", err, wantErr)
+							}
+							return
+						}
+						if err != nil {
+							t.Fatalf("ReadNext: %v", err)
+						}
+						got := string(msg.Payload)
+						if typ == TypeMessagePayload {
+							got = string(msg.Data)
+						}
+						if got != want {
+							t.Fatalf("reassembled %q want %q", got, want)
+						}
+					})
+				}
+			}
+		}
+	}
+}
+
+func TestStateTracksLifecycle(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	c := New(a, WithRequireAuthFirst(true), WithMaxFramePayloadBytes(1024), WithMaxPayloadForType(TypeAuthBegin, 64))
+
+	st := c.State()
+	if st.Closed || st.Authenticated || !st.RequireAuthFirst {
+		t.Fatalf("initial state: %+v", st)
+	}
+	if st.Version != v1Version || st.MaxFramePayload != 1024 || st.MaxPayloadByType[TypeAuthBegin] != 64 {
+		t.Fatalf("limits: %+v", st)
+	}
+
+	c.MarkAuthenticated()
+	if !c.State().Authenticated {
+		t.Fatalf("expected authenticated")
+	}
+
+	// A protocol violation closes the Conn.
+	go func() { _, _ = b.Write([]byte("XX\x01\x10\x00\x03\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00")) }()
+	if _, err := c.ReadNext(context.Background()); !errors.Is(err, ErrBadMagic) {
+		t.Fatalf("ReadNext: got %v want ErrBadMagic", err)
+	}
+	if !c.State().Closed {
+		t.Fatalf("expected closed after protocol error")
+	}
+}
+
+func TestStatsCountTraffic(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ca := New(a, WithMaxFramePayloadBytes(8))
+	cb := New(b)
+
+	sendDone := make(chan struct{})
+	go func() {
+		defer close(sendDone)
+		_ = ca.Send(context.Background(), Message{Type: TypePing})
+		// 4-byte envelope + 12 bytes of data in 8-byte frames: 2 frames.
+		_ = ca.SendBatch(context.Background(), []Message{
+			{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: []byte("0123456789ab")},
+		})
+	}()
+	for i := 0; i < 2; i++ {
+		if _, err := cb.ReadNext(context.Background()); err != nil {
+			t.Fatalf("ReadNext: %v", err)
+		}
+	}
+	<-sendDone
+
+	const wantFrames = 3
+	const wantBytes = wantFrames*headerLen + 4 + 12
+	sent := ca.Stats()
+	if sent.FramesSent != wantFrames || sent.BytesSent != wantBytes {
+		t.Fatalf("sent: %+v", sent)
+	}
+
+	st, err := cb.CloseWithStats()
+	if err != nil {
+		t.Fatalf("CloseWithStats: %v", err)
+	}
+	if st.FramesReceived != wantFrames || st.BytesReceived != wantBytes || st.ReadInProgress || st.WriteInProgress {
+		t.Fatalf("received: %+v", st)
+	}
+	if !cb.State().Closed {
+		t.Fatalf("expected closed")
+	}
+}
+
+func TestCloseWithStatsReportsReadInProgress(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+
+	cb := New(b)
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		_, _ = cb.ReadNext(context.Background())
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cb.Stats().ReadInProgress {
+		if time.Now().After(deadline) {
+			t.Fatalf("read never reported in progress")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	st, _ := cb.CloseWithStats()
+	if !st.ReadInProgress {
+		t.Fatalf("expected ReadInProgress at close: %+v", st)
+	}
+	<-readDone
+}
+
+func TestAllowedPayloadKinds(t *testing.T) {
+	oneway := Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: []byte("x")}
+	request := Message{Type: TypeMessagePayload, StreamID: 2, Kind: PayloadKindRequest, Data: []byte("x")}
+
+	rpc := New(nil, WithAllowedPayloadKinds(PayloadKindRequest, PayloadKindResponse))
+	if err := rpc.validateOutgoing(oneway); !errors.Is(err, ErrDisallowedKind) {
+		t.Fatalf("Send oneway: got %v want ErrDisallowedKind", err)
+	}
+	if err := rpc.validateOutgoing(request); err != nil {
+		t.Fatalf("Send request: %v", err)
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ca := New(a)
+	cb := New(b, WithAllowedPayloadKinds(PayloadKindOneway))
+
+	go func() {
+		_ = ca.Send(context.Background(), oneway)
+		_ = ca.Send(context.Background(), request)
+	}()
+	if _, err := cb.ReadNext(context.Background()); err != nil {
+		t.Fatalf("ReadNext oneway: %v", err)
+	}
+	_, err := cb.ReadNext(context.Background())
+	if !errors.Is(err, ErrDisallowedKind) || !errors.Is(err, ErrEnvelope) {
+		t.Fatalf("ReadNext request: got %v want ErrDisallowedKind", err)
+	}
+	if !cb.State().Closed {
+		t.Fatalf("expected connection closed")
+	}
+}
+
+func TestKeepOpenOnEnvelopeError(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	bad := []byte{0x7f, 0, 0, 0, 'x'}
+	go func() {
+		// A malformed single-frame message, then a malformed fragmented one,
+		// then a valid message that must still be readable.
+		_ = encodeFrameTo(a, TypeMessagePayload, startEndFlags, 1, bad)
+		_ = encodeFrameTo(a, TypeMessagePayload, FlagStart, 2, bad)
+		_ = encodeFrameTo(a, TypeMessagePayload, 0, 2, []byte("middle"))
+		_ = encodeFrameTo(a, TypeMessagePayload, FlagEnd, 2, []byte("end"))
+		_ = New(a).Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 3, Kind: PayloadKindOneway, Data: []byte("ok")})
+	}()
+
+	cb := New(b, WithKeepOpenOnEnvelopeError(true))
+	for _, id := range []uint64{1, 2} {
+		_, err := cb.ReadNext(context.Background())
+		var envErr *EnvelopeError
+		if !errors.As(err, &envErr) || !errors.Is(err, ErrEnvelope) || !errors.Is(err, ErrProtocol) {
+			t.Fatalf("ReadNext stream %d: got %v want *EnvelopeError", id, err)
+		}
+		if envErr.StreamID != id || !bytes.Equal(envErr.Payload, bad) {
+			t.Fatalf("EnvelopeError: got stream %d payload %q", envErr.StreamID, envErr.Payload)
+		}
+	}
+	if cb.State().Closed {
+		t.Fatalf("connection closed on envelope error")
+	}
+
+	msg, err := cb.ReadNext(context.Background())
+	if err != nil {
+		t.Fatalf("ReadNext: %v", err)
+	}
+	if msg.StreamID != 3 || string(msg.Data) != "ok" {
+		t.Fatalf("ReadNext: got stream %d data %q", msg.StreamID, msg.Data)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		// A small frame limit fragments the header block itself.
+		ca := New(a, WithMaxFramePayloadBytes(16), WithPadding([]int{128}))
+		cb := New(b, WithMaxFramePayloadBytes(16))
+
+		want := map[string]string{"content-type": "text/plain", "x-trace": "abc123", "empty": ""}
+		go func() {
+			_ = ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindRequest, Format: PayloadFormatHeaders, Headers: want, Data: []byte("hello")})
+			_ = ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 2, Kind: PayloadKindRequest, Format: PayloadFormatHeaders, Data: []byte("bare")})
+		}()
+
+		msg, err := cb.ReadNext(context.Background())
+		if err != nil {
+			t.Fatalf("ReadNext: %v", err)
+		}
+		if msg.Format != PayloadFormatHeaders || !maps.Equal(msg.Headers, want) || string(msg.Data) != "hello" {
+			t.Fatalf("ReadNext: got format %d headers %v data %q", msg.Format, msg.Headers, msg.Data)
+		}
+		msg, err = cb.ReadNext(context.Background())
+		if err != nil {
+			t.Fatalf("ReadNext: %v", err)
+		}
+		if len(msg.Headers) != 0 || string(msg.Data) != "bare" {
+			t.Fatalf("ReadNext: got headers %v data %q", msg.Headers, msg.Data)
+		}
+	})
+
+	t.Run("send limits", func(t *testing.T) {
+		c := New(nil)
+		base := Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway}
+
+		opaque := base
+		opaque.Headers = map[string]string{"k": "v"}
+		if err := c.validateOutgoing(opaque); !errors.Is(err, ErrHeaders) {
+			t.Fatalf("headers on opaque_bytes: got %v want ErrHeaders", err)
+		}
+
+		big := base
+		big.Format = PayloadFormatHeaders
+		big.Headers = map[string]string{"k": strings.Repeat("v", maxHeaderBlockLen)}
+		if err := c.validateOutgoing(big); !errors.Is(err, ErrHeaders) {
+			t.Fatalf("oversized block: got %v want ErrHeaders", err)
+		}
+
+		many := base
+		many.Format = PayloadFormatHeaders
+		many.Headers = map[string]string{}
+		for i := 0; i <= maxHeaders; i++ {
+			many.Headers[fmt.Sprint(i)] = ""
+		}
+		if err := c.validateOutgoing(many); !errors.Is(err, ErrHeaders) {
+			t.Fatalf("too many headers: got %v want ErrHeaders", err)
+		}
+	})
+
+	t.Run("malformed block", func(t *testing.T) {
+		for name, data := range map[string][]byte{
+			"missing length":  {0},
+			"length too long": {0, 9, 1, 'k', 0, 0},
+			"truncated value": {0, 4, 1, 'k', 0, 5},
+			"empty name":      {0, 3, 0, 0, 0},
+			"duplicate":       {0, 8, 1, 'k', 0, 0, 1, 'k', 0, 0},
+		} {
+			a, b := net.Pipe()
+			payload := append([]byte{byte(PayloadKindOneway), byte(PayloadFormatHeaders), 0, 0}, data...)
+			go func() { _ = encodeFrameTo(a, TypeMessagePayload, startEndFlags, 1, payload) }()
+
+			_, err := New(b).ReadNext(context.Background())
+			if !errors.Is(err, ErrHeaders) || !errors.Is(err, ErrEnvelope) {
+				t.Errorf("%s: got %v want ErrHeaders", name, err)
+			}
+			a.Close()
+			b.Close()
+		}
+	})
+}
+
+func TestReconnecting(t *testing.T) {
+	peers := make(chan *Conn, 4)
+	var dials atomic.Int32
+	dial := func(ctx context.Context) (*Conn, error) {
+		if dials.Add(1) == 2 {
+			return nil, errors.New("dial failed")
+		}
+		a, b := net.Pipe()
+		peers <- New(b)
+		return New(a), nil
+	}
+
+	rc := NewReconnecting(dial, ReconnectConfig{MinBackoff: time.Millisecond})
+	defer rc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := rc.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady: %v", err)
+	}
+	if gen := rc.Generation(); gen != 1 {
+		t.Fatalf("Generation: got %d want 1", gen)
+	}
+
+	peer := <-peers
+	ping := Message{Type: TypePing}
+	go func() { _ = peer.Send(ctx, ping) }()
+	if msg, err := rc.ReadNext(ctx); err != nil || msg.Type != TypePing {
+		t.Fatalf("ReadNext: got %v, %v", msg.Type, err)
+	}
+
+	// The peer drops the connection: the read reports it, then a redial
+	// (after one failed attempt) brings up a new connection.
+	_ = peer.Close()
+	if _, err := rc.ReadNext(ctx); !errors.Is(err, ErrReconnecting) || !errors.Is(err, io.EOF) {
+		t.Fatalf("ReadNext after drop: got %v want ErrReconnecting wrapping io.EOF", err)
+	}
+	if err := rc.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady: %v", err)
+	}
+	if gen := rc.Generation(); gen != 2 {
+		t.Fatalf("Generation: got %d want 2", gen)
+	}
+
+	peer = <-peers
+	go func() { _, _ = peer.ReadNext(ctx) }()
+	if err := rc.Send(ctx, ping); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	// Cancelling a read does not count as a connection failure.
+	short, cancelShort := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelShort()
+	if _, err := rc.ReadNext(short); err == nil || errors.Is(err, ErrReconnecting) {
+		t.Fatalf("ReadNext: got %v want a timeout", err)
+	}
+	if gen := rc.Generation(); gen != 2 {
+		t.Fatalf("Generation after cancel: got %d want 2", gen)
+	}
+
+	_ = rc.Close()
+	if err := rc.Send(ctx, ping); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("Send after Close: got %v want ErrConnClosed", err)
+	}
+}
+
+func TestReconnectingKeepsConnOnTimeout(t *testing.T) {
+	peers := make(chan *Conn, 2)
+	dial := func(ctx context.Context) (*Conn, error) {
+		a, b := net.Pipe()
+		peers <- New(b)
+		return New(a, WithDefaultReadTimeout(10*time.Millisecond)), nil
+	}
+
+	rc := NewReconnecting(dial, ReconnectConfig{MinBackoff: time.Millisecond})
+	defer rc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := rc.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady: %v", err)
+	}
+	peer := <-peers
+	defer peer.Close()
+
+	// The peer is idle: the per-call read timeout fires on a healthy
+	// connection, which must be kept. It only applies to a context without
+	// a deadline.
+	if _, err := rc.ReadNext(context.Background()); err == nil || errors.Is(err, ErrReconnecting) {
+		t.Fatalf("ReadNext: got %v want a timeout", err)
+	}
+	if gen := rc.Generation(); gen != 1 {
+		t.Fatalf("Generation after timeout: got %d want 1", gen)
+	}
+
+	go func() { _ = peer.Send(ctx, Message{Type: TypePing}) }()
+	var (
+		msg Message
+		err error
+	)
+	for {
+		// The read timeout may fire before the peer's ping arrives.
+		if msg, err = rc.ReadNext(context.Background()); err == nil || errors.Is(err, ErrReconnecting) {
+			break
+		}
+	}
+	if err != nil || msg.Type != TypePing {
+		t.Fatalf("ReadNext after timeout: got %v, %v", msg.Type, err)
+	}
+}
+
+func TestReconnectingRedialsAfterEmulatedDeadline(t *testing.T) {
+	peers := make(chan *Conn, 2)
+	dial := func(ctx context.Context) (*Conn, error) {
+		a, b := rwcPair()
+		peers <- NewRWC(b)
+		return NewRWC(a, WithDefaultReadTimeout(10*time.Millisecond)), nil
+	}
+
+	rc := NewReconnecting(dial, ReconnectConfig{MinBackoff: time.Millisecond})
+	defer rc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := rc.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady: %v", err)
+	}
+	peer := <-peers
+	defer peer.Close()
+
+	// Emulating the read timeout closed the transport, so unlike on a
+	// net.Conn the connection must be replaced.
+	if _, err := rc.ReadNext(context.Background()); !errors.Is(err, ErrReconnecting) {
+		t.Fatalf("ReadNext: got %v want ErrReconnecting", err)
+	}
+	if err := rc.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady after timeout: %v", err)
+	}
+	if gen := rc.Generation(); gen != 2 {
+		t.Fatalf("Generation after timeout: got %d want 2", gen)
+	}
+	peer = <-peers
+	defer peer.Close()
+	go func() { _ = peer.Send(ctx, Message{Type: TypePing}) }()
+	msg, err := rc.ReadNext(ctx)
+	if err != nil || msg.Type != TypePing {
+		t.Fatalf("ReadNext on new conn: got %v, %v", msg.Type, err)
+	}
+}
+
+// pipeRWC is an io.ReadWriteCloser without deadlines, standing in for a
+// transport that is not a net.Conn.
+type pipeRWC struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p pipeRWC) Close() error {
+	_ = p.PipeWriter.Close()
+	return p.PipeReader.Close()
+}
+
+func rwcPair() (pipeRWC, pipeRWC) {
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	return pipeRWC{ar, aw}, pipeRWC{br, bw}
+}
+
+func TestNewRWC(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		a, b := rwcPair()
+		ca, cb := NewRWC(a), NewRWC(b)
+		defer ca.Close()
+		defer cb.Close()
+
+		want := Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: []byte("hi")}
+		go func() { _ = ca.Send(context.Background(), want) }()
+		msg, err := cb.ReadNext(context.Background())
+		if err != nil {
+			t.Fatalf("ReadNext: %v", err)
+		}
+		if msg.StreamID != 1 || string(msg.Data) != "hi" {
+			t.Fatalf("ReadNext: got stream %d data %q", msg.StreamID, msg.Data)
+		}
+	})
+
+	t.Run("cancel closes", func(t *testing.T) {
+		a, b := rwcPair()
+		defer a.Close()
+		cb := NewRWC(b)
+		defer cb.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		if _, err := cb.ReadNext(ctx); !errors.Is(err, context.Canceled) {
+			t.Fatalf("ReadNext: got %v want context.Canceled", err)
+		}
+		if _, err := a.Write([]byte{0}); err == nil {
+			t.Fatalf("transport still open after cancelled read")
+		}
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		a, b := rwcPair()
+		defer a.Close()
+		cb := NewRWC(b, WithReadIdleTimeout(20*time.Millisecond))
+		defer cb.Close()
+
+		if _, err := cb.ReadNext(context.Background()); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("ReadNext: got %v want os.ErrDeadlineExceeded", err)
+		}
+	})
+}
+
+func TestFrameCount(t *testing.T) {
+	payload := func(n int) Message {
+		return Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: make([]byte, n)}
+	}
+	for _, tt := range []struct {
+		name string
+		opts []Option
+		msg  Message
+		want int
+	}{
+		{name: "ping", msg: Message{Type: TypePing}, want: 1},
+		{name: "empty payload", opts: []Option{WithMaxFramePayloadBytes(16)}, msg: payload(0), want: 1},
+		{name: "fits with envelope", opts: []Option{WithMaxFramePayloadBytes(16)}, msg: payload(12), want: 1},
+		{name: "envelope spills", opts: []Option{WithMaxFramePayloadBytes(16)}, msg: payload(13), want: 2},
+		{name: "many fragments", opts: []Option{WithMaxFramePayloadBytes(16)}, msg: payload(12 + 16*3 + 1), want: 5},
+		{name: "padded", opts: []Option{WithMaxFramePayloadBytes(16), WithPadding([]int{64})}, msg: payload(1), want: 5},
+		{name: "auth", opts: []Option{WithMaxFramePayloadBytes(16)}, msg: Message{Type: TypeAuthBegin, Payload: make([]byte, 33)}, want: 3},
+		{name: "invalid", msg: Message{Type: TypeMessagePayload}, want: 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(nil, tt.opts...)
+			got := c.FrameCount(tt.msg)
+			if got != tt.want {
+				t.Fatalf("FrameCount: got %d want %d", got, tt.want)
+			}
+			if got == 0 {
+				return
+			}
+
+			// Send must agree.
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			ca := New(a, tt.opts...)
+			go func() { _ = ca.Send(context.Background(), tt.msg) }()
+			cb := New(b, WithMaxFramePayloadBytes(1<<20))
+			if _, err := cb.ReadNext(context.Background()); err != nil {
+				t.Fatalf("ReadNext: %v", err)
+			}
+			if n := cb.Stats().FramesReceived; n != uint64(got) {
+				t.Fatalf("Send wrote %d frames, FrameCount said %d", n, got)
+			}
+		})
+	}
+}
+
+// failingReader returns data, then err.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestSendStream(t *testing.T) {
+	msg := Message{StreamID: 7, Kind: PayloadKindRequest}
+
+	t.Run("clean end", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		data := bytes.Repeat([]byte("x"), 100)
+		ca := New(a, WithMaxFramePayloadBytes(32))
+		go func() { _ = ca.SendStream(context.Background(), msg, bytes.NewReader(data)) }()
+
+		got, err := New(b).ReadNext(context.Background())
+		if err != nil {
+			t.Fatalf("ReadNext: %v", err)
+		}
+		if got.StreamID != 7 || got.Kind != PayloadKindRequest || !bytes.Equal(got.Data, data) {
+			t.Fatalf("ReadNext: got stream %d kind %d %d bytes", got.StreamID, got.Kind, len(got.Data))
+		}
+	})
+
+	t.Run("reader fails", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		ca := New(a, WithMaxFramePayloadBytes(32))
+		cb := New(b)
+		boom := errors.New("boom")
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- ca.SendStream(context.Background(), msg, &failingReader{data: make([]byte, 100), err: boom})
+			_ = ca.Send(context.Background(), Message{Type: TypePing})
+		}()
+
+		_, err := cb.ReadNext(context.Background())
+		var reset *StreamResetError
+		if !errors.As(err, &reset) || !errors.Is(err, ErrStreamReset) || reset.StreamID != 7 {
+			t.Fatalf("ReadNext: got %v want *StreamResetError for stream 7", err)
+		}
+		if err := <-errCh; !errors.Is(err, boom) {
+			t.Fatalf("SendStream: got %v want boom", err)
+		}
+		if got, err := cb.ReadNext(context.Background()); err != nil || got.Type != TypePing {
+			t.Fatalf("ReadNext after reset: got %v, %v", got.Type, err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		ca := New(a, WithMaxFramePayloadBytes(32))
+		errCh := make(chan error, 1)
+		go func() { errCh <- ca.SendStream(ctx, msg, pr) }()
+		go func() {
+			_, _ = pw.Write(make([]byte, 64))
+			cancel()
+			_, _ = pw.Write(make([]byte, 64))
+		}()
+
+		if _, err := New(b).ReadNext(context.Background()); !errors.Is(err, ErrStreamReset) {
+			t.Fatalf("ReadNext: got %v want ErrStreamReset", err)
+		}
+		if err := <-errCh; !errors.Is(err, context.Canceled) {
+			t.Fatalf("SendStream: got %v want context.Canceled", err)
+		}
+	})
+
+	t.Run("standalone reset", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		go func() { _ = New(a).ResetStream(context.Background(), 9, "no longer needed") }()
+		_, err := New(b).ReadNext(context.Background())
+		var reset *StreamResetError
+		if !errors.As(err, &reset) || reset.StreamID != 9 || reset.Reason != "no longer needed" {
+			t.Fatalf("ReadNext: got %v", err)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		c := New(nil, WithPadding([]int{64}))
+		if err := c.SendStream(context.Background(), msg, bytes.NewReader(nil)); !errors.Is(err, ErrProtocol) {
+			t.Fatalf("SendStream with padding: got %v want ErrProtocol", err)
+		}
+	})
+}
+
+func TestRunKeepAlive(t *testing.T) {
+	t.Run("invalid durations", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		ca := New(a)
+		for _, d := range [][2]time.Duration{{0, time.Second}, {-time.Second, time.Second}, {time.Second, 0}, {time.Second, -time.Second}} {
+			if err := ca.RunKeepAlive(context.Background(), d[0], d[1]); err == nil {
+				t.Fatalf("RunKeepAlive(%s, %s): want an error", d[0], d[1])
+			}
+		}
+		if ca.State().Closed {
+			t.Fatalf("connection closed")
+		}
+	})
+
+	t.Run("alive", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		ca := New(a, WithKeepAliveJitter(0.5))
+		cb := New(b, WithAutoPong(true))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		_, _ = ca.Reader(ctx)
+		_, _ = cb.Reader(ctx)
+
+		time.AfterFunc(200*time.Millisecond, cancel)
+		if err := ca.RunKeepAlive(ctx, 20*time.Millisecond, 8*time.Millisecond); !errors.Is(err, context.Canceled) {
+			t.Fatalf("RunKeepAlive: got %v want context.Canceled", err)
+		}
+		if n := cb.Stats().FramesReceived; n < 3 {
+			t.Fatalf("peer received %d pings, want several", n)
+		}
+	})
+
+	t.Run("no pong", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		ca := New(a)
+		cb := New(b) // drops pings without answering
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		_, _ = cb.Reader(ctx)
+
+		if err := ca.RunKeepAlive(ctx, 10*time.Millisecond, 20*time.Millisecond); !errors.Is(err, ErrKeepAliveTimeout) {
+			t.Fatalf("RunKeepAlive: got %v want ErrKeepAliveTimeout", err)
+		}
+		if !ca.State().Closed {
+			t.Fatalf("connection not closed")
+		}
+	})
+
+	t.Run("jitter bounds", func(t *testing.T) {
+		c := New(nil, WithKeepAliveJitter(0.25))
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 1000; i++ {
+			d := c.keepAliveInterval(time.Second)
+			if d < 750*time.Millisecond || d > 1250*time.Millisecond {
+				t.Fatalf("interval %s outside ±25%%", d)
+			}
+			seen[d] = true
+		}
+		if len(seen) < 100 {
+			t.Fatalf("only %d distinct intervals", len(seen))
+		}
+		if d := New(nil).keepAliveInterval(time.Second); d != time.Second {
+			t.Fatalf("no jitter: got %s", d)
+		}
+	})
+}
+
+func TestFrameObserver(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	var seen []FrameInfo
+	ca := New(a, WithMaxFramePayloadBytes(16))
+	cb := New(b, WithFrameObserver(func(fi FrameInfo) { seen = append(seen, fi) }))
+
+	go func() {
+		_ = ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 5, Kind: PayloadKindOneway, Data: make([]byte, 20)})
+		_ = ca.Send(context.Background(), Message{Type: TypePing})
+	}()
+	for range 2 {
+		if _, err := cb.ReadNext(context.Background()); err != nil {
+			t.Fatalf("ReadNext: %v", err)
+		}
+	}
+
+	want := []FrameInfo{
+		{Type: TypeMessagePayload, Flags: FlagStart, StreamID: 5, PayloadLen: 16},
+		{Type: TypeMessagePayload, Flags: FlagEnd, StreamID: 5, PayloadLen: 8},
+		{Type: TypePing, Flags: startEndFlags},
+	}
+	if !slices.Equal(seen, want) {
+		t.Fatalf("observed %+v want %+v", seen, want)
+	}
+}
+
+func TestUnfragmentedAuth(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	cb := New(b, WithUnfragmentedAuth(true))
+
+	// START without END, then stall: rejected without waiting for more.
+	go func() { _ = encodeFrameTo(a, TypeAuthProof, FlagStart, 0, []byte("{")) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := cb.ReadNext(ctx); !errors.Is(err, ErrAuthFragmented) {
+		t.Fatalf("ReadNext: got %v want ErrAuthFragmented", err)
+	}
+
+	small := New(nil, WithUnfragmentedAuth(true), WithMaxFramePayloadBytes(4))
+	if err := small.validateOutgoing(Message{Type: TypeAuthBegin, Payload: []byte(`{"a":1}`)}); !errors.Is(err, ErrAuthFragmented) {
+		t.Fatalf("Send: got %v want ErrAuthFragmented", err)
+	}
+}
+
+func TestPauseReads(t *testing.T) {
+	t.Run("resume", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		ca, cb := New(a), New(b)
+
+		cb.PauseReads()
+		got := make(chan error, 1)
+		go func() {
+			msg, err := cb.ReadNext(context.Background())
+			if err == nil && string(msg.Data) != "hi" {
+				err = fmt.Errorf("got %+v", msg)
+			}
+			got <- err
+		}()
+
+		// Nothing drains the pipe, so the sender blocks: the backpressure
+		// reaches it.
+		sent := make(chan error, 1)
+		go func() {
+			sent <- ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: []byte("hi")})
+		}()
+		select {
+		case err := <-got:
+			t.Fatalf("ReadNext returned while paused: %v", err)
+		case err := <-sent:
+			t.Fatalf("Send returned while reads are paused: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		cb.ResumeReads()
+		if err := <-got; err != nil {
+			t.Fatalf("ReadNext: %v", err)
+		}
+		if err := <-sent; err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	})
+
+	t.Run("close unblocks", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		cb := New(b)
+
+		cb.PauseReads()
+		cb.PauseReads()
+		got := make(chan error, 1)
+		go func() { _, err := cb.ReadNext(context.Background()); got <- err }()
+		time.Sleep(20 * time.Millisecond)
+		_ = cb.Close()
+		select {
+		case err := <-got:
+			if !errors.Is(err, ErrConnClosed) {
+				t.Fatalf("got %v want ErrConnClosed", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Close did not unblock the paused reader")
+		}
+	})
+
+	t.Run("context", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		cb := New(b)
+
+		cb.PauseReads()
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if _, err := cb.ReadRawFrame(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v want context.DeadlineExceeded", err)
+		}
+		if cb.State().Closed {
+			t.Fatal("a cancelled paused read closed the connection")
+		}
+	})
+}
+
+func TestRunAppHeartbeat(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ca, cb := New(a), New(b)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var depth atomic.Int64
+	done := make(chan error, 1)
+	go func() {
+		done <- RunAppHeartbeat(ctx, ca, 7, 5*time.Millisecond, func() []byte {
+			return []byte(strconv.FormatInt(depth.Add(1), 10))
+		})
+	}()
+
+	for i := 1; i <= 3; i++ {
+		msg, err := cb.ReadNext(context.Background())
+		if err != nil {
+			t.Fatalf("ReadNext: %v", err)
+		}
+		if msg.StreamID != 7 || msg.Kind != PayloadKindOneway || string(msg.Data) != strconv.Itoa(i) {
+			t.Fatalf("heartbeat %d: got %+v", i, msg)
+		}
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("RunAppHeartbeat: got %v want context.Canceled", err)
+	}
+
+	if err := RunAppHeartbeat(context.Background(), ca, 7, 0, nil); err == nil {
+		t.Fatal("zero interval accepted")
+	}
+}
+
+func TestWriteInProgress(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ca, cb := New(a, WithMaxFramePayloadBytes(16)), New(b, WithMaxFramePayloadBytes(16))
+
+	if ca.WriteInProgress() {
+		t.Fatal("WriteInProgress before any write")
+	}
+
+	// Nothing reads yet, so the fragmented Send blocks on its first frame.
+	data := bytes.Repeat([]byte("x"), 100)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- ca.Send(context.Background(), Message{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: data})
+	}()
+	deadline := time.Now().Add(time.Second)
+	for !ca.WriteInProgress() {
+		if time.Now().After(deadline) {
+			t.Fatal("WriteInProgress not reported during Send")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// An injected control frame waits for the message boundary.
+	injected := make(chan error, 1)
+	go func() {
+		injected <- ca.WriteRawFrame(context.Background(), Frame{Type: TypePing, Flags: startEndFlags})
+	}()
+
+	msg, err := cb.ReadNext(context.Background())
+	if err != nil || !bytes.Equal(msg.Data, data) {
+		t.Fatalf("message: got %+v, %v", msg, err)
+	}
+	if msg, err := cb.ReadNext(context.Background()); err != nil || msg.Type != TypePing {
+		t.Fatalf("injected frame: got %+v, %v", msg, err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := <-injected; err != nil {
+		t.Fatalf("WriteRawFrame: %v", err)
+	}
+	if ca.WriteInProgress() {
+		t.Fatal("WriteInProgress after writes returned")
+	}
+}
+
+func TestEmptyFragmentFlood(t *testing.T) {
+	envelope := []byte{byte(PayloadKindOneway), 0, 0, 0}
+
+	t.Run("flood", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		cb := New(b, WithMaxEmptyFragments(3))
+
+		go func() {
+			_, _ = a.Write(FrameBytes(TypeMessagePayload, FlagStart, 1, envelope))
+			for range 10 {
+				if _, err := a.Write(FrameBytes(TypeMessagePayload, 0, 1, nil)); err != nil {
+					return
+				}
+			}
+		}()
+		_, err := cb.ReadNext(context.Background())
+		if !errors.Is(err, ErrEmptyFragmentFlood) || !errors.Is(err, ErrProtocol) {
+			t.Fatalf("got %v want ErrEmptyFragmentFlood", err)
+		}
+		if !cb.State().Closed {
+			t.Fatal("connection not closed")
+		}
+	})
+
+	t.Run("interleaved data resets the count", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		cb := New(b, WithMaxEmptyFragments(2))
+
+		go func() {
+			_, _ = a.Write(FrameBytes(TypeMessagePayload, FlagStart, 1, envelope))
+			for _, p := range []string{"", "", "a", "", "", "b", ""} {
+				_, _ = a.Write(FrameBytes(TypeMessagePayload, 0, 1, []byte(p)))
+			}
+			_, _ = a.Write(FrameBytes(TypeMessagePayload, FlagEnd, 1, nil))
+		}()
+		msg, err := cb.ReadNext(context.Background())
+		if err != nil || string(msg.Data) != "ab" {
+			t.Fatalf("got %+v, %v", msg, err)
+		}
+	})
+}
+
+// TestMessagePayloadEnvelopeRoundTrip pins every accepted (Kind, Format)
+// combination across the first-frame capacity boundary, maxFramePayload minus
+// the envelope.
+func TestMessagePayloadEnvelopeRoundTrip(t *testing.T) {
+	const maxPayload = 32
+	firstDataCap := maxPayload - envelopeLen
+	sizes := []struct {
+		n      int
+		frames int
+	}{
+		{0, 1},
+		{1, 1},
+		{firstDataCap - 1, 1},
+		{firstDataCap, 1},
+		{firstDataCap + 1, 2},
+		{maxPayload, 2},
+		{firstDataCap + maxPayload, 2},
+		{firstDataCap + maxPayload + 1, 3},
+	}
+
+	for _, kind := range []PayloadKind{PayloadKindRequest, PayloadKindResponse, PayloadKindOneway} {
+		for _, format := range []PayloadFormat{PayloadFormatOpaqueBytes, PayloadFormatJSON, PayloadFormatHeaders} {
+			for _, size := range sizes {
+				want := Message{
+					Type:      TypeMessagePayload,
+					StreamID:  5,
+					Kind:      kind,
+					Format:    format,
+					RouteHint: 0xbeef,
+					Data:      bytes.Repeat([]byte{'d'}, size.n),
+				}
+				frames := size.frames
+				if format == PayloadFormatHeaders {
+					want.Headers = map[string]string{"k": "v"}
+					// The header block is carried in Data: length, then
+					// KeyLen|Key|ValLen|Val.
+					frames = New(nil, WithMaxFramePayloadBytes(maxPayload)).FrameCount(want)
+				}
+
+				t.Run(fmt.Sprintf("kind=%d/format=%d/len=%d", kind, format, size.n), func(t *testing.T) {
+					a, b := net.Pipe()
+					defer a.Close()
+					defer b.Close()
+					ca := New(a, WithMaxFramePayloadBytes(maxPayload))
+					cb := New(b, WithMaxFramePayloadBytes(maxPayload))
+
+					if got := ca.FrameCount(want); got != frames {
+						t.Fatalf("FrameCount = %d, want %d", got, frames)
+					}
+					sent := make(chan error, 1)
+					go func() { sent <- ca.Send(context.Background(), want) }()
+
+					got, err := cb.ReadNext(context.Background())
+					if err != nil {
+						t.Fatalf("ReadNext: %v", err)
+					}
+					if err := <-sent; err != nil {
+						t.Fatalf("Send: %v", err)
+					}
+					if got.Kind != want.Kind || got.Format != want.Format || got.RouteHint != want.RouteHint || got.StreamID != want.StreamID {
+						t.Fatalf("envelope: got %+v want %+v", got, want)
+					}
+					if !bytes.Equal(got.Data, want.Data) || !maps.Equal(got.Headers, want.Headers) {
+						t.Fatalf("body: got data=%q headers=%v want data=%q headers=%v", got.Data, got.Headers, want.Data, want.Headers)
+					}
+					if n := cb.Stats().FramesReceived; n != uint64(frames) {
+						t.Fatalf("received %d frames, want %d", n, frames)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestDefaultTimeouts(t *testing.T) {
+	t.Run("read default applied", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		cb := New(b, WithDefaultReadTimeout(20*time.Millisecond))
+
+		start := time.Now()
+		if _, err := cb.ReadNext(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("ReadNext: got %v want context.DeadlineExceeded", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("ReadNext took %s", elapsed)
+		}
+		if cb.State().Closed {
+			t.Fatal("timeout closed the connection")
+		}
+	})
+
+	t.Run("read context deadline takes precedence", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		ca, cb := New(a), New(b, WithDefaultReadTimeout(10*time.Millisecond))
+
+		time.AfterFunc(50*time.Millisecond, func() { _ = ca.Send(context.Background(), Message{Type: TypePing}) })
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if msg, err := cb.ReadNext(ctx); err != nil || msg.Type != TypePing {
+			t.Fatalf("ReadNext: got %+v, %v", msg, err)
+		}
+	})
+
+	t.Run("write default applied", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		ca := New(a, WithDefaultWriteTimeout(20*time.Millisecond))
+
+		// Nothing reads from b, so the write blocks until the default fires.
+		err := ca.Send(context.Background(), Message{Type: TypePing})
+		if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Send: got %v want a deadline error", err)
+		}
+	})
+
+	t.Run("write context deadline takes precedence", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		ca, cb := New(a, WithDefaultWriteTimeout(10*time.Millisecond)), New(b)
+
+		time.AfterFunc(50*time.Millisecond, func() { _, _ = cb.ReadNext(context.Background()) })
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := ca.WriteRawFrame(ctx, Frame{Type: TypePing, Flags: startEndFlags}); err != nil {
+			t.Fatalf("WriteRawFrame: %v", err)
+		}
+	})
+}
+
+func TestDrainMessage(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ca := New(a, WithMaxFramePayloadBytes(16))
+	cb := New(b, WithMaxFramePayloadBytes(16))
+
+	sendErr := make(chan error, 1)
+	go func() {
+		ctx := context.Background()
+		for _, msg := range []Message{
+			{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindRequest, Data: make([]byte, 100)},
+			{Type: TypeMessagePayload, StreamID: 2, Kind: PayloadKindRequest, Data: make([]byte, 40)},
+			{Type: TypeMessagePayload, StreamID: 3, Kind: PayloadKindRequest, Data: []byte("next")},
+		} {
+			if err := ca.Send(ctx, msg); err != nil {
+				_ = ca.Close()
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- nil
+	}()
+
+	ctx := context.Background()
+	first, err := cb.ReadRawFrame(ctx)
+	if err != nil {
+		t.Fatalf("ReadRawFrame: %v", err)
+	}
+	if first.StreamID != 1 || !first.Flags.IsStart() || first.Flags.IsEnd() {
+		t.Fatalf("unexpected first frame %+v", first)
+	}
+	if err := cb.DrainMessage(ctx, first); err != nil {
+		t.Fatalf("DrainMessage: %v", err)
+	}
+
+	// A whole message drained frame by frame leaves nothing to do.
+	second, err := cb.ReadRawFrame(ctx)
+	if err != nil {
+		t.Fatalf("ReadRawFrame: %v", err)
+	}
+	for !second.Flags.IsEnd() {
+		if second, err = cb.ReadRawFrame(ctx); err != nil {
+			t.Fatalf("ReadRawFrame: %v", err)
+		}
+	}
+	if err := cb.DrainMessage(ctx, second); err != nil {
+		t.Fatalf("DrainMessage after END: %v", err)
+	}
+
+	msg, err := cb.ReadNext(ctx)
+	if err != nil {
+		t.Fatalf("ReadNext: %v", err)
+	}
+	if msg.StreamID != 3 || string(msg.Data) != "next" {
+		t.Fatalf("unexpected message after drain: %#v", msg)
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+}
+
+func TestControlHandler(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	var seen []string
+	ca := New(a)
+	cb := New(b, WithControlHandler(func(msg Message) {
+		seen = append(seen, fmt.Sprintf("control %d", msg.Type))
+	}))
+
+	go func() {
+		ctx := context.Background()
+		for _, msg := range []Message{
+			{Type: TypePing},
+			{Type: TypeMessagePayload, StreamID: 1, Kind: PayloadKindOneway, Data: []byte("one")},
+			{Type: TypePong},
+			{Type: TypePing},
+			{Type: TypeMessagePayload, StreamID: 2, Kind: PayloadKindOneway, Data: []byte("two")},
+			{Type: TypeAuthBegin, Payload: []byte("{}")},
+		} {
+			if err := ca.Send(ctx, msg); err != nil {
+				_ = ca.Close()
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		msg, err := cb.ReadNext(context.Background())
+		if err != nil {
+			t.Fatalf("ReadNext: %v", err)
+		}
+		seen = append(seen, fmt.Sprintf("read %d %s", msg.Type, msg.Data))
+	}
+	want := []string{
+		fmt.Sprintf("control %d", TypePing),
+		fmt.Sprintf("read %d one", TypeMessagePayload),
+		fmt.Sprintf("control %d", TypePong),
+		fmt.Sprintf("control %d", TypePing),
+		fmt.Sprintf("read %d two", TypeMessagePayload),
+		// Auth types are only diverted when asked for.
+		fmt.Sprintf("read %d ", TypeAuthBegin),
+	}
+	if !slices.Equal(seen, want) {
+		t.Fatalf("got %q\nwant %q", seen, want)
+	}
+}
@@ -0,0 +1,56 @@
+package protocol
+
+import "fmt"
+
+// Envelope is the header at the start of every message_payload message:
+//
+//	Kind (1) | Format (1) | Route Hint (2)
+//
+// It is the single definition of the envelope layout, used by Send and
+// SendStream to encode it and by ReadNext to decode it. The Pad Length field
+// of padded messages follows the envelope and is not part of it.
+type Envelope struct {
+	Kind      PayloadKind
+	Format    PayloadFormat
+	RouteHint uint16
+}
+
+// Encode returns the envelope's wire encoding.
+func (e Envelope) Encode() []byte {
+	return e.appendTo(make([]byte, 0, envelopeLen))
+}
+
+// appendTo appends the envelope's wire encoding to b.
+func (e Envelope) appendTo(b []byte) []byte {
+	return append(b, byte(e.Kind), byte(e.Format), byte(e.RouteHint>>8), byte(e.RouteHint))
+}
+
+// DecodeEnvelope decodes the envelope at the start of p, the payload of a
+// message_payload START frame, and returns it with the bytes that follow it.
+// It fails with an *EnvelopeError if p is too short or the kind or format is
+// unknown; StreamID and Payload of that error are left for the caller.
+func DecodeEnvelope(p []byte) (Envelope, []byte, error) {
+	e, rest, err := decodeEnvelope(p)
+	if err != nil {
+		return Envelope{}, nil, err
+	}
+	return e, rest, nil
+}
+
+func decodeEnvelope(p []byte) (Envelope, []byte, *EnvelopeError) {
+	if len(p) < envelopeLen {
+		return Envelope{}, nil, &EnvelopeError{Reason: fmt.Sprintf("payload of %d bytes too short for envelope", len(p))}
+	}
+	e := Envelope{
+		Kind:      PayloadKind(p[0]),
+		Format:    PayloadFormat(p[1]),
+		RouteHint: uint16(p[2])<<8 | uint16(p[3]),
+	}
+	if !isKnownFormat(e.Format) {
+		return Envelope{}, nil, &EnvelopeError{Reason: fmt.Sprintf("unsupported payload format %d", e.Format)}
+	}
+	if !isKnownKind(e.Kind) {
+		return Envelope{}, nil, &EnvelopeError{Reason: fmt.Sprintf("unsupported payload kind %d", e.Kind)}
+	}
+	return e, p[envelopeLen:], nil
+}
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+const maxErrorCodeLen = 255
+
+// RemoteError is returned by ReadNext when the peer sent a TypeError frame: a
+// connection-level notice, such as a policy denial, sent just before the peer
+// closes the connection.
+type RemoteError struct {
+	Code    string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("remote error: %s (%s)", e.Code, e.Message)
+	}
+	return "remote error: " + e.Code
+}
+
+// EncodeError builds the payload of a TypeError frame.
+func EncodeError(code, message string) ([]byte, error) {
+	if code == "" || len(code) > maxErrorCodeLen {
+		return nil, fmt.Errorf("%w: error code length %d out of range", ErrProtocol, len(code))
+	}
+	payload := make([]byte, 0, 1+len(code)+len(message))
+	payload = append(payload, byte(len(code)))
+	payload = append(payload, code...)
+	payload = append(payload, message...)
+	return payload, nil
+}
+
+// ParseError decodes the payload of a TypeError frame.
+func ParseError(payload []byte) (*RemoteError, error) {
+	if len(payload) < 1 {
+		return nil, errors.Join(ErrProtocol, ErrErrorFrame)
+	}
+	codeLen := int(payload[0])
+	if codeLen == 0 || len(payload) < 1+codeLen {
+		return nil, errors.Join(ErrProtocol, ErrErrorFrame)
+	}
+	return &RemoteError{
+		Code:    string(payload[1 : 1+codeLen]),
+		Message: string(payload[1+codeLen:]),
+	}, nil
+}
+
+// CloseWithError tells the peer why the connection is being terminated by
+// sending a TypeError frame, then closes the connection. The peer's ReadNext
+// returns the notice as a *RemoteError. The connection is closed even if the
+// frame cannot be sent; the send error is returned.
+func (c *Conn) CloseWithError(ctx context.Context, code, message string) error {
+	payload, err := EncodeError(code, message)
+	if err != nil {
+		return err
+	}
+	sendErr := c.Send(ctx, Message{Type: TypeError, Payload: payload})
+	closeErr := c.Close()
+	if sendErr != nil {
+		return sendErr
+	}
+	return closeErr
+}
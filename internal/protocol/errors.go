@@ -1,6 +1,10 @@
 package protocol
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"net"
+)
 
 var (
 	// ErrProtocol is a generic sentinel for protocol violations.
@@ -14,5 +18,107 @@ var (
 	ErrFragmentation   = errors.New("fragmentation error")
 	ErrEnvelope        = errors.New("message_payload envelope error")
 	ErrInvalidStreamID = errors.New("invalid stream id")
+	ErrResume          = errors.New("resume payload error")
+	ErrErrorFrame      = errors.New("error frame payload error")
+	ErrDisallowedKind  = errors.New("payload kind not allowed on this connection")
+	ErrAuthFragmented  = errors.New("fragmented auth message")
+	ErrHeaders         = errors.New("message_payload header block error")
+	ErrCompression     = errors.New("message_payload compression error")
+
+	// ErrCompressionDictionary is returned, with ErrCompression and
+	// ErrEnvelope, by ReadNext for a compressed message whose dictionary
+	// differs from the one set with WithCompressionDictionary.
+	ErrCompressionDictionary = fmt.Errorf("%w: dictionary mismatch", ErrCompression)
+
+	// ErrEmptyFragmentFlood is returned, with ErrProtocol, by ReadNext when a
+	// message has more consecutive empty continuation frames than
+	// WithMaxEmptyFragments allows. The connection is closed.
+	ErrEmptyFragmentFlood = errors.New("too many empty continuation frames")
+
+	// ErrWriteStall is returned by Send and the other write methods when a
+	// single frame write made no progress for WithWriteStallTimeout, i.e. the
+	// peer stopped reading. The connection is closed.
+	ErrWriteStall = errors.New("write stalled: peer stopped reading")
+
+	// errFrameCutShort is matched, along with os.ErrDeadlineExceeded, by the
+	// error of a write that WithWriteTimeout interrupted partway through a
+	// frame. The connection is closed.
+	errFrameCutShort = errors.New("write timed out partway through a frame")
+
+	// ErrUnauthenticated is returned by ReadNext when WithRequireAuthFirst is
+	// set and a non-auth frame arrives before MarkAuthenticated was called.
+	ErrUnauthenticated = errors.New("frame received before authentication")
+
+	// ErrConnClosed is returned by ReadNext, Send and the other I/O methods
+	// once Close was called on this side, including when Close interrupts a
+	// blocked call. It matches net.ErrClosed as well.
+	ErrConnClosed = fmt.Errorf("tunnel connection closed: %w", net.ErrClosed)
+
+	// ErrReassemblyTimeout is returned by ReadNext when a fragmented message
+	// is not completed within the WithReassemblyTimeout bound. The connection
+	// is closed.
+	ErrReassemblyTimeout = errors.New("message reassembly timed out")
+
+	// ErrReconnecting is returned by ReconnectingConn while its connection is
+	// down and being redialed. The call may be retried once a new connection
+	// is up; see ReconnectingConn.WaitReady.
+	ErrReconnecting = errors.New("tunnel connection reconnecting")
+
+	// ErrStreamReset is matched by the *StreamResetError ReadNext returns when
+	// the peer abandoned a message with a TypeReset frame.
+	ErrStreamReset = errors.New("stream reset")
+
+	// ErrKeepAliveTimeout is returned by RunKeepAlive when the peer did not
+	// answer a ping in time. The connection is closed.
+	ErrKeepAliveTimeout = errors.New("keepalive timed out")
+
+	// ErrReaderActive is reported by Reader when another Reader is running.
+	ErrReaderActive = errors.New("reader already active")
+
+	// ErrPayloadValidation is returned by ReadNext when a validator registered
+	// with WithPayloadValidator rejects a message. It is not a protocol error:
+	// the message was fully consumed and the connection stays usable.
+	ErrPayloadValidation = errors.New("payload validation failed")
 )
 
+// EnvelopeError is returned by ReadNext when the envelope of a message_payload
+// is malformed or not allowed on this connection. It matches ErrProtocol and
+// ErrEnvelope, and Err if set.
+type EnvelopeError struct {
+	StreamID uint64
+	// Payload is the payload of the message's START frame, envelope included,
+	// as received.
+	Payload []byte
+	Reason  string
+	Err     error
+}
+
+func (e *EnvelopeError) Error() string {
+	return fmt.Sprintf("%v: %v: stream %d: %s", ErrProtocol, ErrEnvelope, e.StreamID, e.Reason)
+}
+
+func (e *EnvelopeError) Unwrap() []error {
+	if e.Err != nil {
+		return []error{ErrProtocol, ErrEnvelope, e.Err}
+	}
+	return []error{ErrProtocol, ErrEnvelope}
+}
+
+// VersionMismatchError is returned by ReadNext when a frame carries a version
+// byte other than the one this package speaks, typically because the peer runs
+// a newer or older binary. It matches ErrProtocol and ErrBadVersion. The
+// connection is closed.
+type VersionMismatchError struct {
+	// Received is the version byte of the peer's frame.
+	Received byte
+	// Supported is the version this side speaks.
+	Supported byte
+}
+
+func (e *VersionMismatchError) Error() string {
+	return fmt.Sprintf("%v: %v: peer speaks v%d, we support v%d", ErrProtocol, ErrBadVersion, e.Received, e.Supported)
+}
+
+func (e *VersionMismatchError) Unwrap() []error {
+	return []error{ErrProtocol, ErrBadVersion}
+}
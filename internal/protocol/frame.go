@@ -1,60 +1,158 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 )
 
 const (
-	v1Magic0 byte = 0x53 // 'S'
-	v1Magic1 byte = 0x42 // 'B'
-	v1Version     = 0x01
+	v1Magic0  byte = 0x53 // 'S'
+	v1Magic1  byte = 0x42 // 'B'
+	v1Version      = 0x01
 
 	headerLen = 18
+
+	// envelopeLen is the size of the message_payload envelope (Kind, Format,
+	// Route Hint) carried at the start of the first fragment.
+	envelopeLen = 4
+
+	// padLenLen is the size of the Pad Length field that follows the envelope
+	// in padded messages.
+	padLenLen = 4
 )
 
 type frame struct {
 	typ       Type
-	flags     uint16
+	flags     Flags
 	streamID  uint64
 	payload   []byte
 	payloadLn uint32
 }
 
 func isKnownType(t Type) bool {
-	switch t {
-	case TypeAuthBegin, TypeAuthChallenge, TypeAuthProof, TypeAuthOK, TypeAuthError,
-		TypeMessagePayload,
-		TypePing, TypePong:
-		return true
-	default:
-		return false
-	}
+	_, ok := lookupTypeInfo(t)
+	return ok
 }
 
-func encodeFrameTo(w io.Writer, typ Type, flags uint16, streamID uint64, payload []byte) error {
-	var hdr [headerLen]byte
+// validFlags reports whether flags sets only bits defined for a frame of type
+// typ: START and END, plus PADDED and COMPRESSED on the first frame of a
+// message_payload.
+func validFlags(typ Type, flags Flags) bool {
+	allowed := startEndFlags
+	if typ == TypeMessagePayload && flags.IsStart() {
+		allowed |= flagPadded | flagCompressed
+	}
+	return flags&^allowed == 0
+}
 
+func putHeader(hdr []byte, typ Type, flags Flags, streamID uint64, payloadLen int) {
 	hdr[0] = v1Magic0
 	hdr[1] = v1Magic1
 	hdr[2] = v1Version
 	hdr[3] = byte(typ)
-	binary.BigEndian.PutUint16(hdr[4:6], flags)
+	binary.BigEndian.PutUint16(hdr[4:6], uint16(flags))
 	binary.BigEndian.PutUint64(hdr[6:14], streamID)
-	binary.BigEndian.PutUint32(hdr[14:18], uint32(len(payload)))
+	binary.BigEndian.PutUint32(hdr[14:18], uint32(payloadLen))
+}
+
+func encodeFrameTo(w io.Writer, typ Type, flags Flags, streamID uint64, payload []byte) error {
+	var hdr [headerLen]byte
+	putHeader(hdr[:], typ, flags, streamID, len(payload))
+
+	// On a connection, the header and payload go out in one write, so that a
+	// write timeout sees the frame as a whole.
+	if bw, ok := w.(buffersWriter); ok && len(payload) > 0 {
+		bufs := net.Buffers{hdr[:], payload}
+		if _, err := bw.writeBuffers(&bufs); err != nil {
+			return err
+		}
+	} else {
+		if _, err := w.Write(hdr[:]); err != nil {
+			return err
+		}
+		if len(payload) > 0 {
+			if _, err := w.Write(payload); err != nil {
+				return err
+			}
+		}
+	}
+	if fc, ok := w.(frameCounter); ok {
+		fc.countFrame()
+	}
+	return nil
+}
 
-	if _, err := w.Write(hdr[:]); err != nil {
+// encodeEnvelopeFrameTo writes a message_payload frame whose payload is
+// prefix (the envelope, plus the pad length if padded) followed by data. The
+// header and prefix share one small buffer and data is written as is, without
+// being copied; on a connection the two go out in a single vectored write
+// where the transport supports it.
+func encodeEnvelopeFrameTo(w io.Writer, flags Flags, streamID uint64, prefix, data []byte) error {
+	var head [headerLen + envelopeLen + padLenLen]byte
+	n := headerLen + copy(head[headerLen:], prefix)
+	putHeader(head[:headerLen], TypeMessagePayload, flags, streamID, len(prefix)+len(data))
+
+	bufs := net.Buffers{head[:n]}
+	if len(data) > 0 {
+		bufs = append(bufs, data)
+	}
+	var err error
+	if bw, ok := w.(buffersWriter); ok {
+		_, err = bw.writeBuffers(&bufs)
+	} else {
+		_, err = bufs.WriteTo(w)
+	}
+	if err != nil {
 		return err
 	}
-	if len(payload) == 0 {
-		return nil
+	if fc, ok := w.(frameCounter); ok {
+		fc.countFrame()
 	}
-	_, err := w.Write(payload)
-	return err
+	return nil
 }
 
-func decodeFrameFrom(r io.Reader, maxPayload int) (frame, error) {
+// FrameBytes returns the exact on-wire encoding of a single frame. The encoding
+// is deterministic, which makes it suitable for generating golden vectors to
+// check other implementations against. FrameBytes does not validate its input.
+func FrameBytes(typ Type, flags Flags, streamID uint64, payload []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(headerLen + len(payload))
+	_ = encodeFrameTo(&buf, typ, flags, streamID, payload)
+	return buf.Bytes()
+}
+
+// errSkippedFrame is returned by decodeFrameFrom when an unknown frame type was
+// read and discarded because skipping was requested.
+var errSkippedFrame = errors.New("unknown frame skipped")
+
+// decodeOptions controls the validation performed by decodeFrameFrom.
+type decodeOptions struct {
+	// maxPayload is the payload limit for types without a specific limit.
+	maxPayload int
+	// maxPayloadByType overrides maxPayload for individual frame types.
+	maxPayloadByType map[Type]int
+	// skipUnknown discards unknown frame types instead of failing.
+	skipUnknown bool
+}
+
+func (o decodeOptions) limitFor(t Type) int {
+	if n, ok := o.maxPayloadByType[t]; ok {
+		return n
+	}
+	return o.maxPayload
+}
+
+func decodeFrameFrom(r io.Reader, opts decodeOptions) (frame, error) {
+	// A non-positive limit is a caller bug; converting it to uint32 would wrap
+	// around and disable the size check entirely.
+	if opts.maxPayload <= 0 {
+		return frame{}, fmt.Errorf("invalid max frame payload %d", opts.maxPayload)
+	}
+
 	var hdr [headerLen]byte
 	if _, err := io.ReadFull(r, hdr[:]); err != nil {
 		return frame{}, err
@@ -64,22 +162,33 @@ func decodeFrameFrom(r io.Reader, maxPayload int) (frame, error) {
 		return frame{}, errors.Join(ErrProtocol, ErrBadMagic)
 	}
 	if hdr[2] != v1Version {
-		return frame{}, errors.Join(ErrProtocol, ErrBadVersion)
+		return frame{}, &VersionMismatchError{Received: hdr[2], Supported: v1Version}
 	}
 
 	typ := Type(hdr[3])
+	payloadLn := binary.BigEndian.Uint32(hdr[14:18])
 	if !isKnownType(typ) {
-		return frame{}, errors.Join(ErrProtocol, ErrUnknownType)
+		if !opts.skipUnknown {
+			return frame{}, errors.Join(ErrProtocol, ErrUnknownType)
+		}
+		// The payload is length-prefixed, so an unknown frame can be
+		// discarded without understanding it (its flags included).
+		if int64(payloadLn) > int64(opts.maxPayload) {
+			return frame{}, errors.Join(ErrProtocol, ErrFrameTooLarge)
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(payloadLn)); err != nil {
+			return frame{}, truncated(err)
+		}
+		return frame{}, errSkippedFrame
 	}
 
-	flags := binary.BigEndian.Uint16(hdr[4:6])
-	if flags&^(flagStart|flagEnd) != 0 {
+	flags := Flags(binary.BigEndian.Uint16(hdr[4:6]))
+	if !validFlags(typ, flags) {
 		return frame{}, errors.Join(ErrProtocol, ErrInvalidFlags)
 	}
 
 	streamID := binary.BigEndian.Uint64(hdr[6:14])
-	payloadLn := binary.BigEndian.Uint32(hdr[14:18])
-	if payloadLn > uint32(maxPayload) {
+	if int64(payloadLn) > int64(opts.limitFor(typ)) {
 		return frame{}, errors.Join(ErrProtocol, ErrFrameTooLarge)
 	}
 
@@ -87,7 +196,7 @@ func decodeFrameFrom(r io.Reader, maxPayload int) (frame, error) {
 	if payloadLn > 0 {
 		payload = make([]byte, payloadLn)
 		if _, err := io.ReadFull(r, payload); err != nil {
-			return frame{}, err
+			return frame{}, truncated(err)
 		}
 	}
 
@@ -100,3 +209,12 @@ func decodeFrameFrom(r io.Reader, maxPayload int) (frame, error) {
 	}, nil
 }
 
+// truncated maps io.EOF while reading a payload to io.ErrUnexpectedEOF: the
+// header has been read, so the stream ended inside a frame even if not a
+// single payload byte arrived.
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,327 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// hugeFrameHeader returns a valid header announcing a payload of n bytes with
+// no payload bytes following it.
+func hugeFrameHeader(n uint32) []byte {
+	hdr := make([]byte, headerLen)
+	hdr[0], hdr[1], hdr[2], hdr[3] = v1Magic0, v1Magic1, v1Version, byte(TypeMessagePayload)
+	binary.BigEndian.PutUint16(hdr[4:6], uint16(startEndFlags))
+	binary.BigEndian.PutUint64(hdr[6:14], 1)
+	binary.BigEndian.PutUint32(hdr[14:18], n)
+	return hdr
+}
+
+func TestDecodeRejectsNonPositiveMaxPayload(t *testing.T) {
+	for _, max := range []int{0, -1, -1 << 40} {
+		_, err := decodeFrameFrom(bytes.NewReader(hugeFrameHeader(1<<31)), decodeOptions{maxPayload: max})
+		if err == nil {
+			t.Fatalf("max=%d: expected error", max)
+		}
+		if errors.Is(err, ErrProtocol) {
+			t.Fatalf("max=%d: caller bug reported as a peer protocol error: %v", max, err)
+		}
+	}
+}
+
+func TestDecodeLargeMaxPayloadDoesNotWrap(t *testing.T) {
+	// 1<<32+1 truncates to 1 as a uint32; the limit must still be honored as a
+	// huge value, so a 2-byte payload is accepted.
+	if strconv.IntSize < 64 {
+		t.Skip("requires 64-bit int")
+	}
+	shift := 32
+	var buf bytes.Buffer
+	if err := encodeFrameTo(&buf, TypeAuthBegin, startEndFlags, 0, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	fr, err := decodeFrameFrom(&buf, decodeOptions{maxPayload: 1<<shift + 1})
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if string(fr.payload) != "{}" {
+		t.Fatalf("payload mismatch: %q", fr.payload)
+	}
+}
+
+func TestDecodeRejectsOversizedFrameBeforeAllocating(t *testing.T) {
+	_, err := decodeFrameFrom(bytes.NewReader(hugeFrameHeader(1<<31)), decodeOptions{maxPayload: 1024})
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+	}
+}
+
+// Golden interop vectors. The hex strings are the normative on-wire bytes;
+// other implementations can be certified against them.
+var goldenFrames = []struct {
+	name     string
+	typ      Type
+	flags    Flags
+	streamID uint64
+	payload  []byte
+	hex      string
+}{
+	{"ping", TypePing, startEndFlags, 0, nil,
+		"534201fe0003000000000000000000000000"},
+	{"auth_begin", TypeAuthBegin, startEndFlags, 0, []byte(`{"type":"auth_begin"}`),
+		"5342010100030000000000000000000000157b2274797065223a22617574685f626567696e227d"},
+	{"message_payload oneway", TypeMessagePayload, startEndFlags, 7, []byte{0x03, 0x00, 0x00, 0x00, 'h', 'i'},
+		"534201100003000000000000000700000006030000006869"},
+}
+
+// goldenFragmented is "hello, tunnel world" sent as a request on stream 42
+// with 8-byte frames: START (envelope + 4 bytes), middle, END.
+var goldenFragmented = []string{
+	"534201100001000000000000002a000000080100000068656c6c",
+	"534201100000000000000000002a000000086f2c2074756e6e65",
+	"534201100002000000000000002a000000076c20776f726c64",
+}
+
+func TestFrameBytesGoldenVectors(t *testing.T) {
+	for _, g := range goldenFrames {
+		if got := hex.EncodeToString(FrameBytes(g.typ, g.flags, g.streamID, g.payload)); got != g.hex {
+			t.Errorf("%s:\n got %s\nwant %s", g.name, got, g.hex)
+		}
+	}
+}
+
+func TestFrameBytesGoldenFragmentedMessage(t *testing.T) {
+	c := New(nil, WithMaxFramePayloadBytes(8))
+	var buf bytes.Buffer
+	err := c.writeMessage(&buf, Message{
+		Type:     TypeMessagePayload,
+		StreamID: 42,
+		Kind:     PayloadKindRequest,
+		Data:     []byte("hello, tunnel world"),
+	})
+	if err != nil {
+		t.Fatalf("writeMessage: %v", err)
+	}
+	if got, want := hex.EncodeToString(buf.Bytes()), strings.Join(goldenFragmented, ""); got != want {
+		t.Fatalf("fragmented message:\n got %s\nwant %s", got, want)
+	}
+
+	// Each vector decodes back to one frame of the START/middle/END sequence.
+	wantFlags := []Flags{FlagStart, 0, FlagEnd}
+	for i, h := range goldenFragmented {
+		b, _ := hex.DecodeString(h)
+		fr, err := decodeFrameFrom(bytes.NewReader(b), decodeOptions{maxPayload: 8})
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if fr.flags != wantFlags[i] || fr.streamID != 42 {
+			t.Fatalf("frame %d: flags=%d stream=%d", i, fr.flags, fr.streamID)
+		}
+	}
+}
+
+// TestDecodeOneByteReads feeds the decoder through a reader that returns one
+// byte per Read, as some TLS middleboxes deliver data, covering header and
+// payload reassembly, empty payloads and skipped unknown frames.
+func TestDecodeOneByteReads(t *testing.T) {
+	var wire bytes.Buffer
+	for _, g := range goldenFrames {
+		b, _ := hex.DecodeString(g.hex)
+		wire.Write(b)
+	}
+	unknown := FrameBytes(Type(0x7f), startEndFlags, 0, []byte("skip me"))
+	wire.Write(unknown)
+	for _, h := range goldenFragmented {
+		b, _ := hex.DecodeString(h)
+		wire.Write(b)
+	}
+
+	r := iotest.OneByteReader(&wire)
+	opts := decodeOptions{maxPayload: 64, skipUnknown: true}
+	for _, g := range goldenFrames {
+		fr, err := decodeFrameFrom(r, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", g.name, err)
+		}
+		if fr.typ != g.typ || fr.flags != g.flags || fr.streamID != g.streamID || !bytes.Equal(fr.payload, g.payload) {
+			t.Fatalf("%s: got %+v", g.name, fr)
+		}
+		if int(fr.payloadLn) != len(g.payload) {
+			t.Fatalf("%s: payloadLn=%d want %d", g.name, fr.payloadLn, len(g.payload))
+		}
+	}
+	if _, err := decodeFrameFrom(r, opts); !errors.Is(err, errSkippedFrame) {
+		t.Fatalf("unknown frame: got %v want errSkippedFrame", err)
+	}
+	var payload []byte
+	for i := range goldenFragmented {
+		fr, err := decodeFrameFrom(r, opts)
+		if err != nil {
+			t.Fatalf("fragment %d: %v", i, err)
+		}
+		payload = append(payload, fr.payload...)
+	}
+	if got := string(payload[envelopeLen:]); got != "hello, tunnel world" {
+		t.Fatalf("reassembled %q", got)
+	}
+	if _, err := decodeFrameFrom(r, opts); err != io.EOF {
+		t.Fatalf("after last frame: got %v want io.EOF", err)
+	}
+}
+
+func TestDecodeOneByteReadsTruncated(t *testing.T) {
+	b, _ := hex.DecodeString(goldenFrames[1].hex)
+	unknown := FrameBytes(Type(0x7f), startEndFlags, 0, []byte("skip me"))
+	for _, tc := range []struct {
+		wire []byte
+		cut  int
+	}{
+		{b, 1}, {b, headerLen - 1}, {b, headerLen}, {b, len(b) - 1},
+		{unknown, headerLen}, {unknown, len(unknown) - 1},
+	} {
+		r := iotest.OneByteReader(bytes.NewReader(tc.wire[:tc.cut]))
+		_, err := decodeFrameFrom(r, decodeOptions{maxPayload: 64, skipUnknown: true})
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("cut at %d: got %v want io.ErrUnexpectedEOF", tc.cut, err)
+		}
+	}
+}
+
+// oneByteRWC delivers its input to a Conn one byte per Read.
+type oneByteRWC struct {
+	io.Reader
+	io.Writer
+}
+
+func (oneByteRWC) Close() error { return nil }
+
+func TestReadNextOneByteReads(t *testing.T) {
+	var wire bytes.Buffer
+	for _, h := range append([]string{goldenFrames[0].hex}, goldenFragmented...) {
+		b, _ := hex.DecodeString(h)
+		wire.Write(b)
+	}
+	// An empty oneway message: START|END frame carrying only the envelope.
+	wire.Write(FrameBytes(TypeMessagePayload, startEndFlags, 9, []byte{byte(PayloadKindOneway), 0, 0, 0}))
+
+	c := NewRWC(oneByteRWC{iotest.OneByteReader(&wire), io.Discard}, WithMaxFramePayloadBytes(8), WithAutoPong(false))
+	ctx := context.Background()
+
+	msg, err := c.ReadNext(ctx)
+	if err != nil || msg.Type != TypePing {
+		t.Fatalf("ping: got %+v, %v", msg, err)
+	}
+	msg, err = c.ReadNext(ctx)
+	if err != nil {
+		t.Fatalf("fragmented message: %v", err)
+	}
+	if msg.StreamID != 42 || msg.Kind != PayloadKindRequest || string(msg.Data) != "hello, tunnel world" {
+		t.Fatalf("fragmented message: got %+v", msg)
+	}
+	msg, err = c.ReadNext(ctx)
+	if err != nil {
+		t.Fatalf("empty message: %v", err)
+	}
+	if msg.StreamID != 9 || msg.Kind != PayloadKindOneway || len(msg.Data) != 0 {
+		t.Fatalf("empty message: got %+v", msg)
+	}
+}
+
+func TestReadNextVersionMismatch(t *testing.T) {
+	wire := FrameBytes(TypePing, startEndFlags, 0, nil)
+	wire[2] = 0x02
+	c := NewRWC(oneByteRWC{bytes.NewReader(wire), io.Discard})
+
+	_, err := c.ReadNext(context.Background())
+	var vErr *VersionMismatchError
+	if !errors.As(err, &vErr) || !errors.Is(err, ErrBadVersion) || !errors.Is(err, ErrProtocol) {
+		t.Fatalf("got %v want *VersionMismatchError", err)
+	}
+	if vErr.Received != 0x02 || vErr.Supported != v1Version {
+		t.Fatalf("got %+v", vErr)
+	}
+	if !strings.Contains(err.Error(), "peer speaks v2, we support v1") {
+		t.Fatalf("message %q", err)
+	}
+	if !c.State().Closed {
+		t.Fatalf("connection not closed after version mismatch")
+	}
+}
+
+func TestFlagsPredicates(t *testing.T) {
+	for _, tc := range []struct {
+		flags                Flags
+		start, end, complete bool
+	}{
+		{0, false, false, false},
+		{FlagStart, true, false, false},
+		{FlagEnd, false, true, false},
+		{FlagStart | FlagEnd, true, true, true},
+		{FlagStart | flagPadded, true, false, false},
+		{FlagStart | FlagEnd | flagPadded, true, true, true},
+	} {
+		if got := tc.flags.IsStart(); got != tc.start {
+			t.Errorf("%#x.IsStart() = %v", tc.flags, got)
+		}
+		if got := tc.flags.IsEnd(); got != tc.end {
+			t.Errorf("%#x.IsEnd() = %v", tc.flags, got)
+		}
+		if got := tc.flags.IsComplete(); got != tc.complete {
+			t.Errorf("%#x.IsComplete() = %v", tc.flags, got)
+		}
+	}
+}
+
+func TestDecodeEnvelope(t *testing.T) {
+	want := Envelope{Kind: PayloadKindResponse, Format: PayloadFormatHeaders, RouteHint: 0xBEEF}
+	enc := want.Encode()
+	if !bytes.Equal(enc, []byte{0x02, 0x02, 0xBE, 0xEF}) {
+		t.Fatalf("Encode() = %x", enc)
+	}
+	got, rest, err := DecodeEnvelope(append(enc, "body"...))
+	if err != nil {
+		t.Fatalf("DecodeEnvelope: %v", err)
+	}
+	if got != want || string(rest) != "body" {
+		t.Fatalf("got %+v, rest %q", got, rest)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		reason  string
+	}{
+		{"empty", nil, "payload of 0 bytes too short for envelope"},
+		{"short", []byte{0x01, 0x00, 0x00}, "payload of 3 bytes too short for envelope"},
+		{"zero kind", []byte{0x00, 0x00, 0x00, 0x00}, "unsupported payload kind 0"},
+		{"unknown kind", []byte{0x04, 0x00, 0x00, 0x00}, "unsupported payload kind 4"},
+		{"unknown format", []byte{0x01, 0x03, 0x00, 0x00}, "unsupported payload format 3"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := DecodeEnvelope(tc.payload)
+			var envErr *EnvelopeError
+			if !errors.As(err, &envErr) || !errors.Is(err, ErrEnvelope) || !errors.Is(err, ErrProtocol) {
+				t.Fatalf("got %v want *EnvelopeError", err)
+			}
+			if envErr.Reason != tc.reason {
+				t.Fatalf("reason %q want %q", envErr.Reason, tc.reason)
+			}
+		})
+	}
+
+	// The route hint took the place of the v1 reserved bytes: every value is
+	// valid.
+	for _, hint := range []uint16{0, 1, 0xFFFF} {
+		e := Envelope{Kind: PayloadKindOneway, RouteHint: hint}
+		if got, _, err := DecodeEnvelope(e.Encode()); err != nil || got != e {
+			t.Fatalf("route hint %#x: got %+v, %v", hint, got, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+const (
+	// headerBlockLenLen is the size of the Header Block Length field that
+	// starts the Data of a PayloadFormatHeaders message.
+	headerBlockLenLen = 2
+
+	// maxHeaderBlockLen bounds the encoded header block, so headers stay
+	// small metadata and a peer cannot make the receiver build a large map.
+	maxHeaderBlockLen = 8 << 10
+
+	// maxHeaders bounds the number of headers per message.
+	maxHeaders = 64
+)
+
+// headerBlockLen validates h and returns the size of its encoded block, not
+// counting the Header Block Length field.
+func headerBlockLen(h map[string]string) (int, error) {
+	if len(h) > maxHeaders {
+		return 0, fmt.Errorf("%w: %w: %d headers exceed limit %d", ErrProtocol, ErrHeaders, len(h), maxHeaders)
+	}
+	n := 0
+	for k, v := range h {
+		if k == "" || len(k) > 0xff {
+			return 0, fmt.Errorf("%w: %w: header name length %d out of range", ErrProtocol, ErrHeaders, len(k))
+		}
+		n += 1 + len(k) + 2 + len(v)
+	}
+	if n > maxHeaderBlockLen {
+		return 0, fmt.Errorf("%w: %w: header block of %d bytes exceeds limit %d", ErrProtocol, ErrHeaders, n, maxHeaderBlockLen)
+	}
+	return n, nil
+}
+
+// withHeaders returns the Data of a PayloadFormatHeaders message: the encoded
+// header block of h followed by body. Headers are written in key order so the
+// encoding is deterministic.
+func withHeaders(h map[string]string, body []byte) ([]byte, error) {
+	n, err := headerBlockLen(h)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, headerBlockLenLen+n+len(body))
+	data = binary.BigEndian.AppendUint16(data, uint16(n))
+	for _, k := range slices.Sorted(maps.Keys(h)) {
+		data = append(data, byte(len(k)))
+		data = append(data, k...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(h[k])))
+		data = append(data, h[k]...)
+	}
+	return append(data, body...), nil
+}
+
+// splitHeaders parses the header block at the start of data and returns the
+// headers and the body that follows. Errors describe the malformation only;
+// the caller wraps them.
+func splitHeaders(data []byte) (map[string]string, []byte, error) {
+	if len(data) < headerBlockLenLen {
+		return nil, nil, errors.New("missing header block length")
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if n > maxHeaderBlockLen || n > len(data)-headerBlockLenLen {
+		return nil, nil, fmt.Errorf("header block length %d out of range", n)
+	}
+	block, body := data[headerBlockLenLen:headerBlockLenLen+n], data[headerBlockLenLen+n:]
+
+	var h map[string]string
+	for len(block) > 0 {
+		kl := int(block[0])
+		if kl == 0 || len(block) < 1+kl+2 {
+			return nil, nil, errors.New("truncated header")
+		}
+		k := string(block[1 : 1+kl])
+		block = block[1+kl:]
+		vl := int(binary.BigEndian.Uint16(block))
+		if len(block) < 2+vl {
+			return nil, nil, fmt.Errorf("truncated header %q", k)
+		}
+		if h == nil {
+			h = make(map[string]string)
+		}
+		if _, dup := h[k]; dup {
+			return nil, nil, fmt.Errorf("duplicate header %q", k)
+		}
+		if len(h) == maxHeaders {
+			return nil, nil, fmt.Errorf("more than %d headers", maxHeaders)
+		}
+		h[k] = string(block[2 : 2+vl])
+		block = block[2+vl:]
+	}
+	return h, body, nil
+}
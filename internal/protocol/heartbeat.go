@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RunAppHeartbeat sends an application heartbeat, a PayloadKindOneway
+// message_payload on streamID carrying payload(), every interval until ctx is
+// done or a Send fails. payload is called for each heartbeat, so it can report
+// current state such as a queue depth; a nil payload sends empty heartbeats.
+//
+// Unlike RunKeepAlive's pings, heartbeats are ordinary messages that the
+// peer's application reads. They go through Send and so take turns with other
+// writers; a heartbeat waiting behind a long message is sent late, and ticks
+// missed meanwhile are dropped rather than sent in a burst.
+//
+// RunAppHeartbeat returns ctx.Err() when ctx is done and the Send error
+// otherwise.
+func RunAppHeartbeat(ctx context.Context, c *Conn, streamID uint64, interval time.Duration, payload func() []byte) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if interval <= 0 {
+		return fmt.Errorf("invalid heartbeat interval %s", interval)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		msg := Message{Type: TypeMessagePayload, StreamID: streamID, Kind: PayloadKindOneway}
+		if payload != nil {
+			msg.Data = payload()
+		}
+		if err := c.Send(ctx, msg); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// RunKeepAlive pings the peer every interval until ctx is done or the
+// connection fails. After each ping, some frame must arrive within
+// pongTimeout, or RunKeepAlive closes the connection and returns
+// ErrKeepAliveTimeout. Any frame counts, not only the pong, so a busy
+// connection is never declared dead.
+//
+// RunKeepAlive only writes: frames are observed through the caller's own
+// reads, so a ReadNext loop or Reader must run concurrently, and the peer must
+// answer pings (see WithAutoPong).
+//
+// With WithKeepAliveJitter, each interval is drawn from
+// interval ± fraction·interval. The pong wait is part of the interval, so
+// pongTimeout should stay below the shortest jittered interval,
+// interval·(1-fraction); a longer pongTimeout spaces pings pongTimeout apart
+// instead and the jitter no longer spreads them.
+//
+// interval and pongTimeout must be positive.
+func (c *Conn) RunKeepAlive(ctx context.Context, interval, pongTimeout time.Duration) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if interval <= 0 {
+		return fmt.Errorf("invalid keepalive interval %s", interval)
+	}
+	if pongTimeout <= 0 {
+		return fmt.Errorf("invalid keepalive pong timeout %s", pongTimeout)
+	}
+
+	timer := time.NewTimer(c.keepAliveInterval(interval))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		next := c.keepAliveInterval(interval)
+		received := c.framesReceived.Load()
+		if err := c.Send(ctx, Message{Type: TypePing}); err != nil {
+			return err
+		}
+
+		timer.Reset(pongTimeout)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if c.framesReceived.Load() == received {
+			_ = c.Close()
+			return ErrKeepAliveTimeout
+		}
+		timer.Reset(max(next-pongTimeout, 0))
+	}
+}
+
+// keepAliveInterval returns interval with the WithKeepAliveJitter jitter
+// applied.
+func (c *Conn) keepAliveInterval(interval time.Duration) time.Duration {
+	if c.keepAliveJitter == 0 {
+		return interval
+	}
+	// Uniform in [-jitter, +jitter).
+	offset := (2*rand.Float64() - 1) * c.keepAliveJitter
+	return time.Duration(float64(interval) * (1 + offset))
+}
@@ -0,0 +1,372 @@
+package protocol
+
+import (
+	"slices"
+	"time"
+)
+
+type Option func(*Conn)
+
+func WithMaxFramePayloadBytes(n int) Option {
+	return func(c *Conn) {
+		if n > 0 {
+			c.maxFramePayload = n
+		}
+	}
+}
+
+// WithMaxPayloadForType sets the largest frame payload accepted for frames of
+// type t, overriding the global limit from WithMaxFramePayloadBytes for that
+// type only. Auth frames, for instance, can be capped at a few KiB while
+// message payloads keep a large limit.
+func WithMaxPayloadForType(t Type, n int) Option {
+	return func(c *Conn) {
+		if n <= 0 {
+			return
+		}
+		if c.maxPayloadByType == nil {
+			c.maxPayloadByType = make(map[Type]int)
+		}
+		c.maxPayloadByType[t] = n
+	}
+}
+
+// WithReadIdleTimeout bounds how long ReadNext waits for each individual frame,
+// including every continuation fragment of a reassembled message. The
+// effective deadline is the earlier of the context deadline and now+d.
+func WithReadIdleTimeout(d time.Duration) Option {
+	return func(c *Conn) {
+		if d > 0 {
+			c.readIdleTimeout = d
+		}
+	}
+}
+
+// WithDefaultReadTimeout bounds every ReadNext and ReadRawFrame call whose
+// context has no deadline to d, so that even ReadNext(context.Background())
+// cannot block forever; the call then fails with context.DeadlineExceeded. A
+// context deadline takes precedence, whether earlier or later. The bound
+// covers the whole call, including a wait in PauseReads, and applies to the
+// reads of Reader too, so an idle connection ends a Reader loop.
+//
+// Unlike WithReadIdleTimeout, which restarts for every frame, the default
+// timeout limits the wait for one complete message.
+func WithDefaultReadTimeout(d time.Duration) Option {
+	return func(c *Conn) {
+		if d > 0 {
+			c.defaultReadTimeout = d
+		}
+	}
+}
+
+// WithDefaultWriteTimeout bounds every Send, SendBatch and WriteRawFrame call
+// whose context has no deadline to d, like WithDefaultReadTimeout does for
+// reads. It also covers helpers built on Send, such as ResetStream,
+// CloseWithError and RunKeepAlive's pings, but not SendStream and
+// ResumeStream, whose duration depends on their reader; bound their frame
+// writes with WithWriteTimeout.
+func WithDefaultWriteTimeout(d time.Duration) Option {
+	return func(c *Conn) {
+		if d > 0 {
+			c.defaultWriteTimeout = d
+		}
+	}
+}
+
+// WithReassemblyTimeout bounds the total time from the START frame to the END
+// frame of a fragmented message. Unlike WithReadIdleTimeout, which a peer can
+// defeat by trickling fragments just often enough, it caps how long a single
+// message can hold the reader. When exceeded, ReadNext closes the connection
+// and returns ErrReassemblyTimeout.
+func WithReassemblyTimeout(d time.Duration) Option {
+	return func(c *Conn) {
+		if d > 0 {
+			c.reassemblyTimeout = d
+		}
+	}
+}
+
+// WithMaxEmptyFragments sets how many consecutive empty continuation frames,
+// carrying neither data nor END, a message may have. A peer sending more is
+// spinning the reader without making progress; ReadNext closes the
+// connection and returns ErrEmptyFragmentFlood. Senders have no reason to
+// emit such frames, so the default of 32 only guards against abuse.
+// Non-positive values are ignored.
+func WithMaxEmptyFragments(n int) Option {
+	return func(c *Conn) {
+		if n > 0 {
+			c.maxEmptyFragments = n
+		}
+	}
+}
+
+// WithWriteTimeout bounds each individual write to the transport, so a
+// stalled peer is detected within d even when the context passed to Send has
+// a distant deadline or none. Fragmented messages get a fresh d per frame,
+// while a SendBatch is a single write. The effective deadline is the earlier
+// of the context deadline and now+d. It is the write-side counterpart of
+// WithReadIdleTimeout.
+//
+// If d expires after part of a frame was written, the peer is left waiting
+// for the rest of it and can no longer find the next frame, so the write
+// method closes the connection as well as returning the timeout. A timeout
+// before any byte of the frame went out leaves the connection usable.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(c *Conn) {
+		if d > 0 {
+			c.writeTimeout = d
+		}
+	}
+}
+
+// WithWriteStallTimeout detects a peer that stopped reading: if writing a
+// single frame to the transport takes longer than d, the write method fails
+// with ErrWriteStall and the connection is closed, since the frame was cut
+// short. Unlike a context deadline, which bounds a whole call however much
+// progress it makes, d bounds each frame, so a large message to a slow but
+// live peer is not affected as long as every frame gets through within d.
+// Timeouts from the context or WithWriteTimeout are reported as before.
+func WithWriteStallTimeout(d time.Duration) Option {
+	return func(c *Conn) {
+		if d > 0 {
+			c.writeStallTimeout = d
+		}
+	}
+}
+
+// WithSkipUnknownFrames makes ReadNext discard frames of unknown types instead
+// of treating them as a fatal protocol error. This lets peers introduce new
+// frame types without breaking older receivers. The default is strict.
+func WithSkipUnknownFrames(skip bool) Option {
+	return func(c *Conn) {
+		c.skipUnknown = skip
+	}
+}
+
+// WithForceCloseOnCancel makes ReadNext close the connection when its context
+// is cancelled but the blocked read does not return shortly afterwards.
+//
+// Cancellation normally works by moving the read deadline into the past, which
+// is a no-op on transports that ignore deadlines: custom net.Conn adapters over
+// an io.ReadWriteCloser (WebSocket wrappers, some in-process pipes). Such
+// transports need this option for cancellation to take effect. It is opt-in
+// because closing is destructive: the Conn is unusable afterwards.
+func WithForceCloseOnCancel(force bool) Option {
+	return func(c *Conn) {
+		c.forceCloseOnCancel = force
+	}
+}
+
+// WithKeepOpenOnEnvelopeError keeps the connection open when ReadNext rejects
+// a message_payload envelope, e.g. for a diagnostic proxy that logs malformed
+// messages and carries on. ReadNext returns an *EnvelopeError carrying the
+// offending bytes; if the message was fragmented, its remaining fragments are
+// read and discarded first, so the next ReadNext starts at a message boundary.
+//
+// Only envelope errors are covered: a frame that breaks the framing itself
+// (bad header, oversized frame, fragmentation error) still closes the
+// connection, since the position of the next frame is then unknown.
+func WithKeepOpenOnEnvelopeError(keep bool) Option {
+	return func(c *Conn) {
+		c.keepOpenOnEnvelope = keep
+	}
+}
+
+// WithPayloadValidator registers fn to check the reassembled Data of every
+// message_payload received with the given format. When fn returns an error,
+// ReadNext returns it wrapped in ErrPayloadValidation instead of the message.
+// A typical use is rejecting malformed JSON:
+//
+//	protocol.WithPayloadValidator(protocol.PayloadFormatJSON, func(b []byte) error {
+//		if !json.Valid(b) {
+//			return errors.New("invalid JSON")
+//		}
+//		return nil
+//	})
+func WithPayloadValidator(format PayloadFormat, fn func([]byte) error) Option {
+	return func(c *Conn) {
+		if fn == nil {
+			return
+		}
+		if c.validators == nil {
+			c.validators = make(map[PayloadFormat]func([]byte) error)
+		}
+		c.validators[format] = fn
+	}
+}
+
+// WithRequireAuthFirst makes ReadNext, ReadRawFrame and DrainMessage reject
+// every frame other than the auth handshake frames until MarkAuthenticated is
+// called. A violating frame closes the connection and the read returns
+// ErrUnauthenticated. This keeps a
+// server from acting on traffic from a peer that skipped authentication.
+func WithRequireAuthFirst(require bool) Option {
+	return func(c *Conn) {
+		c.requireAuthFirst = require
+	}
+}
+
+// WithAutoPong makes Reader answer every received ping with a pong.
+func WithAutoPong(auto bool) Option {
+	return func(c *Conn) {
+		c.autoPong = auto
+	}
+}
+
+// WithAllowedPayloadKinds restricts the message_payload kinds this connection
+// may carry, e.g. only PayloadKindRequest and PayloadKindResponse on an RPC
+// connection. Send rejects other kinds with ErrDisallowedKind; ReadNext
+// rejects them as a protocol violation and closes the connection. By default
+// all kinds are allowed.
+func WithAllowedPayloadKinds(kinds ...PayloadKind) Option {
+	return func(c *Conn) {
+		c.allowedKinds = make(map[PayloadKind]bool, len(kinds))
+		for _, k := range kinds {
+			c.allowedKinds[k] = true
+		}
+	}
+}
+
+// WithUnfragmentedAuth requires every auth handshake message to fit in a
+// single START|END frame. ReadNext rejects the first frame of a multi-frame
+// auth message with ErrAuthFragmented and closes the connection, instead of
+// waiting for the remaining fragments; Send rejects auth payloads that would
+// need fragmenting. Auth messages are small, so this only removes attack
+// surface from the unauthenticated phase.
+func WithUnfragmentedAuth(require bool) Option {
+	return func(c *Conn) {
+		c.unfragmentedAuth = require
+	}
+}
+
+// WithDefaultPayloadFormat sets the format Send uses for message_payload
+// messages whose Format is zero, so a connection that always speaks JSON does
+// not need Format set on every message. Unknown formats are ignored.
+//
+// PayloadFormatOpaqueBytes is itself zero, so with a non-opaque default a
+// message can no longer ask for opaque bytes explicitly.
+func WithDefaultPayloadFormat(f PayloadFormat) Option {
+	return func(c *Conn) {
+		if isKnownFormat(f) {
+			c.defaultFormat = f
+		}
+	}
+}
+
+// WithWriteCoalesce makes Send buffer oneway message_payload messages and
+// write them together once window has passed since the first one was
+// buffered, or as soon as 64 KiB are buffered. Under bursty oneway traffic
+// this trades up to window of latency for far fewer writes. Every other
+// message, including requests and responses, is written immediately, after
+// any buffered frames so that ordering is kept.
+//
+// A buffered Send returns before its message reaches the wire and cannot
+// report write errors: if a background flush fails, the connection is closed
+// and later calls return ErrConnClosed. A background flush that cannot write
+// within the longer of window and one second, because the peer stopped
+// reading, fails the same way; later calls wait for it meanwhile. Close
+// flushes buffered messages first unless a write is blocked at that moment.
+func WithWriteCoalesce(window time.Duration) Option {
+	return func(c *Conn) {
+		if window > 0 {
+			c.coalesceWindow = window
+		}
+	}
+}
+
+// WithPadding makes Send pad the Data of every message_payload with zero bytes
+// up to the smallest of buckets that fits it, so that message sizes on the
+// wire only reveal the bucket. Data larger than every bucket is padded to a
+// multiple of the largest one. ReadNext strips the padding.
+//
+// Padded messages set a flag that receivers without padding support reject
+// as a protocol error, so only enable it when the peer supports padding. With
+// padding off the wire format is unchanged. Non-positive buckets are ignored.
+func WithPadding(buckets []int) Option {
+	return func(c *Conn) {
+		var valid []int
+		for _, b := range buckets {
+			if b > 0 {
+				valid = append(valid, b)
+			}
+		}
+		slices.Sort(valid)
+		c.padBuckets = slices.Compact(valid)
+	}
+}
+
+// WithCompressionDictionary makes Send compress the Data of a message_payload
+// that would otherwise be fragmented, using zlib with dict as the preset
+// dictionary; smaller messages, and messages that do not shrink, are sent as
+// is. ReadNext decompresses messages with dict as well. A dictionary of
+// samples typical of the traffic, e.g. common JSON keys and values, makes even
+// moderately sized messages compress well. A nil dict compresses without one.
+//
+// Compressed messages set a flag that receivers without compression support
+// reject as a protocol error, so only enable it when the peer supports
+// compression. Both peers must use the same dict: a message compressed with
+// another dictionary fails ReadNext with ErrCompressionDictionary. SendStream
+// never compresses. dict is not copied and must not be modified afterwards.
+func WithCompressionDictionary(dict []byte) Option {
+	return func(c *Conn) {
+		c.compress = true
+		c.compressDict = dict
+	}
+}
+
+// WithKeepAliveJitter randomizes each RunKeepAlive interval within
+// ±fraction of its nominal value, so that many connections established at
+// once do not keep pinging the server in lockstep. fraction is clamped to
+// [0, 1); 0 disables jitter.
+func WithKeepAliveJitter(fraction float64) Option {
+	return func(c *Conn) {
+		c.keepAliveJitter = 0
+		if fraction > 0 {
+			c.keepAliveJitter = min(fraction, 0.99)
+		}
+	}
+}
+
+// WithFrameObserver calls fn for every frame read, with its header fields and
+// payload length, as it arrives and before any reassembly, e.g. to build
+// per-type frame size histograms. fn runs on the reading goroutine and must
+// not block or call back into the Conn's read methods.
+func WithFrameObserver(fn func(FrameInfo)) Option {
+	return func(c *Conn) {
+		c.frameObserver = fn
+	}
+}
+
+// WithControlHandler diverts control messages from ReadNext to fn, so that a
+// read loop only interested in data sees message_payload and the other types
+// it did not divert. types selects the diverted types among TypePing,
+// TypePong and the auth types (to observe re-authentication traffic); other
+// types are ignored, and no types means TypePing and TypePong.
+//
+// fn is called synchronously from ReadNext, on the reading goroutine, for
+// each diverted message in arrival order, before ReadNext returns any message
+// received after it: relative to data, control messages are seen in exactly
+// the order they were read. fn must not block or call back into the Conn's
+// read methods; it may Send, e.g. to answer a ping, since WithAutoPong only
+// applies to pings that reach Reader.
+//
+// Do not divert auth types before the handshake has completed: the auth
+// package reads them with ReadNext.
+func WithControlHandler(fn func(Message), types ...Type) Option {
+	return func(c *Conn) {
+		if fn == nil {
+			c.controlHandler, c.controlTypes = nil, nil
+			return
+		}
+		if len(types) == 0 {
+			types = []Type{TypePing, TypePong}
+		}
+		c.controlHandler = fn
+		c.controlTypes = make(map[Type]bool, len(types))
+		for _, t := range types {
+			if t == TypePing || t == TypePong || isAuthType(t) {
+				c.controlTypes[t] = true
+			}
+		}
+	}
+}
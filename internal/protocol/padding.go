@@ -0,0 +1,34 @@
+package protocol
+
+// paddedLen returns the length n is padded to: the smallest bucket >= n, or
+// else the next multiple of the largest bucket. buckets is sorted ascending.
+func paddedLen(n int, buckets []int) int {
+	for _, b := range buckets {
+		if b >= n {
+			return b
+		}
+	}
+	largest := buckets[len(buckets)-1]
+	return (n + largest - 1) / largest * largest
+}
+
+// padData returns data followed by zero bytes up to paddedLen. data is only
+// copied if padding is needed.
+func padData(data []byte, buckets []int) []byte {
+	n := paddedLen(len(data), buckets)
+	if n == len(data) {
+		return data
+	}
+	padded := make([]byte, n)
+	copy(padded, data)
+	return padded
+}
+
+// padLenFieldLen is the size of the Pad Length field this Conn adds after the
+// envelope: padLenLen when padding is enabled, 0 otherwise.
+func (c *Conn) padLenFieldLen() int {
+	if len(c.padBuckets) > 0 {
+		return padLenLen
+	}
+	return 0
+}
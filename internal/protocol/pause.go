@@ -0,0 +1,53 @@
+package protocol
+
+import "context"
+
+// PauseReads makes ReadNext and ReadRawFrame calls block, before reading
+// anything, until ResumeReads is called, their context is done, or the Conn
+// is closed. A read already in progress is not interrupted.
+//
+// While reads are paused nothing drains the transport, so the socket receive
+// buffer fills up and the peer's writes eventually block: TCP flow control
+// carries the backpressure to the sender without closing the connection. A
+// pause therefore also delays pings and their pongs; keep it shorter than any
+// keepalive timeout the peer enforces.
+//
+// Pausing an already paused Conn has no effect.
+func (c *Conn) PauseReads() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.resumed == nil {
+		c.resumed = make(chan struct{})
+	}
+}
+
+// ResumeReads releases reads blocked by PauseReads. Resuming a Conn that is
+// not paused has no effect.
+func (c *Conn) ResumeReads() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.resumed != nil {
+		close(c.resumed)
+		c.resumed = nil
+	}
+}
+
+// waitReadable blocks while reads are paused. It returns ErrConnClosed if the
+// Conn is closed and ctx.Err() if ctx is done first.
+func (c *Conn) waitReadable(ctx context.Context) error {
+	c.pauseMu.Lock()
+	resumed := c.resumed
+	c.pauseMu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+
+	select {
+	case <-resumed:
+		return nil
+	case <-c.done:
+		return ErrConnClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
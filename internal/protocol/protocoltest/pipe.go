@@ -0,0 +1,82 @@
+// Package protocoltest provides transports for testing code built on
+// package protocol under adverse network conditions.
+package protocoltest
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Profile describes the pathologies injected by PipeWithProfile. The zero
+// Profile behaves like net.Pipe.
+type Profile struct {
+	// Latency delays every underlying write, including each piece of a
+	// split write.
+	Latency time.Duration
+
+	// MaxReadSize caps the bytes returned by a single Read, forcing callers
+	// to handle partial reads. Zero means no cap.
+	MaxReadSize int
+
+	// ShortWrites splits every Write into randomly sized pieces that reach
+	// the peer separately. Write still reports the full length on success.
+	ShortWrites bool
+
+	// Seed makes the random write splitting reproducible.
+	Seed int64
+}
+
+// SlowFragmentDelivery returns a profile that delivers data in small pieces
+// with delay between them, so a message spanning several frames arrives
+// fragment by fragment. It is meant to exercise read idle timeouts.
+func SlowFragmentDelivery(delay time.Duration) Profile {
+	return Profile{Latency: delay, MaxReadSize: 64, ShortWrites: true}
+}
+
+// PipeWithProfile returns both ends of a net.Pipe with p applied to each end.
+func PipeWithProfile(p Profile) (net.Conn, net.Conn) {
+	a, b := net.Pipe()
+	return newProfileConn(a, p, p.Seed), newProfileConn(b, p, p.Seed+1)
+}
+
+type profileConn struct {
+	net.Conn
+	p Profile
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newProfileConn(nc net.Conn, p Profile, seed int64) *profileConn {
+	return &profileConn{Conn: nc, p: p, rng: rand.New(rand.NewSource(seed))}
+}
+
+func (c *profileConn) Read(b []byte) (int, error) {
+	if c.p.MaxReadSize > 0 && len(b) > c.p.MaxReadSize {
+		b = b[:c.p.MaxReadSize]
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *profileConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n := len(b) - written
+		if c.p.ShortWrites && n > 1 {
+			c.mu.Lock()
+			n = 1 + c.rng.Intn(n)
+			c.mu.Unlock()
+		}
+		if c.p.Latency > 0 {
+			time.Sleep(c.p.Latency)
+		}
+		m, err := c.Conn.Write(b[written : written+n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,64 @@
+package protocoltest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"switchboard/internal/protocol"
+)
+
+func TestPipeWithProfilePreservesMessages(t *testing.T) {
+	a, b := PipeWithProfile(Profile{MaxReadSize: 3, ShortWrites: true, Seed: 1})
+	defer a.Close()
+	defer b.Close()
+
+	ca := protocol.New(a, protocol.WithMaxFramePayloadBytes(32))
+	cb := protocol.New(b)
+
+	want := bytes.Repeat([]byte("0123456789"), 20)
+	go func() {
+		_ = ca.Send(context.Background(), protocol.Message{
+			Type:     protocol.TypeMessagePayload,
+			StreamID: 1,
+			Kind:     protocol.PayloadKindOneway,
+			Data:     want,
+		})
+	}()
+
+	msg, err := cb.ReadNext(context.Background())
+	if err != nil {
+		t.Fatalf("ReadNext: %v", err)
+	}
+	if !bytes.Equal(msg.Data, want) {
+		t.Fatalf("data mismatch: got %d bytes", len(msg.Data))
+	}
+}
+
+func TestSlowFragmentDeliveryTripsIdleTimeout(t *testing.T) {
+	a, b := PipeWithProfile(SlowFragmentDelivery(50 * time.Millisecond))
+	defer a.Close()
+	defer b.Close()
+
+	ca := protocol.New(a, protocol.WithMaxFramePayloadBytes(16))
+	cb := protocol.New(b, protocol.WithReadIdleTimeout(10*time.Millisecond))
+
+	go func() {
+		_ = ca.Send(context.Background(), protocol.Message{
+			Type:     protocol.TypeMessagePayload,
+			StreamID: 1,
+			Kind:     protocol.PayloadKindOneway,
+			Data:     bytes.Repeat([]byte("x"), 64),
+		})
+	}()
+
+	_, err := cb.ReadNext(context.Background())
+	var ne net.Error
+	if !errors.Is(err, os.ErrDeadlineExceeded) && !(errors.As(err, &ne) && ne.Timeout()) {
+		t.Fatalf("ReadNext: got %v want timeout", err)
+	}
+}
@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+)
+
+// Frame is a single wire frame, exposed for pass-through use cases that must
+// preserve fragmentation boundaries instead of reassembling messages.
+type Frame struct {
+	Type     Type
+	Flags    Flags
+	StreamID uint64
+	Payload  []byte
+}
+
+// ReadRawFrame reads exactly one frame without reassembly or type-specific
+// validation. The header checks (magic, version, known type, flags, size
+// limits) and WithRequireAuthFirst still apply, and violations close the
+// connection as in ReadNext.
+//
+// Mixing ReadRawFrame and ReadNext on the same Conn is the caller's
+// responsibility: switching in the middle of a fragmented message makes
+// ReadNext reject the remaining fragments.
+func (c *Conn) ReadRawFrame(ctx context.Context) (Frame, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := withDefaultTimeout(ctx, c.defaultReadTimeout)
+	defer cancel()
+
+	if c.closed.Load() {
+		return Frame{}, ErrConnClosed
+	}
+	if err := c.waitReadable(ctx); err != nil {
+		return Frame{}, err
+	}
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	restore, stop := c.applyReadContext(ctx)
+	defer func() {
+		stop()
+		restore()
+	}()
+
+	fr, err := c.readFrame(ctx)
+	if err != nil {
+		return Frame{}, err
+	}
+	if err := c.checkAuthenticated(fr.typ); err != nil {
+		return Frame{}, err
+	}
+	return Frame{
+		Type:     fr.typ,
+		Flags:    fr.flags,
+		StreamID: fr.streamID,
+		Payload:  fr.payload,
+	}, nil
+}
+
+// DrainMessage skips the rest of a message read with ReadRawFrame: given the
+// last frame read, it discards the message's remaining fragments up to and
+// including END, so the connection is left at a message boundary for the next
+// ReadNext or ReadRawFrame. It returns immediately if last already ends the
+// message.
+//
+// Draining is cheap (fragments are read and dropped, never reassembled) but
+// still receives the whole message. If the sender abandons the message with a
+// reset frame instead, DrainMessage returns the *StreamResetError and the
+// connection remains usable. Anything else that breaks the fragment sequence
+// closes the connection, as in ReadNext.
+func (c *Conn) DrainMessage(ctx context.Context, last Frame) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if last.Flags.IsEnd() {
+		return nil
+	}
+	ctx, cancel := withDefaultTimeout(ctx, c.defaultReadTimeout)
+	defer cancel()
+
+	if c.closed.Load() {
+		return ErrConnClosed
+	}
+	if err := c.checkAuthenticated(last.Type); err != nil {
+		return err
+	}
+	if err := c.waitReadable(ctx); err != nil {
+		return err
+	}
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	restore, stop := c.applyReadContext(ctx)
+	defer func() {
+		stop()
+		restore()
+	}()
+
+	c.emptyFragments = 0
+	return c.drainFragments(ctx, last.Type, last.StreamID)
+}
+
+// drainFragments reads and discards fragments of the typ message streamID
+// until its END.
+func (c *Conn) drainFragments(ctx context.Context, typ Type, streamID uint64) error {
+	for {
+		next, err := c.readFragment(ctx, typ, streamID)
+		if err != nil {
+			return err
+		}
+		if next.flags.IsEnd() {
+			return nil
+		}
+	}
+}
+
+// WriteRawFrame writes f exactly as given. Only header-level rules are checked
+// (known type, no reserved flag bits, payload within maxFramePayload), the same
+// ones ReadRawFrame applies, so any frame it returns can be forwarded; the
+// caller is responsible for producing a valid frame sequence.
+//
+// To end a message built from raw frames when the last data has already been
+// written, send a frame with only END set and an empty payload; ReadNext
+// accepts it as the terminator for every fragmentable type.
+//
+// WriteRawFrame waits for a message being written by Send or another write
+// method to be complete, so it is safe for injecting control frames. The
+// reverse does not hold: mixing WriteRawFrame and Send on the same Conn is the
+// caller's responsibility, as a Send between two raw fragments of one message
+// corrupts it.
+func (c *Conn) WriteRawFrame(ctx context.Context, f Frame) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := withDefaultTimeout(ctx, c.defaultWriteTimeout)
+	defer cancel()
+
+	if c.closed.Load() {
+		return ErrConnClosed
+	}
+	if !isKnownType(f.Type) {
+		return errors.Join(ErrProtocol, ErrUnknownType)
+	}
+	if !validFlags(f.Type, f.Flags) {
+		return errors.Join(ErrProtocol, ErrInvalidFlags)
+	}
+	if len(f.Payload) > c.maxFramePayload {
+		return errors.Join(ErrProtocol, ErrFrameTooLarge)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	restore, stop := c.applyWriteContext(ctx)
+	defer func() {
+		stop()
+		restore()
+	}()
+
+	if err := c.flushCoalescedLocked(); err != nil {
+		return c.closedErr(err)
+	}
+	return c.closedErr(encodeFrameTo(statsWriter{c}, f.Type, f.Flags, f.StreamID, f.Payload))
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+)
+
+// Reader starts a read loop that delivers data and auth messages on the
+// returned message channel, so callers need not filter keepalives themselves.
+// Pings are answered with a pong when WithAutoPong is set and dropped
+// otherwise; pongs are always dropped.
+//
+// The loop runs until ctx is cancelled or ReadNext fails. It then sends the
+// terminating error (ctx.Err() on cancellation) on the error channel and
+// closes both channels. Errors that lose only the message they concern and
+// leave the connection usable, namely a *StreamResetError,
+// ErrPayloadValidation and an EnvelopeError under WithKeepOpenOnEnvelopeError,
+// are sent on the error channel as well but do not stop the loop. Callers
+// should receive from both until the message channel is closed.
+//
+// Only one Reader may run at a time, and ReadNext must not be called while it
+// runs. Calling Reader while another is active reports ErrReaderActive.
+func (c *Conn) Reader(ctx context.Context) (<-chan Message, <-chan error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	msgs := make(chan Message)
+	errs := make(chan error, 1)
+
+	if !c.readerActive.CompareAndSwap(false, true) {
+		errs <- ErrReaderActive
+		close(errs)
+		close(msgs)
+		return msgs, errs
+	}
+
+	go func() {
+		defer c.readerActive.Store(false)
+		defer close(msgs)
+		defer close(errs)
+
+		for {
+			msg, err := c.ReadNext(ctx)
+			if err != nil && readErrRecoverable(c, err) {
+				select {
+				case errs <- err:
+					continue
+				case <-ctx.Done():
+					errs <- ctx.Err()
+					return
+				}
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			switch msg.Type {
+			case TypePing:
+				if !c.autoPong {
+					continue
+				}
+				if err := c.Send(ctx, Message{Type: TypePong}); err != nil {
+					errs <- err
+					return
+				}
+				continue
+			case TypePong:
+				continue
+			}
+
+			select {
+			case msgs <- msg:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return msgs, errs
+}
+
+// readErrRecoverable reports whether err, returned by ReadNext on c, lost only
+// the message it concerns and left c positioned on the next one.
+func readErrRecoverable(c *Conn, err error) bool {
+	if c.closed.Load() {
+		return false
+	}
+	var ee *EnvelopeError
+	return errors.Is(err, ErrStreamReset) || errors.Is(err, ErrPayloadValidation) || errors.As(err, &ee)
+}
@@ -0,0 +1,246 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReconnectMinBackoff = 100 * time.Millisecond
+	defaultReconnectMaxBackoff = 30 * time.Second
+)
+
+// ReconnectConfig configures NewReconnecting.
+type ReconnectConfig struct {
+	// MinBackoff is the delay before redialing after a failed dial; it doubles
+	// after every further failure. Defaults to 100ms.
+	MinBackoff time.Duration
+
+	// MaxBackoff caps the delay between dial attempts. Defaults to 30s.
+	MaxBackoff time.Duration
+}
+
+// ReconnectingConn keeps a Conn available across transport failures by
+// redialing in the background. It offers the Send/ReadNext surface of Conn;
+// while no connection is up, both return ErrReconnecting.
+//
+// Delivery is at-most-once. Nothing is buffered or replayed: a message whose
+// Send failed may or may not have reached the peer, and stream IDs are scoped
+// to one connection, so a response to a request sent on a previous connection
+// never arrives. When ReadNext or Send returns ErrReconnecting, callers must
+// treat every request still awaiting a response as failed; resending them
+// turns delivery into at-least-once, which is only safe for idempotent
+// requests. Generation tells connections apart.
+//
+// Like Conn, ReconnectingConn is safe for one concurrent reader and one
+// concurrent writer.
+type ReconnectingConn struct {
+	dial func(ctx context.Context) (*Conn, error)
+	cfg  ReconnectConfig
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	conn    *Conn
+	gen     uint64
+	ready   chan struct{} // closed once conn is set
+	dialing bool
+	closed  bool
+}
+
+// NewReconnecting returns a ReconnectingConn that obtains connections from
+// dial, which must return a ready-to-use Conn: dialed and, where required,
+// authenticated. The first dial starts immediately in the background; use
+// WaitReady to wait for it.
+func NewReconnecting(dial func(ctx context.Context) (*Conn, error), cfg ReconnectConfig) *ReconnectingConn {
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = defaultReconnectMinBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = max(defaultReconnectMaxBackoff, cfg.MinBackoff)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := &ReconnectingConn{
+		dial:   dial,
+		cfg:    cfg,
+		ctx:    ctx,
+		cancel: cancel,
+		ready:  make(chan struct{}),
+	}
+	rc.mu.Lock()
+	rc.redialLocked()
+	rc.mu.Unlock()
+	return rc
+}
+
+// Send sends msg on the current connection. It returns ErrReconnecting,
+// wrapping the transport error if there is one, when no connection is up or
+// the connection failed during the write; msg may then have been delivered or
+// not.
+func (rc *ReconnectingConn) Send(ctx context.Context, msg Message) error {
+	c, err := rc.current()
+	if err != nil {
+		return err
+	}
+	return rc.check(ctx, c, c.Send(ctx, msg))
+}
+
+// ReadNext reads the next message from the current connection. It returns
+// ErrReconnecting, wrapping the transport error if there is one, when no
+// connection is up or the connection failed; see ReconnectingConn for what
+// that means for requests in flight.
+func (rc *ReconnectingConn) ReadNext(ctx context.Context) (Message, error) {
+	c, err := rc.current()
+	if err != nil {
+		return Message{}, err
+	}
+	msg, err := c.ReadNext(ctx)
+	return msg, rc.check(ctx, c, err)
+}
+
+// WaitReady blocks until a connection is up, ctx is done, or rc is closed.
+func (rc *ReconnectingConn) WaitReady(ctx context.Context) error {
+	rc.mu.Lock()
+	ready, closed := rc.ready, rc.closed
+	rc.mu.Unlock()
+	if closed {
+		return ErrConnClosed
+	}
+
+	select {
+	case <-ready:
+		return nil
+	case <-rc.ctx.Done():
+		return ErrConnClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Generation returns the number of connections established so far; it
+// changes whenever a new connection replaces a failed one, and is 0 until the
+// first dial succeeds.
+func (rc *ReconnectingConn) Generation() uint64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.gen
+}
+
+// Close closes the current connection and stops redialing. Later calls to
+// Send and ReadNext return ErrConnClosed.
+func (rc *ReconnectingConn) Close() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.closed {
+		return nil
+	}
+	rc.closed = true
+	rc.cancel()
+	if rc.conn != nil {
+		return rc.conn.Close()
+	}
+	return nil
+}
+
+func (rc *ReconnectingConn) current() (*Conn, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	switch {
+	case rc.closed:
+		return nil, ErrConnClosed
+	case rc.conn == nil:
+		return nil, ErrReconnecting
+	default:
+		return rc.conn, nil
+	}
+}
+
+// check inspects the result of an operation on c. If it shows c is unusable,
+// c is dropped, a redial starts and err is reported as ErrReconnecting.
+func (rc *ReconnectingConn) check(ctx context.Context, c *Conn, err error) error {
+	if err == nil || !connBroken(ctx, c, err) {
+		return err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.closed {
+		return ErrConnClosed
+	}
+	if rc.conn == c {
+		_ = c.Close()
+		rc.conn = nil
+		rc.ready = make(chan struct{})
+		rc.redialLocked()
+	}
+	return fmt.Errorf("%w: %w", ErrReconnecting, err)
+}
+
+// connBroken reports whether err, returned by an operation on c, leaves c
+// unusable. Failures once the caller's ctx is done and errors that leave the
+// stream intact, such as ErrPayloadValidation or a rejected outgoing message,
+// do not. Neither do timeouts, e.g. from WithDefaultReadTimeout on an idle
+// connection, unless they made c close itself or, for a NewRWC transport
+// without deadlines, closed the transport.
+func connBroken(ctx context.Context, c *Conn, err error) bool {
+	if c.State().Closed || c.transportClosed() {
+		return true
+	}
+	// The transport deadline derived from ctx may fire just before ctx itself
+	// reports it, surfacing as a transport timeout.
+	if d, ok := ctx.Deadline(); ctx.Err() != nil || ok && !time.Now().Before(d) {
+		return false
+	}
+	var ne net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &ne) && !ne.Timeout()
+}
+
+// redialLocked starts the dial loop unless it is already running. The caller
+// must hold mu.
+func (rc *ReconnectingConn) redialLocked() {
+	if rc.dialing || rc.closed {
+		return
+	}
+	rc.dialing = true
+	go rc.dialLoop()
+}
+
+func (rc *ReconnectingConn) dialLoop() {
+	backoff := rc.cfg.MinBackoff
+	for {
+		c, err := rc.dial(rc.ctx)
+		if err == nil {
+			rc.mu.Lock()
+			rc.dialing = false
+			if rc.closed {
+				rc.mu.Unlock()
+				_ = c.Close()
+				return
+			}
+			rc.conn = c
+			rc.gen++
+			close(rc.ready)
+			rc.mu.Unlock()
+			return
+		}
+
+		select {
+		case <-rc.ctx.Done():
+			rc.mu.Lock()
+			rc.dialing = false
+			rc.mu.Unlock()
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, rc.cfg.MaxBackoff)
+	}
+}
@@ -0,0 +1,104 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const maxResetReasonLen = 255
+
+// StreamResetError is returned by ReadNext when the peer sent a TypeReset
+// frame: the message on StreamID was abandoned, and any part of it already
+// received is discarded. It matches ErrStreamReset. Unlike RemoteError, it
+// only ends one stream; the connection stays usable.
+type StreamResetError struct {
+	StreamID uint64
+	Reason   string
+}
+
+func (e *StreamResetError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("stream %d reset by peer: %s", e.StreamID, e.Reason)
+	}
+	return fmt.Sprintf("stream %d reset by peer", e.StreamID)
+}
+
+func (e *StreamResetError) Is(target error) bool { return target == ErrStreamReset }
+
+// ResetStream tells the peer that the message on streamID was abandoned,
+// e.g. a request the caller no longer wants answered. reason is optional
+// and at most 255 bytes.
+func (c *Conn) ResetStream(ctx context.Context, streamID uint64, reason string) error {
+	return c.Send(ctx, Message{Type: TypeReset, StreamID: streamID, Payload: []byte(reason)})
+}
+
+// parseReset decodes a TypeReset frame into the *StreamResetError it
+// signals, or returns a protocol error for a malformed one.
+func parseReset(fr frame) error {
+	if fr.flags != startEndFlags {
+		return fmt.Errorf("%w: reset must be START|END", ErrProtocol)
+	}
+	if len(fr.payload) > maxResetReasonLen {
+		return fmt.Errorf("%w: reset reason of %d bytes too long", ErrProtocol, len(fr.payload))
+	}
+	return &StreamResetError{StreamID: fr.streamID, Reason: string(fr.payload)}
+}
+
+// SendStream sends everything read from r as the Data of the message_payload
+// described by msg, whose own Data is ignored, without buffering it all.
+// Headers and padding need the whole message up front, so SendStream rejects
+// a PayloadFormatHeaders message and a connection with WithPadding.
+//
+// A message normally ends with its END frame. If r fails or ctx is done after
+// the first frame was written, SendStream instead ends the message with a
+// TypeReset frame and returns the cause; the peer's ReadNext discards what it
+// received of the message and returns a *StreamResetError. The connection
+// stays usable unless the reset itself cannot be written, in which case it is
+// closed.
+//
+// ctx is checked before each read from r, and does not interrupt a frame
+// write in progress: cutting a frame short would break the framing for the
+// whole connection. Use WithWriteTimeout to bound each write instead.
+func (c *Conn) SendStream(ctx context.Context, msg Message, r io.Reader) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if c.closed.Load() {
+		return ErrConnClosed
+	}
+	msg.Type = TypeMessagePayload
+	msg.Data = nil
+	if err := c.validateOutgoing(msg); err != nil {
+		return err
+	}
+	format := c.outgoingFormat(msg.Format)
+	if format == PayloadFormatHeaders || len(c.padBuckets) > 0 {
+		return fmt.Errorf("%w: SendStream does not support headers or padding", ErrProtocol)
+	}
+	prefix := Envelope{Kind: msg.Kind, Format: format, RouteHint: msg.RouteHint}.Encode()
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	restore, stop := c.applyWriteContext(context.WithoutCancel(ctx))
+	defer func() {
+		stop()
+		restore()
+	}()
+
+	if err := c.flushCoalescedLocked(); err != nil {
+		return c.closedErr(err)
+	}
+	return c.closedErr(c.writeStream(ctx, statsWriter{c}, TypeMessagePayload, msg.StreamID, prefix, r, func(cause error) error {
+		reason := "aborted"
+		if errors.Is(cause, context.Canceled) || errors.Is(cause, context.DeadlineExceeded) {
+			reason = "cancelled"
+		}
+		if err := encodeFrameTo(statsWriter{c}, TypeReset, startEndFlags, msg.StreamID, []byte(reason)); err != nil {
+			_ = c.Close()
+		}
+		return cause
+	}))
+}
@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// resumeHeaderLen is Offset (8) + Key Length (2).
+	resumeHeaderLen = 10
+
+	maxResumeKeyLen = 255
+
+	// streamChunkSize caps the frame payloads emitted while streaming from an
+	// io.Reader, so streaming never buffers a full maxFramePayload.
+	streamChunkSize = 32 << 10
+)
+
+// Resume is a decoded resume message: the continuation of the resumable
+// upload identified by Key, starting at byte Offset of that upload.
+type Resume struct {
+	Key    string
+	Offset uint64
+	Data   []byte
+}
+
+// ParseResume decodes the payload of a TypeResume message.
+func ParseResume(payload []byte) (Resume, error) {
+	if len(payload) < resumeHeaderLen {
+		return Resume{}, errors.Join(ErrProtocol, ErrResume)
+	}
+	offset := binary.BigEndian.Uint64(payload[0:8])
+	keyLen := int(binary.BigEndian.Uint16(payload[8:10]))
+	if keyLen == 0 || keyLen > maxResumeKeyLen || len(payload) < resumeHeaderLen+keyLen {
+		return Resume{}, errors.Join(ErrProtocol, ErrResume)
+	}
+	return Resume{
+		Key:    string(payload[resumeHeaderLen : resumeHeaderLen+keyLen]),
+		Offset: offset,
+		Data:   payload[resumeHeaderLen+keyLen:],
+	}, nil
+}
+
+// ResumeStream sends everything read from r as the continuation, starting at
+// byte offset, of the resumable upload identified by key. The first attempt of
+// a resumable upload is simply ResumeStream with offset 0, so the receiver
+// learns the key before any reconnect happens.
+//
+// Delivery is at-least-once: after a reconnect the sender resumes from the last
+// offset it believes was received, so the receiver may see bytes it already
+// has and must discard any data below its own committed offset. A resume whose
+// offset is beyond what the receiver holds leaves a gap and should be rejected
+// by the application.
+//
+// If r fails or ctx is done after the first frame was written, the logical
+// message cannot be completed and the connection is closed.
+func (c *Conn) ResumeStream(ctx context.Context, key string, offset uint64, r io.Reader) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if c.closed.Load() {
+		return ErrConnClosed
+	}
+	if len(key) == 0 || len(key) > maxResumeKeyLen {
+		return fmt.Errorf("%w: resume key must be 1..%d bytes", ErrProtocol, maxResumeKeyLen)
+	}
+
+	prefix := make([]byte, resumeHeaderLen+len(key))
+	binary.BigEndian.PutUint64(prefix[0:8], offset)
+	binary.BigEndian.PutUint16(prefix[8:10], uint16(len(key)))
+	copy(prefix[resumeHeaderLen:], key)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	restore, stop := c.applyWriteContext(ctx)
+	defer func() {
+		stop()
+		restore()
+	}()
+
+	if err := c.flushCoalescedLocked(); err != nil {
+		return c.closedErr(err)
+	}
+	return c.writeStream(ctx, statsWriter{c}, TypeResume, 0, prefix, r, func(cause error) error {
+		_ = c.Close()
+		return cause
+	})
+}
+
+// writeStream encodes prefix followed by everything read from r as a single
+// logical message, reading only one frame ahead of the wire.
+//
+// If r fails or ctx is done before the first frame is written, writeStream
+// returns the error and nothing reached the wire. Afterwards the message is
+// left unfinished, and writeStream returns abort(cause) instead.
+func (c *Conn) writeStream(ctx context.Context, w io.Writer, typ Type, streamID uint64, prefix []byte, r io.Reader, abort func(cause error) error) error {
+	chunkSize := min(c.maxFramePayload, streamChunkSize)
+	if len(prefix) > chunkSize {
+		return fmt.Errorf("%w: maxFramePayload too small for stream prefix", ErrProtocol)
+	}
+
+	br := bufio.NewReader(r)
+	buf := make([]byte, chunkSize)
+	filled := copy(buf, prefix)
+	flags := FlagStart
+	fail := func(cause error) error {
+		if !flags.IsStart() {
+			return abort(cause)
+		}
+		return cause
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+		n, err := io.ReadFull(br, buf[filled:])
+		filled += n
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return encodeFrameTo(w, typ, flags|FlagEnd, streamID, buf[:filled])
+		case err != nil:
+			return fail(err)
+		}
+
+		// The frame is full; peek to learn whether it is also the last one.
+		if _, err := br.Peek(1); err == io.EOF {
+			return encodeFrameTo(w, typ, flags|FlagEnd, streamID, buf[:filled])
+		} else if err != nil {
+			return fail(err)
+		}
+
+		if err := encodeFrameTo(w, typ, flags, streamID, buf[:filled]); err != nil {
+			return err
+		}
+		flags = 0
+		filled = 0
+	}
+}
@@ -0,0 +1,139 @@
+package protocol
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// transport is what Conn needs from the underlying connection. net.Conn
+// satisfies it; NewRWC adapts other io.ReadWriteClosers.
+type transport interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// NewRWC is like New for a transport that is not a net.Conn, such as a
+// WebSocket wrapper or an in-process pipe.
+//
+// If rwc has SetReadDeadline and SetWriteDeadline methods they are used as
+// is. Otherwise deadlines are emulated by closing rwc when one expires, and
+// the interrupted Read or Write reports os.ErrDeadlineExceeded. Because the
+// emulation cannot interrupt an I/O call without closing rwc, any expired
+// deadline ends the connection: a cancelled context, WithReadIdleTimeout,
+// WithWriteTimeout and the like all close it, where a net.Conn would stay
+// usable after a cancelled ReadNext.
+func NewRWC(rwc io.ReadWriteCloser, opts ...Option) *Conn {
+	t, ok := rwc.(transport)
+	if !ok {
+		t = &deadlineEmulator{rwc: rwc}
+	}
+	return newConn(t, opts...)
+}
+
+// deadlineEmulator provides deadlines for an io.ReadWriteCloser that has
+// none, by closing it when a deadline expires.
+type deadlineEmulator struct {
+	rwc io.ReadWriteCloser
+
+	mu         sync.Mutex
+	readTimer  *time.Timer
+	writeTimer *time.Timer
+
+	readExpired  atomic.Bool
+	writeExpired atomic.Bool
+}
+
+// expired reports whether a deadline has expired and so closed rwc.
+func (d *deadlineEmulator) expired() bool {
+	return d.readExpired.Load() || d.writeExpired.Load()
+}
+
+// transportClosed reports whether the transport of c closed itself, as the
+// NewRWC deadline emulation does when a deadline expires, without c.Close
+// being called.
+func (c *Conn) transportClosed() bool {
+	d, ok := c.nc.(*deadlineEmulator)
+	return ok && d.expired()
+}
+
+func (d *deadlineEmulator) Read(p []byte) (int, error) {
+	if d.readExpired.Load() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, err := d.rwc.Read(p)
+	if err != nil && d.readExpired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (d *deadlineEmulator) Write(p []byte) (int, error) {
+	if d.writeExpired.Load() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, err := d.rwc.Write(p)
+	if err != nil && d.writeExpired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (d *deadlineEmulator) Close() error {
+	d.mu.Lock()
+	for _, t := range []*time.Timer{d.readTimer, d.writeTimer} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+	d.mu.Unlock()
+	return d.rwc.Close()
+}
+
+// CloseWrite forwards to rwc if it supports half-close, and otherwise closes
+// it, like Conn.CloseWrite does for a net.Conn without half-close.
+func (d *deadlineEmulator) CloseWrite() error {
+	if hc, ok := d.rwc.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return d.Close()
+}
+
+// RemoteAddr forwards to rwc if it reports an address.
+func (d *deadlineEmulator) RemoteAddr() net.Addr {
+	if ra, ok := d.rwc.(interface{ RemoteAddr() net.Addr }); ok {
+		return ra.RemoteAddr()
+	}
+	return nil
+}
+
+func (d *deadlineEmulator) SetReadDeadline(t time.Time) error {
+	d.setDeadline(&d.readTimer, &d.readExpired, t)
+	return nil
+}
+
+func (d *deadlineEmulator) SetWriteDeadline(t time.Time) error {
+	d.setDeadline(&d.writeTimer, &d.writeExpired, t)
+	return nil
+}
+
+func (d *deadlineEmulator) setDeadline(timer **time.Timer, expired *atomic.Bool, t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if t.IsZero() || expired.Load() {
+		return
+	}
+	*timer = time.AfterFunc(time.Until(t), func() {
+		expired.Store(true)
+		_ = d.rwc.Close()
+	})
+}
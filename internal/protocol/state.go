@@ -0,0 +1,59 @@
+package protocol
+
+import "time"
+
+// ConnState is a point-in-time snapshot of a Conn, for debugging and metrics.
+type ConnState struct {
+	// Closed reports whether the Conn was closed locally, either by Close or
+	// by the Conn itself after a protocol violation. A close by the peer is
+	// only observed as a read or write error.
+	Closed bool
+
+	// Authenticated reports whether MarkAuthenticated was called.
+	Authenticated bool
+
+	// RequireAuthFirst reports whether the WithRequireAuthFirst gate is on.
+	RequireAuthFirst bool
+
+	// Version is the frame format version in use. v1 is the only version and
+	// is not negotiated.
+	Version byte
+
+	// MaxFramePayload is the effective global frame payload limit.
+	MaxFramePayload int
+
+	// MaxPayloadByType holds the per-type overrides of MaxFramePayload.
+	MaxPayloadByType map[Type]int
+
+	// ReadIdleTimeout is the per-frame read timeout, or 0 if unset.
+	ReadIdleTimeout time.Duration
+
+	// WriteTimeout is the per-frame write timeout, or 0 if unset.
+	WriteTimeout time.Duration
+
+	// WriteStallTimeout is the WithWriteStallTimeout limit, or 0 if unset.
+	WriteStallTimeout time.Duration
+}
+
+// State returns a snapshot of the connection's state. It is safe to call
+// concurrently with reads and writes.
+func (c *Conn) State() ConnState {
+	var byType map[Type]int
+	if len(c.maxPayloadByType) > 0 {
+		byType = make(map[Type]int, len(c.maxPayloadByType))
+		for t, n := range c.maxPayloadByType {
+			byType[t] = n
+		}
+	}
+	return ConnState{
+		Closed:            c.closed.Load(),
+		Authenticated:     c.authenticated.Load(),
+		RequireAuthFirst:  c.requireAuthFirst,
+		Version:           v1Version,
+		MaxFramePayload:   c.maxFramePayload,
+		MaxPayloadByType:  byType,
+		ReadIdleTimeout:   c.readIdleTimeout,
+		WriteTimeout:      c.writeTimeout,
+		WriteStallTimeout: c.writeStallTimeout,
+	}
+}
@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"net"
+)
+
+// ConnStats counts the traffic of a Conn since it was created.
+type ConnStats struct {
+	BytesSent      uint64
+	BytesReceived  uint64
+	FramesSent     uint64
+	FramesReceived uint64
+
+	// ReadInProgress and WriteInProgress report whether a read or write call
+	// was running when the snapshot was taken. On shutdown, either being set
+	// means a message may have been cut off.
+	ReadInProgress  bool
+	WriteInProgress bool
+}
+
+// Stats returns a snapshot of the connection's traffic counters.
+func (c *Conn) Stats() ConnStats {
+	return ConnStats{
+		BytesSent:       c.bytesSent.Load(),
+		BytesReceived:   c.bytesReceived.Load(),
+		FramesSent:      c.framesSent.Load(),
+		FramesReceived:  c.framesReceived.Load(),
+		ReadInProgress:  c.reading.Load(),
+		WriteInProgress: c.writing.Load(),
+	}
+}
+
+// WriteInProgress reports whether a write call (Send, SendBatch, SendStream,
+// ResumeStream, WriteRawFrame, ...) is running, possibly in the middle of a
+// fragmented message. It is the Stats().WriteInProgress snapshot.
+//
+// The answer may be stale by the time it is used, so it is for metrics and
+// diagnostics only. To inject a frame at a message boundary, just call
+// WriteRawFrame or Send: every write method holds the write lock for a whole
+// message, so the frame queues behind the message in progress and never lands
+// between its fragments.
+func (c *Conn) WriteInProgress() bool { return c.writing.Load() }
+
+// FrameInfo describes one received frame for WithFrameObserver. It is taken
+// from the frame header, before reassembly.
+type FrameInfo struct {
+	Type       Type
+	Flags      Flags
+	StreamID   uint64
+	PayloadLen int
+}
+
+// CloseWithStats snapshots Stats at the moment of shutdown and then closes the
+// connection, so callers can log whether traffic was cut off mid-message.
+func (c *Conn) CloseWithStats() (ConnStats, error) {
+	st := c.Stats()
+	return st, c.Close()
+}
+
+// frameCounter is implemented by writers that count the frames encoded to
+// them; see encodeFrameTo.
+type frameCounter interface {
+	countFrame()
+}
+
+// buffersWriter is implemented by writers that can pass net.Buffers on to the
+// transport, so that it may use a single vectored write.
+type buffersWriter interface {
+	writeBuffers(bufs *net.Buffers) (int64, error)
+}
+
+// statsWriter writes to the connection, counting bytes and frames sent. Every
+// write re-arms the WithWriteTimeout and WithWriteStallTimeout deadline.
+type statsWriter struct{ c *Conn }
+
+func (w statsWriter) Write(p []byte) (int, error) {
+	if err := w.c.armWriteTimeout(); err != nil {
+		return 0, err
+	}
+	n, err := w.c.nc.Write(p)
+	w.c.bytesSent.Add(uint64(n))
+	return n, w.c.writeTimedOut(int64(n), err)
+}
+
+func (w statsWriter) countFrame() { w.c.framesSent.Add(1) }
+
+func (w statsWriter) writeBuffers(bufs *net.Buffers) (int64, error) {
+	if err := w.c.armWriteTimeout(); err != nil {
+		return 0, err
+	}
+	n, err := bufs.WriteTo(w.c.nc)
+	w.c.bytesSent.Add(uint64(n))
+	return n, w.c.writeTimedOut(n, err)
+}
+
+// statsReader reads from the connection, counting bytes received.
+type statsReader struct{ c *Conn }
+
+func (r statsReader) Read(p []byte) (int, error) {
+	n, err := r.c.nc.Read(p)
+	r.c.bytesReceived.Add(uint64(n))
+	return n, err
+}
+
+// batchBuffer collects encoded frames for SendBatch, counting them so that
+// they are only added to the stats once the batch is written.
+type batchBuffer struct {
+	bytes.Buffer
+	frames uint64
+}
+
+func (b *batchBuffer) countFrame() { b.frames++ }
+
+// frameCountWriter discards what is written to it and counts the frames; see
+// FrameCount.
+type frameCountWriter struct {
+	frames int
+}
+
+func (w *frameCountWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func (w *frameCountWriter) countFrame() { w.frames++ }
+
+var (
+	_ io.Writer     = statsWriter{}
+	_ frameCounter  = statsWriter{}
+	_ buffersWriter = statsWriter{}
+	_ frameCounter  = (*batchBuffer)(nil)
+)
@@ -0,0 +1,60 @@
+package protocol
+
+// TypeInfo describes the framing rules for one known frame type. Send and
+// ReadNext enforce these rules from the same table, so they cannot disagree.
+type TypeInfo struct {
+	Type Type
+
+	// Name is the type's name in docs/architecture/tunnel-protocol.md.
+	Name string
+
+	// ZeroStreamID is true when the stream ID must be 0 and false when it must
+	// be non-zero.
+	ZeroStreamID bool
+
+	// Fragmentable reports whether a logical message may span several frames.
+	// Frames of non-fragmentable types always carry START|END.
+	Fragmentable bool
+
+	// EmptyPayload reports whether the payload must be empty.
+	EmptyPayload bool
+
+	// MinPayload is the minimum length of the logical payload, including any
+	// envelope or header. The message_payload envelope must fit entirely in
+	// the first frame.
+	MinPayload int
+}
+
+var typeInfos = []TypeInfo{
+	{Type: TypeAuthBegin, Name: "auth_begin", ZeroStreamID: true, Fragmentable: true},
+	{Type: TypeAuthChallenge, Name: "auth_challenge", ZeroStreamID: true, Fragmentable: true},
+	{Type: TypeAuthProof, Name: "auth_proof", ZeroStreamID: true, Fragmentable: true},
+	{Type: TypeAuthOK, Name: "auth_ok", ZeroStreamID: true, Fragmentable: true},
+	{Type: TypeAuthError, Name: "auth_error", ZeroStreamID: true, Fragmentable: true},
+	{Type: TypeMessagePayload, Name: "message_payload", Fragmentable: true, MinPayload: envelopeLen},
+	{Type: TypeReset, Name: "reset"},
+	{Type: TypeResume, Name: "resume", ZeroStreamID: true, Fragmentable: true, MinPayload: resumeHeaderLen},
+	{Type: TypeError, Name: "error", ZeroStreamID: true, Fragmentable: true, MinPayload: 2},
+	{Type: TypePing, Name: "ping", ZeroStreamID: true, EmptyPayload: true},
+	{Type: TypePong, Name: "pong", ZeroStreamID: true, EmptyPayload: true},
+}
+
+// KnownTypes returns the rules for every frame type this package understands,
+// in ascending type order.
+func KnownTypes() []TypeInfo {
+	return append([]TypeInfo(nil), typeInfos...)
+}
+
+func lookupTypeInfo(t Type) (TypeInfo, bool) {
+	for _, info := range typeInfos {
+		if info.Type == t {
+			return info, true
+		}
+	}
+	return TypeInfo{}, false
+}
+
+// validStreamID reports whether streamID satisfies the type's stream ID rule.
+func (info TypeInfo) validStreamID(streamID uint64) bool {
+	return info.ZeroStreamID == (streamID == 0)
+}
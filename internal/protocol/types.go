@@ -14,6 +14,16 @@ const (
 
 	TypeMessagePayload Type = 0x10
 
+	// TypeReset abandons the message on one stream. See StreamResetError.
+	TypeReset Type = 0x11
+
+	// TypeResume carries the continuation of a resumable upload. See Resume.
+	TypeResume Type = 0x14
+
+	// TypeError is a connection-level error notice sent before closing. See
+	// RemoteError.
+	TypeError Type = 0x15
+
 	TypePing Type = 0xFE
 	TypePong Type = 0xFF
 )
@@ -33,15 +43,66 @@ type PayloadFormat byte
 const (
 	// PayloadFormatOpaqueBytes corresponds to Format=0x00 in v1.
 	PayloadFormatOpaqueBytes PayloadFormat = 0x00
+
+	// PayloadFormatJSON marks Data as a UTF-8 JSON document. The tunnel does
+	// not parse it; see WithPayloadValidator for receiver-side checks.
+	PayloadFormatJSON PayloadFormat = 0x01
+
+	// PayloadFormatHeaders marks Data as a header block followed by an opaque
+	// body; see Message.Headers. Peers that predate it reject the format, so
+	// only use it when the peer is known to support it.
+	PayloadFormatHeaders PayloadFormat = 0x02
 )
 
+func isAuthType(t Type) bool {
+	switch t {
+	case TypeAuthBegin, TypeAuthChallenge, TypeAuthProof, TypeAuthOK, TypeAuthError:
+		return true
+	default:
+		return false
+	}
+}
+
+func isKnownKind(k PayloadKind) bool {
+	return k == PayloadKindRequest || k == PayloadKindResponse || k == PayloadKindOneway
+}
+
+func isKnownFormat(f PayloadFormat) bool {
+	return f == PayloadFormatOpaqueBytes || f == PayloadFormatJSON || f == PayloadFormatHeaders
+}
+
+// Flags is the flags field of a frame header.
+type Flags uint16
+
 const (
-	flagStart uint16 = 0x0001
-	flagEnd   uint16 = 0x0002
+	// FlagStart marks the first frame of a message.
+	FlagStart Flags = 0x0001
+
+	// FlagEnd marks the last frame of a message.
+	FlagEnd Flags = 0x0002
+
+	// flagPadded marks the first frame of a padded message_payload; see
+	// WithPadding. It is only valid together with FlagStart.
+	flagPadded Flags = 0x0004
 
-	startEndFlags uint16 = flagStart | flagEnd
+	// flagCompressed marks the first frame of a message_payload whose data is
+	// compressed; see WithCompressionDictionary. It is only valid together
+	// with FlagStart.
+	flagCompressed Flags = 0x0008
+
+	startEndFlags = FlagStart | FlagEnd
 )
 
+// IsStart reports whether f marks the first frame of a message.
+func (f Flags) IsStart() bool { return f&FlagStart != 0 }
+
+// IsEnd reports whether f marks the last frame of a message.
+func (f Flags) IsEnd() bool { return f&FlagEnd != 0 }
+
+// IsComplete reports whether f marks a frame that is both the first and the
+// last of its message, i.e. an unfragmented message.
+func (f Flags) IsComplete() bool { return f&startEndFlags == startEndFlags }
+
 // Message represents one logical tunnel message (reassembled if fragmented).
 //
 // For TypeMessagePayload, Data/Kind/Format are used and Payload is empty.
@@ -53,9 +114,20 @@ type Message struct {
 	// Payload is the logical payload for non-message_payload types.
 	Payload []byte
 
-	// Kind/Format/Data apply to TypeMessagePayload only.
+	// Kind/Format/RouteHint/Data apply to TypeMessagePayload only.
 	Kind   PayloadKind
 	Format PayloadFormat
-	Data   []byte
-}
 
+	// RouteHint is an application-defined value carried in the envelope's
+	// formerly reserved bytes. The tunnel does not interpret it. Peers that
+	// predate it reject non-zero values, so leave it 0 unless the peer is
+	// known to support it.
+	RouteHint uint16
+
+	// Headers are key/value metadata carried before Data when Format is
+	// PayloadFormatHeaders, and must be empty otherwise. Names are 1..255
+	// bytes; a message carries at most 64 headers in at most 8 KiB.
+	Headers map[string]string
+
+	Data []byte
+}